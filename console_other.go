@@ -0,0 +1,6 @@
+//go:build !windows
+
+package main
+
+// enableVirtualTerminal is a no-op outside Windows: terminals interpret ANSI natively.
+func enableVirtualTerminal() error { return nil }
@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// enableVirtualTerminalProcessing is the console mode flag that makes conhost
+// interpret ANSI escape sequences instead of printing them (e.g. "←[32m").
+const enableVirtualTerminalProcessing = 0x0004
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// enableVirtualTerminal turns on ANSI handling for stdout when it is a Windows console.
+// A non-console stdout (a pipe, as under Claude Code) is left alone: whoever reads it
+// interprets the escapes. Returns an error only when a console refuses the mode.
+func enableVirtualTerminal() error {
+	handle := syscall.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(handle, &mode); err != nil {
+		return nil
+	}
+	if mode&enableVirtualTerminalProcessing != 0 {
+		return nil
+	}
+	if ok, _, err := procSetConsoleMode.Call(uintptr(handle), uintptr(mode|enableVirtualTerminalProcessing)); ok == 0 {
+		return err
+	}
+	return nil
+}
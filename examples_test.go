@@ -21,11 +21,12 @@ func weeklyResetAt(elapsedFraction float64) string {
 var ansiRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
 
 var ansiToSVGColor = map[string]string{
-	ColorGreen:  "#22c55e",
-	ColorYellow: "#eab308",
-	ColorRed:    "#ef4444",
-	ColorGray:   "#6b7280",
-	ColorReset:  "#d1d5db",
+	ColorGreen:     "#22c55e",
+	ColorYellow:    "#eab308",
+	ColorRed:       "#ef4444",
+	ColorBrightRed: "#f87171",
+	ColorGray:      "#6b7280",
+	ColorReset:     "#d1d5db",
 }
 
 func ansiToSpans(s string) string {
@@ -1,3 +1,5 @@
 module github.com/stvnksslr/claude-code-litellm-plugin
 
 go 1.26.1
+
+require golang.org/x/text v0.42.0
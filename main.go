@@ -1,20 +1,48 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
 )
 
+// nowFunc is the clock behind every time read (cache TTLs, backoff, countdowns).
+// Tests replace it to pin the current time.
+var nowFunc = time.Now
+
 // Version is set at build time via -ldflags="-X main.Version=vX.Y.Z"
 var Version = "dev"
 
@@ -23,28 +51,112 @@ const GitHubRepo = "stvnksslr/claude-code-litellm-plugin"
 
 // ANSI color codes
 const (
-	ColorGreen  = "\x1b[32m"
-	ColorYellow = "\x1b[33m"
-	ColorRed    = "\x1b[31m"
-	ColorGray   = "\x1b[90m"
-	ColorReset  = "\x1b[0m"
+	ColorGreen     = "\x1b[32m"
+	ColorYellow    = "\x1b[33m"
+	ColorRed       = "\x1b[31m"
+	ColorBrightRed = "\x1b[91m" // exhausted budget
+	ColorGray      = "\x1b[90m"
+	ColorBlink     = "\x1b[5m" // LITELLM_BLOCKED_MARKER=blink
+	ColorReset     = "\x1b[0m"
 )
 
 // Cache configuration
 const (
-	CacheTTLMs         = 30_000          // 30 seconds in milliseconds
-	BudgetFailTTLMs    = 10_000          // negative-cache window for failed budget fetches
-	HTTPTimeout        = 3 * time.Second // fast failure for subprocess/statusline use
-	UpdateCheckTTLMs   = 60 * 60 * 1_000 // 1 hour in milliseconds
-	UpdateCheckTimeout = 5 * time.Second
+	CacheTTLMs              = 30_000          // 30 seconds in milliseconds
+	StaleTTLMs              = 5 * 60 * 1_000  // serve expired cache up to 5 minutes while revalidating
+	BudgetFailTTLMs         = 10_000          // negative-cache window after a first failed budget fetch
+	BudgetFailMaxTTLMs      = 5 * 60 * 1_000  // cap for the window as consecutive failures double it
+	BreakerProbeMs          = 10_000          // lease on a half-open probe; other invocations stay open meanwhile
+	DefaultBreakerThreshold = 1               // consecutive failures before the breaker opens
+	HTTPTimeout             = 3 * time.Second // fast failure for subprocess/statusline use
+	UpdateCheckTTLMs        = 60 * 60 * 1_000 // 1 hour in milliseconds
+	UpdateCheckTimeout      = 5 * time.Second
+	TopModelTTLMs           = 5 * 60 * 1_000          // /spend/logs is heavier, so the top-model summary is cached longer
+	OrgReportTTLMs          = 10 * 60 * 1_000         // /global/spend/report scans the whole org's spend
+	DefaultRetries          = 1                       // extra attempts after a transient failure
+	RetryDelay              = 250 * time.Millisecond  // pause before each retry
+	FastConnectTimeout      = 500 * time.Millisecond  // -fast: a down proxy fails within half a second
+	FastReadTimeout         = 1500 * time.Millisecond // -fast: wait for the response headers
+	MaxResetTimeMemo        = 8                       // parsed reset times kept; a daemon sees a new one each period
+	RevalidateLease         = 30 * time.Second        // a -revalidate child's claim; past it the child is presumed dead
+)
+
+// Daemon mode (-daemon / -client)
+const (
+	DaemonDialTimeout = 200 * time.Millisecond // a client gives up quickly and renders in-process instead
+	DaemonConnTimeout = 10 * time.Second       // covers a cold fetch plus the update check
+)
+
+// MaxBodyBytes caps how much of a response body is read (and, separately, how much it
+// may decompress to), so a misbehaving proxy can't exhaust memory.
+const MaxBodyBytes = 1 << 20
+
+// DefaultSeparator goes between status segments unless LITELLM_SEPARATOR overrides it.
+const DefaultSeparator = " | "
+
+// SpendResetRatio is how far spend must fall between fetches, as a fraction of the
+// previous value, to be treated as a budget reset (see spendWasReset).
+const SpendResetRatio = 0.5
+
+// DefaultModelsMaxLen is how many characters the LITELLM_SHOW_MODELS=list segment may use.
+const DefaultModelsMaxLen = 30
+
+// ProxyResetGrace is how long past budget_reset_at the proxy gets to actually reset
+// spend (its reset job runs periodically) before the data is flagged as possibly stale.
+const ProxyResetGrace = 15 * time.Minute
+
+// MaxPlausibleReset bounds how far away a reset may be when no budget_duration is
+// known; anything further almost certainly means the local clock is wrong.
+const MaxPlausibleReset = 366 * 24 * time.Hour
+
+// Budget usage thresholds (percent) for the warn (yellow) and critical (red) bands.
+const (
+	BudgetWarnPercent = 75
+	BudgetCritPercent = 90
+)
+
+// Exit codes. Without -exit-code the plugin always exits ExitOK (or ExitUsage on bad
+// flags) so a statusline never breaks.
+const (
+	ExitOK    = 0
+	ExitError = 1 // fetch/config failure or no budget configured (-exit-code only)
+	ExitUsage = 2 // invalid command-line flags
+	ExitWarn  = 3 // usage in the warn band (-exit-code only)
+	ExitCrit  = 4 // usage in the critical band or budget exceeded (-exit-code only)
+)
+
+// Spend history / sparkline
+const (
+	MaxHistorySamples       = 64 // samples kept on disk (oldest dropped first)
+	DefaultSparklineSamples = 10
 )
 
-// ErrAuth is returned when the API responds with a 401 or 403 status.
+// ErrAuth is returned when the API responds with a 401 status.
 var ErrAuth = errors.New("auth error")
 
+// ErrForbidden is returned when the API responds with a 403 status: the key was accepted
+// but isn't allowed to call the endpoint.
+var ErrForbidden = errors.New("forbidden")
+
 // ErrNoAPIKey is returned when neither LITELLM_PROXY_API_KEY nor ANTHROPIC_AUTH_TOKEN is set.
 var ErrNoAPIKey = errors.New("no api key")
 
+// ErrNoCachedData is returned in offline mode (LITELLM_OFFLINE) when nothing has been cached yet.
+var ErrNoCachedData = errors.New("no cached data")
+
+// ErrBadResponse is returned when the proxy answers 200 with a body that isn't the
+// expected JSON (e.g. an HTML login page from a misrouted request).
+var ErrBadResponse = errors.New("unexpected response")
+
+// ErrConfig is returned when the config file (see loadConfig) can't be read or parsed.
+var ErrConfig = errors.New("config error")
+
+// ErrInvalidColor is returned by parseColor for a value it can't turn into a color.
+var ErrInvalidColor = errors.New("invalid color")
+
+// ErrInternal marks the status rendered after a recovered panic (see run).
+var ErrInternal = errors.New("internal error")
+
 // ErrBudgetExceeded is returned when the API reports the key's budget has been exceeded.
 var ErrBudgetExceeded = errors.New("budget exceeded")
 
@@ -60,12 +172,70 @@ func (e *BudgetExceededError) Is(target error) bool {
 }
 func (e *BudgetExceededError) Unwrap() error { return ErrBudgetExceeded }
 
-// liteLLMError is the error envelope returned by LiteLLM on non-2xx responses.
+// RetryAfterError wraps a failed fetch for which the proxy asked the client to wait
+// (429/503 with a Retry-After header). The breaker stays open at least that long.
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *RetryAfterError) Error() string { return e.Err.Error() }
+func (e *RetryAfterError) Unwrap() error { return e.Err }
+
+// parseRetryAfter parses a Retry-After header value, either delay-seconds or an
+// HTTP-date, relative to now. ok is false for empty or malformed values.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second, true
+	}
+	when, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(when.Sub(now), 0), true
+}
+
+// liteLLMError is the error envelope returned by LiteLLM on non-2xx responses. Some
+// proxies also send it with a 200.
 type liteLLMError struct {
-	Error struct {
-		Message string `json:"message"`
-		Type    string `json:"type"`
-	} `json:"error"`
+	Error APIError `json:"error"`
+}
+
+// APIError is the error object inside a liteLLMError envelope. fetchKeyInfo returns it
+// when a 200 response carries one: transient errors are retried (see getRetries), and
+// permanent ones match ErrBadResponse.
+type APIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+func (e *APIError) Error() string { return "proxy error: " + e.Message }
+
+func (e *APIError) Unwrap() error {
+	if e.Transient() {
+		return nil
+	}
+	return ErrBadResponse
+}
+
+// transientAPIErrorHints are message fragments of proxy errors that a retry may fix.
+var transientAPIErrorHints = []string{
+	"temporarily unavailable", "service unavailable", "overloaded", "try again", "timeout", "timed out", "rate limit",
+}
+
+// Transient reports whether the error looks temporary, judging by its message and type.
+func (e *APIError) Transient() bool {
+	text := strings.ToLower(e.Message + " " + e.Type)
+	for _, hint := range transientAPIErrorHints {
+		if strings.Contains(text, hint) {
+			return true
+		}
+	}
+	return false
 }
 
 // BudgetCacheEntry is the on-disk representation of a cached budget API response.
@@ -74,21 +244,93 @@ type BudgetCacheEntry struct {
 	Info      KeyInfo `json:"info"`
 }
 
+// TopModelCacheEntry is the on-disk summary of today's highest-spend model. An empty
+// Model records a failed or empty lookup so it backs off for the full TTL.
+type TopModelCacheEntry struct {
+	Timestamp int64   `json:"timestamp"` // Unix milliseconds
+	Model     string  `json:"model,omitempty"`
+	Spend     float64 `json:"spend,omitempty"`
+}
+
+// SpendLogEntry is one row of the /spend/logs response. Depending on the LiteLLM
+// version and query, rows are either individual requests (Model/Spend) or per-day
+// aggregates with a model → spend breakdown (Models).
+type SpendLogEntry struct {
+	Model  string             `json:"model"`
+	Spend  float64            `json:"spend"`
+	Models map[string]float64 `json:"models"`
+}
+
+// OrgSpendReportEntry is one row of /global/spend/report: one day's spend broken down
+// by team (the default grouping). Some proxy versions report the day's total directly.
+type OrgSpendReportEntry struct {
+	Day        string  `json:"group_by_day"`
+	TotalSpend float64 `json:"total_spend"`
+	Teams      []struct {
+		TeamName   string  `json:"team_name"`
+		TotalSpend float64 `json:"total_spend"`
+	} `json:"teams"`
+}
+
+// spend returns the day's total, summing the per-team rows when present.
+func (e OrgSpendReportEntry) spend() float64 {
+	if len(e.Teams) == 0 {
+		return e.TotalSpend
+	}
+	total := 0.0
+	for _, team := range e.Teams {
+		total += team.TotalSpend
+	}
+	return total
+}
+
 // UpdateCacheEntry is the on-disk representation of a cached GitHub version check.
 type UpdateCacheEntry struct {
 	Timestamp     int64  `json:"timestamp"` // Unix milliseconds
 	LatestVersion string `json:"latest_version"`
 }
 
-// BudgetFailEntry is the on-disk negative-cache record of a failed budget fetch.
+// SpendHistoryEntry is the on-disk record of spend observed on successive fetches,
+// oldest first, used to draw the sparkline.
+type SpendHistoryEntry struct {
+	Samples []SpendSample `json:"samples"`
+}
+
+// SpendSample is one observed spend value.
+type SpendSample struct {
+	Timestamp int64   `json:"timestamp"` // Unix milliseconds
+	Spend     float64 `json:"spend"`
+}
+
+// NotifyStateEntry is the on-disk record of the budget percent seen on the previous
+// invocation, used to detect a crossing into the critical band exactly once.
+type NotifyStateEntry struct {
+	Timestamp   int64   `json:"timestamp"` // Unix milliseconds
+	LastPercent float64 `json:"last_percent"`
+}
+
+// DisplayStateEntry is the on-disk record of the last-shown status color, used to
+// debounce color flips (LITELLM_DEBOUNCE_MS). Pending is a different color seen since
+// PendingSince that hasn't been stable long enough to be shown yet.
+type DisplayStateEntry struct {
+	Color        string `json:"color"`
+	Pending      string `json:"pending,omitempty"`
+	PendingSince int64  `json:"pending_since,omitempty"` // Unix milliseconds
+}
+
+// BudgetFailEntry is the on-disk negative-cache record of a failed budget fetch, and
+// the persisted state of the fetch circuit breaker (see breaker).
 // It captures enough to reconstruct an equivalent error (so main()'s classification
-// keeps working) without making another network call within BudgetFailTTLMs.
+// keeps working) without making another network call while the breaker is open.
 type BudgetFailEntry struct {
-	Timestamp int64   `json:"timestamp"`            // Unix milliseconds
-	Kind      string  `json:"kind"`                 // "auth" | "budget" | "transport"
-	Message   string  `json:"message,omitempty"`    // original error text, for debug output
-	Spend     float64 `json:"spend,omitempty"`      // populated when Kind == "budget"
-	MaxBudget float64 `json:"max_budget,omitempty"` // populated when Kind == "budget"
+	Timestamp    int64   `json:"timestamp"`                // Unix milliseconds
+	Failures     int     `json:"failures,omitempty"`       // consecutive failures, including this one
+	RetryAfterMs int64   `json:"retry_after_ms,omitempty"` // cooldown the proxy asked for via Retry-After
+	ProbeAt      int64   `json:"probe_at,omitempty"`       // Unix ms a half-open probe started, 0 if none
+	Kind         string  `json:"kind"`                     // "auth" | "forbidden" | "budget" | "transport"
+	Message      string  `json:"message,omitempty"`        // original error text, for debug output
+	Spend        float64 `json:"spend,omitempty"`          // populated when Kind == "budget"
+	MaxBudget    float64 `json:"max_budget,omitempty"`     // populated when Kind == "budget"
 }
 
 // cachedError reconstructs a previously-seen fetch error from the negative cache.
@@ -115,11 +357,76 @@ type KeyInfo struct {
 	BudgetDuration *string  `json:"budget_duration"`
 	TeamID         *string  `json:"team_id"`
 	UserID         *string  `json:"user_id"`
+	KeyAlias       *string  `json:"key_alias"`
 	// Team-level budget fields (populated from /team/info when key has no max_budget)
 	TeamSpend          *float64 `json:"team_spend"`
 	TeamMaxBudget      *float64 `json:"team_max_budget"`
 	TeamBudgetResetAt  *string  `json:"team_budget_reset_at"`
 	TeamBudgetDuration *string  `json:"team_budget_duration"`
+	// Whole-team totals for the team named by LITELLM_TEAM_ID, shown as a separate segment
+	TeamTotalSpend     *float64 `json:"team_total_spend"`
+	TeamTotalMaxBudget *float64 `json:"team_total_max_budget"`
+	// Second reset window, when the member budget and the team's own budget reset on
+	// different schedules (e.g. a daily member cap inside a monthly team budget)
+	SecondaryBudgetResetAt  *string `json:"secondary_budget_reset_at"`
+	SecondaryBudgetDuration *string `json:"secondary_budget_duration"`
+	// Models the key may call; empty means all models are allowed
+	Models []string `json:"models"`
+	// Requests-per-minute limit and, when the proxy reports it, the current minute's usage
+	RPMLimit *int64 `json:"rpm_limit"`
+	RPMUsage *int64 `json:"rpm_usage"`
+	// Tokens used by the key, when the proxy reports it (shown with LITELLM_SHOW_TOKENS)
+	TotalTokens *int64 `json:"total_tokens"`
+	// Free-form key metadata (e.g. a cost center), shown with LITELLM_SHOW_METADATA_KEY
+	Metadata map[string]any `json:"metadata"`
+}
+
+// UnmarshalJSON accepts spend and max_budget encoded as JSON numbers, numeric strings
+// ("25.00"), or null — some LiteLLM versions serialize money as strings, which would
+// otherwise fail the whole parse.
+func (k *KeyInfo) UnmarshalJSON(data []byte) error {
+	type plain KeyInfo
+	aux := struct {
+		*plain
+		Spend     json.RawMessage `json:"spend"`
+		MaxBudget json.RawMessage `json:"max_budget"`
+	}{plain: (*plain)(k)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	var err error
+	if k.Spend, err = parseFlexFloat(aux.Spend); err != nil {
+		return fmt.Errorf("spend: %w", err)
+	}
+	if k.MaxBudget, err = parseFlexFloat(aux.MaxBudget); err != nil {
+		return fmt.Errorf("max_budget: %w", err)
+	}
+	return nil
+}
+
+// parseFlexFloat decodes a JSON number or numeric string. Absent, null, and empty-string
+// values decode to nil.
+func parseFlexFloat(raw json.RawMessage) (*float64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var f float64
+	if err := json.Unmarshal(raw, &f); err == nil {
+		return &f, nil
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return nil, fmt.Errorf("not a number: %s", string(raw))
+	}
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil, fmt.Errorf("not a number: %q", str)
+	}
+	return &f, nil
 }
 
 // TeamMemberBudgetTable holds the per-user budget within a team. It backs both
@@ -130,6 +437,23 @@ type TeamMemberBudgetTable struct {
 	BudgetResetAt  *string  `json:"budget_reset_at"`
 }
 
+// UnmarshalJSON accepts max_budget as a number or numeric string, like KeyInfo.
+func (t *TeamMemberBudgetTable) UnmarshalJSON(data []byte) error {
+	type plain TeamMemberBudgetTable
+	aux := struct {
+		*plain
+		MaxBudget json.RawMessage `json:"max_budget"`
+	}{plain: (*plain)(t)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	var err error
+	if t.MaxBudget, err = parseFlexFloat(aux.MaxBudget); err != nil {
+		return fmt.Errorf("max_budget: %w", err)
+	}
+	return nil
+}
+
 // TeamInfoData is the nested team_info object in the /team/info response.
 type TeamInfoData struct {
 	Spend                 *float64               `json:"spend"`
@@ -139,6 +463,28 @@ type TeamInfoData struct {
 	TeamMemberBudgetTable *TeamMemberBudgetTable `json:"team_member_budget_table"`
 }
 
+// UnmarshalJSON accepts spend and max_budget as numbers or numeric strings, like
+// KeyInfo.
+func (t *TeamInfoData) UnmarshalJSON(data []byte) error {
+	type plain TeamInfoData
+	aux := struct {
+		*plain
+		Spend     json.RawMessage `json:"spend"`
+		MaxBudget json.RawMessage `json:"max_budget"`
+	}{plain: (*plain)(t)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	var err error
+	if t.Spend, err = parseFlexFloat(aux.Spend); err != nil {
+		return fmt.Errorf("spend: %w", err)
+	}
+	if t.MaxBudget, err = parseFlexFloat(aux.MaxBudget); err != nil {
+		return fmt.Errorf("max_budget: %w", err)
+	}
+	return nil
+}
+
 // TeamMembership represents a single entry in the team_memberships array.
 // LitellmBudgetTable carries this member's own budget — on many LiteLLM instances
 // the per-member budget lives here rather than in team_info.
@@ -149,12 +495,66 @@ type TeamMembership struct {
 	LitellmBudgetTable *TeamMemberBudgetTable `json:"litellm_budget_table"`
 }
 
+// UnmarshalJSON accepts spend as a number or numeric string, like KeyInfo.
+func (m *TeamMembership) UnmarshalJSON(data []byte) error {
+	type plain TeamMembership
+	aux := struct {
+		*plain
+		Spend json.RawMessage `json:"spend"`
+	}{plain: (*plain)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	var err error
+	if m.Spend, err = parseFlexFloat(aux.Spend); err != nil {
+		return fmt.Errorf("spend: %w", err)
+	}
+	return nil
+}
+
 // TeamInfoAPIResponse is the top-level /team/info response.
 type TeamInfoAPIResponse struct {
 	TeamInfo        TeamInfoData     `json:"team_info"`
 	TeamMemberships []TeamMembership `json:"team_memberships"`
 }
 
+// UserInfoAPIResponse is the subset of the /user/info response used when /key/info is
+// forbidden (LITELLM_USER_INFO_FALLBACK).
+type UserInfoAPIResponse struct {
+	UserID   string       `json:"user_id"`
+	UserInfo UserInfoData `json:"user_info"`
+}
+
+// UserInfoData is the nested user_info object in the /user/info response.
+type UserInfoData struct {
+	Spend          *float64 `json:"spend"`
+	MaxBudget      *float64 `json:"max_budget"`
+	BudgetDuration *string  `json:"budget_duration"`
+	BudgetResetAt  *string  `json:"budget_reset_at"`
+}
+
+// UnmarshalJSON accepts spend and max_budget as numbers or numeric strings, like
+// KeyInfo.
+func (u *UserInfoData) UnmarshalJSON(data []byte) error {
+	type plain UserInfoData
+	aux := struct {
+		*plain
+		Spend     json.RawMessage `json:"spend"`
+		MaxBudget json.RawMessage `json:"max_budget"`
+	}{plain: (*plain)(u)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	var err error
+	if u.Spend, err = parseFlexFloat(aux.Spend); err != nil {
+		return fmt.Errorf("spend: %w", err)
+	}
+	if u.MaxBudget, err = parseFlexFloat(aux.MaxBudget); err != nil {
+		return fmt.Errorf("max_budget: %w", err)
+	}
+	return nil
+}
+
 // resolveEffectiveBudget returns a *KeyInfo populated with the budget to display.
 // The team budget is the only source of truth — key-level spend/budget is intentionally
 // ignored to avoid confusing fallbacks. When no team budget exists, an empty *KeyInfo is
@@ -162,15 +562,149 @@ type TeamInfoAPIResponse struct {
 func resolveEffectiveBudget(info *KeyInfo) *KeyInfo {
 	if info.TeamMaxBudget != nil && *info.TeamMaxBudget > 0 {
 		return &KeyInfo{
-			Spend:          info.TeamSpend,
-			MaxBudget:      info.TeamMaxBudget,
-			BudgetResetAt:  info.TeamBudgetResetAt,
-			BudgetDuration: info.TeamBudgetDuration,
+			Spend:                   info.TeamSpend,
+			MaxBudget:               info.TeamMaxBudget,
+			BudgetResetAt:           info.TeamBudgetResetAt,
+			BudgetDuration:          info.TeamBudgetDuration,
+			SecondaryBudgetResetAt:  info.SecondaryBudgetResetAt,
+			SecondaryBudgetDuration: info.SecondaryBudgetDuration,
 		}
 	}
 	return &KeyInfo{}
 }
 
+// budgetConstraint is one hard spending limit that applies to the key.
+type budgetConstraint struct {
+	Tag   string // "" for the member budget, else a short label shown as "(tag)"
+	Spend float64
+	Limit float64
+}
+
+func (c budgetConstraint) percent() float64 { return (c.Spend / c.Limit) * 100 }
+
+// bindingColor is the status color for the binding limit: by utilization, or bright
+// red once it is exhausted.
+func bindingColor(c budgetConstraint) string {
+	if c.Spend >= c.Limit {
+		return ColorBrightRed
+	}
+	return budgetColor(c.percent())
+}
+
+// withShownColor returns input carrying the debounced color for a live text or tmux
+// render of info (see debouncedColor). Other modes, stale and error renders leave the
+// display state alone.
+func withShownColor(mode string, info *KeyInfo, input StatusInput) StatusInput {
+	if mode == "json" || mode == "logfmt" || info == nil {
+		return input
+	}
+	if binding, ok := bindingConstraint(info); ok {
+		input.shownColor = debouncedColor(bindingColor(binding))
+	}
+	return input
+}
+
+// bindingConstraint returns the limit with the highest utilization among the member
+// budget (see resolveEffectiveBudget) and the LITELLM_TEAM_ID team total, so the single
+// status color reflects whichever one will run out first. The member budget wins ties.
+// ok is false when no member budget is configured. The personal alert budget is a
+// soft cap with its own marker and deliberately doesn't compete here.
+func bindingConstraint(info *KeyInfo) (budgetConstraint, bool) {
+	effective := resolveEffectiveBudget(info)
+	if effective.MaxBudget == nil || *effective.MaxBudget <= 0 {
+		return budgetConstraint{}, false
+	}
+	binding := budgetConstraint{Spend: derefFloat(effective.Spend), Limit: *effective.MaxBudget}
+	if info.TeamTotalMaxBudget != nil && *info.TeamTotalMaxBudget > 0 {
+		team := budgetConstraint{Tag: "team", Spend: derefFloat(info.TeamTotalSpend), Limit: *info.TeamTotalMaxBudget}
+		if team.percent() > binding.percent() {
+			binding = team
+		}
+	}
+	return binding, true
+}
+
+// Config is the optional JSON config file (see configFile). The typed fields are the
+// common tunables, each the default for the environment variable in its comment, so
+// a wrong type ("cache_ttl_ms": "1m") is a parse error instead of a silent fallback.
+// Env mirrors the `env` block of Claude Code's settings.json and covers every other
+// variable; a typed field wins over the same variable there. Variables that are
+// already set in the real environment always take precedence over the file.
+type Config struct {
+	// Format
+	Output      string `json:"output,omitempty"`       // LITELLM_OUTPUT
+	ResetFormat string `json:"reset_format,omitempty"` // LITELLM_RESET_FORMAT
+	ResetUnits  *int   `json:"reset_units,omitempty"`  // LITELLM_RESET_UNITS
+	Separator   string `json:"separator,omitempty"`    // LITELLM_SEPARATOR
+	Label       string `json:"label,omitempty"`        // LITELLM_LABEL
+	ShowCost    bool   `json:"show_cost,omitempty"`    // LITELLM_PLUGIN_SHOW_COST
+
+	// Thresholds
+	AlertBudget    *float64 `json:"alert_budget,omitempty"`     // LITELLM_ALERT_BUDGET
+	MinSpend       *float64 `json:"min_spend,omitempty"`        // LITELLM_MIN_SPEND
+	ResetWarnHours *float64 `json:"reset_warn_hours,omitempty"` // LITELLM_RESET_WARN_HOURS
+
+	// Timeouts
+	CacheTTLMs       *int64 `json:"cache_ttl_ms,omitempty"`       // LITELLM_CACHE_TTL_MS
+	ConnectTimeoutMs *int64 `json:"connect_timeout_ms,omitempty"` // LITELLM_CONNECT_TIMEOUT_MS
+	ReadTimeoutMs    *int64 `json:"read_timeout_ms,omitempty"`    // LITELLM_READ_TIMEOUT_MS
+	Retries          *int   `json:"retries,omitempty"`            // LITELLM_RETRIES
+
+	// Colors
+	NoColor   bool   `json:"no_color,omitempty"`   // NO_COLOR
+	MetaColor string `json:"meta_color,omitempty"` // LITELLM_META_COLOR
+
+	Env map[string]string `json:"env"`
+}
+
+// vars returns the typed fields that are set, as the environment variables they
+// provide defaults for.
+func (c *Config) vars() map[string]string {
+	vars := make(map[string]string)
+	for name, val := range map[string]string{
+		"LITELLM_OUTPUT":       c.Output,
+		"LITELLM_RESET_FORMAT": c.ResetFormat,
+		"LITELLM_SEPARATOR":    c.Separator,
+		"LITELLM_LABEL":        c.Label,
+		"LITELLM_META_COLOR":   c.MetaColor,
+	} {
+		if val != "" {
+			vars[name] = val
+		}
+	}
+	for name, val := range map[string]*float64{
+		"LITELLM_ALERT_BUDGET":     c.AlertBudget,
+		"LITELLM_MIN_SPEND":        c.MinSpend,
+		"LITELLM_RESET_WARN_HOURS": c.ResetWarnHours,
+	} {
+		if val != nil {
+			vars[name] = strconv.FormatFloat(*val, 'f', -1, 64)
+		}
+	}
+	for name, val := range map[string]*int64{
+		"LITELLM_CACHE_TTL_MS":       c.CacheTTLMs,
+		"LITELLM_CONNECT_TIMEOUT_MS": c.ConnectTimeoutMs,
+		"LITELLM_READ_TIMEOUT_MS":    c.ReadTimeoutMs,
+	} {
+		if val != nil {
+			vars[name] = strconv.FormatInt(*val, 10)
+		}
+	}
+	if c.ResetUnits != nil {
+		vars["LITELLM_RESET_UNITS"] = strconv.Itoa(*c.ResetUnits)
+	}
+	if c.Retries != nil {
+		vars["LITELLM_RETRIES"] = strconv.Itoa(*c.Retries)
+	}
+	if c.ShowCost {
+		vars["LITELLM_PLUGIN_SHOW_COST"] = "1"
+	}
+	if c.NoColor {
+		vars["NO_COLOR"] = "1"
+	}
+	return vars
+}
+
 // GitHubRelease represents the GitHub releases API response
 type GitHubRelease struct {
 	TagName string `json:"tag_name"`
@@ -186,6 +720,10 @@ type StatusInput struct {
 	ContextWindow *struct {
 		UsedPercentage *float64 `json:"used_percentage"`
 	} `json:"context_window"`
+
+	// shownColor is the debounced budget color for this render (see withShownColor),
+	// or "" to use the freshly computed one. It is not part of the stdin payload.
+	shownColor string
 }
 
 // readStatusInput decodes the JSON payload Claude Code sends on stdin.
@@ -198,8 +736,12 @@ func readStatusInput(r io.Reader) StatusInput {
 }
 
 // cacheDir returns the directory used for filesystem caching.
-// Respects XDG_CACHE_HOME; falls back to $HOME/.cache.
+// LITELLM_CACHE_DIR overrides it; otherwise respects XDG_CACHE_HOME and falls
+// back to $HOME/.cache.
 func cacheDir() string {
+	if dir := os.Getenv("LITELLM_CACHE_DIR"); dir != "" {
+		return dir
+	}
 	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
 		return filepath.Join(xdg, "claude-code-litellm")
 	}
@@ -207,11 +749,58 @@ func cacheDir() string {
 	return filepath.Join(home, ".cache", "claude-code-litellm")
 }
 
+// configFile returns the default config file path.
+// Respects XDG_CONFIG_HOME; falls back to $HOME/.config.
+func configFile() string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "litellm-statusline", "config.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "litellm-statusline", "config.json")
+}
+
+// loadConfig reads and parses the config file at path. A missing file is only an
+// error when required is set (i.e. the path was given explicitly via -config).
+func loadConfig(path string, required bool) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !required {
+			return &Config{}, nil
+		}
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// applyConfig exports the config's defaults for every variable not already set, so
+// the existing os.Getenv-based lookups pick them up unchanged. The typed fields go
+// first, so they win over the same variable in the env block.
+func applyConfig(cfg *Config) {
+	for _, vars := range []map[string]string{cfg.vars(), cfg.Env} {
+		for key, val := range vars {
+			if _, set := os.LookupEnv(key); !set {
+				_ = os.Setenv(key, val)
+			}
+		}
+	}
+}
+
 // cacheKey returns a short, stable hash of the active base URL + token so budget
 // cache files don't bleed across different proxies/keys (e.g. per-project configs
 // that point at different LiteLLM instances or use different keys).
 func cacheKey() string {
-	sum := sha256.Sum256([]byte(getBaseURL() + "\x00" + getToken()))
+	material := getBaseURL() + "\x00" + getToken()
+	if queryKey := getQueryKey(); queryKey != "" {
+		material += "\x00key=" + queryKey
+	}
+	if teamID := getTeamID(); teamID != "" {
+		material += "\x00" + teamID
+	}
+	sum := sha256.Sum256([]byte(material))
 	return hex.EncodeToString(sum[:])[:12]
 }
 
@@ -225,6 +814,37 @@ func budgetFailCacheFile() string {
 	return filepath.Join(cacheDir(), "budget-fail-"+cacheKey()+".json")
 }
 
+// notifyStateFile holds the last-seen budget percent for threshold-crossing alerts.
+func notifyStateFile() string {
+	return filepath.Join(cacheDir(), "notify-"+cacheKey()+".json")
+}
+
+// displayStateFile holds the last-shown status color for debouncing.
+func displayStateFile() string {
+	return filepath.Join(cacheDir(), "display-"+cacheKey()+".json")
+}
+
+// spendHistoryFile holds recent spend samples for the sparkline.
+func spendHistoryFile() string {
+	return filepath.Join(cacheDir(), "history-"+cacheKey()+".json")
+}
+
+// topModelCacheFile holds the cached top-model summary for LITELLM_SHOW_TOP_MODEL.
+func topModelCacheFile() string {
+	return filepath.Join(cacheDir(), "top-model-"+cacheKey()+".json")
+}
+
+// revalidateLeaseFile marks a -revalidate child in flight (see claimRevalidation).
+func revalidateLeaseFile() string {
+	return filepath.Join(cacheDir(), "revalidate-"+cacheKey()+".lock")
+}
+
+// orgReportCacheFile holds the org-wide budget for LITELLM_SCOPE=org, in the same
+// shape as the key budget cache.
+func orgReportCacheFile() string {
+	return filepath.Join(cacheDir(), "org-"+cacheKey()+".json")
+}
+
 // updateCacheFile is intentionally NOT namespaced by key: the latest GitHub release
 // is identical regardless of which LiteLLM key/URL is in use, and a shared file means
 // a single backoff is honored across keys (fewer GitHub calls under rate limits).
@@ -263,10 +883,75 @@ func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
 	return nil
 }
 
-// readBudgetCache reads cached budget info from disk.
-// Returns nil, false if the cache is missing, corrupt, or older than CacheTTLMs.
-func readBudgetCache() (*KeyInfo, bool) {
-	data, err := os.ReadFile(budgetCacheFile())
+// memCache holds cache files in memory once the cache directory turned out to be
+// unwritable (e.g. a read-only sandbox). It lasts only as long as the process, which
+// still keeps a single run (or the daemon) consistent instead of failing.
+var (
+	memCacheMu sync.Mutex
+	memCache   map[string][]byte
+)
+
+// writeCacheFile writes data to path in the cache directory, creating the directory
+// if needed. When that fails, data is kept in memCache instead; the first fallback
+// is logged in debug mode. Caching is best-effort, so no error is returned.
+func writeCacheFile(path string, data []byte) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		err = writeFileAtomic(path, data, 0o600)
+	}
+	memCacheMu.Lock()
+	defer memCacheMu.Unlock()
+	if err == nil {
+		delete(memCache, path)
+		return
+	}
+	if memCache == nil {
+		debugf("cache directory %s is not writable, caching in memory: %v", filepath.Dir(path), err)
+		memCache = make(map[string][]byte)
+	}
+	memCache[path] = data
+}
+
+// readCacheFile returns the contents of a cache file, preferring the in-memory copy
+// left by writeCacheFile when the directory was unwritable.
+func readCacheFile(path string) ([]byte, error) {
+	memCacheMu.Lock()
+	data, ok := memCache[path]
+	memCacheMu.Unlock()
+	if ok {
+		return data, nil
+	}
+	return os.ReadFile(path)
+}
+
+// removeCacheFile deletes a cache file and any in-memory copy of it.
+func removeCacheFile(path string) {
+	memCacheMu.Lock()
+	delete(memCache, path)
+	memCacheMu.Unlock()
+	_ = os.Remove(path)
+}
+
+// budgetMemory keeps decoded budget cache entries in the daemon, keyed by cache file,
+// so a request answered from cache touches neither the disk nor the JSON decoder.
+// Writes still go through to disk, keeping one-shot runs consistent and letting a
+// restarted daemon start warm. entries is nil outside the daemon (see runDaemon).
+var budgetMemory struct {
+	sync.Mutex
+	entries map[string]BudgetCacheEntry
+}
+
+// readBudgetCacheEntry reads the cached budget entry regardless of its age, from
+// budgetMemory in the daemon or else from disk. Returns nil, false if the cache is
+// missing or corrupt.
+func readBudgetCacheEntry() (*BudgetCacheEntry, bool) {
+	path := budgetCacheFile()
+	budgetMemory.Lock()
+	defer budgetMemory.Unlock()
+	if entry, ok := budgetMemory.entries[path]; ok {
+		return &entry, true
+	}
+	data, err := readCacheFile(path)
 	if err != nil {
 		return nil, false
 	}
@@ -274,7 +959,20 @@ func readBudgetCache() (*KeyInfo, bool) {
 	if err := json.Unmarshal(data, &entry); err != nil {
 		return nil, false
 	}
-	if time.Now().UnixMilli()-entry.Timestamp >= CacheTTLMs {
+	if budgetMemory.entries != nil {
+		budgetMemory.entries[path] = entry
+	}
+	return &entry, true
+}
+
+// readBudgetCache reads cached budget info from disk.
+// Returns nil, false if the cache is missing, corrupt, or older than the cache TTL.
+func readBudgetCache() (*KeyInfo, bool) {
+	entry, ok := readBudgetCacheEntry()
+	if !ok {
+		return nil, false
+	}
+	if nowFunc().UnixMilli()-entry.Timestamp >= getCacheTTLMs() {
 		return nil, false
 	}
 	return &entry.Info, true
@@ -287,23 +985,36 @@ func writeBudgetCache(info *KeyInfo) {
 		return
 	}
 	entry := BudgetCacheEntry{
-		Timestamp: time.Now().UnixMilli(),
+		Timestamp: nowFunc().UnixMilli(),
 		Info:      *info,
 	}
+	path := budgetCacheFile()
+	budgetMemory.Lock()
+	if budgetMemory.entries != nil {
+		budgetMemory.entries[path] = entry
+	}
+	budgetMemory.Unlock()
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return
 	}
-	if err := os.MkdirAll(cacheDir(), 0o755); err != nil {
-		return
+	writeCacheFile(path, data)
+}
+
+// failBackoffMs returns the negative-cache window after n consecutive failures:
+// BudgetFailTTLMs doubled per extra failure, capped at BudgetFailMaxTTLMs. A proxy
+// that stays down is then polled less and less often instead of every 10 seconds.
+func failBackoffMs(n int) int64 {
+	ms := int64(BudgetFailTTLMs)
+	for i := 1; i < n && ms < BudgetFailMaxTTLMs; i++ {
+		ms *= 2
 	}
-	_ = writeFileAtomic(budgetCacheFile(), data, 0o600)
+	return min(ms, BudgetFailMaxTTLMs)
 }
 
-// readBudgetFailCache returns a recent failed-fetch record, if one exists within
-// BudgetFailTTLMs. Returns nil, false when absent, corrupt, or expired.
-func readBudgetFailCache() (*BudgetFailEntry, bool) {
-	data, err := os.ReadFile(budgetFailCacheFile())
+// readBudgetFailEntry reads the failed-fetch record regardless of age.
+func readBudgetFailEntry() (*BudgetFailEntry, bool) {
+	data, err := readCacheFile(budgetFailCacheFile())
 	if err != nil {
 		return nil, false
 	}
@@ -311,20 +1022,30 @@ func readBudgetFailCache() (*BudgetFailEntry, bool) {
 	if err := json.Unmarshal(data, &entry); err != nil {
 		return nil, false
 	}
-	if time.Now().UnixMilli()-entry.Timestamp >= BudgetFailTTLMs {
-		return nil, false
-	}
 	return &entry, true
 }
 
 // writeBudgetFailCache records a failed budget fetch so subsequent refreshes back off
-// instead of re-blocking on the network. Errors are silently ignored — best-effort.
+// instead of re-blocking on the network. The failure streak carries over from the
+// previous record unless that one expired more than BudgetFailMaxTTLMs ago.
+// Errors are silently ignored — best-effort.
 func writeBudgetFailCache(fetchErr error) {
+	now := nowFunc().UnixMilli()
 	entry := BudgetFailEntry{
-		Timestamp: time.Now().UnixMilli(),
+		Timestamp: now,
+		Failures:  1,
 		Message:   fetchErr.Error(),
 		Kind:      "transport",
 	}
+	if prev, ok := readBudgetFailEntry(); ok {
+		if now-prev.Timestamp < failBackoffMs(prev.Failures)+BudgetFailMaxTTLMs {
+			entry.Failures = max(prev.Failures, 1) + 1
+		}
+	}
+	var raErr *RetryAfterError
+	if errors.As(fetchErr, &raErr) {
+		entry.RetryAfterMs = min(raErr.After.Milliseconds(), BudgetFailMaxTTLMs)
+	}
 	var bErr *BudgetExceededError
 	switch {
 	case errors.As(fetchErr, &bErr):
@@ -333,15 +1054,97 @@ func writeBudgetFailCache(fetchErr error) {
 		entry.MaxBudget = bErr.MaxBudget
 	case errors.Is(fetchErr, ErrAuth):
 		entry.Kind = "auth"
+	case errors.Is(fetchErr, ErrForbidden):
+		entry.Kind = "forbidden"
 	}
+	writeBudgetFailEntry(&entry)
+}
+
+// writeBudgetFailEntry persists the failure record. Errors are silently ignored.
+func writeBudgetFailEntry(entry *BudgetFailEntry) {
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return
 	}
-	if err := os.MkdirAll(cacheDir(), 0o755); err != nil {
-		return
+	writeCacheFile(budgetFailCacheFile(), data)
+}
+
+// breakerState is the circuit breaker state for budget fetches.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // fetches go to the network
+	breakerOpen                         // recent failures: replay the cached error, no network call
+	breakerHalfOpen                     // cooldown elapsed: a single probe may go to the network
+)
+
+// breaker is a circuit breaker for budget fetches. Every statusline refresh is a new
+// process, so its state lives in the on-disk failure record (BudgetFailEntry):
+// threshold consecutive failures open it for a cooldown (failBackoffMs, stretched by
+// any Retry-After the proxy sent); once that elapses it turns half-open and lets one
+// probe through. The probe's success closes the breaker; its failure re-opens it
+// with a longer cooldown.
+type breaker struct {
+	threshold int
+}
+
+func newBreaker() *breaker {
+	return &breaker{threshold: getBreakerThreshold()}
+}
+
+// cooldownMs is how long the breaker stays open after the failure recorded in e.
+func (b *breaker) cooldownMs(e *BudgetFailEntry) int64 {
+	return max(failBackoffMs(max(e.Failures, 1)-b.threshold+1), e.RetryAfterMs)
+}
+
+// state derives the breaker state from the failure record e (nil when there is none)
+// at time now (Unix ms).
+func (b *breaker) state(e *BudgetFailEntry, now int64) breakerState {
+	if e == nil || max(e.Failures, 1) < b.threshold {
+		return breakerClosed
+	}
+	if now-e.Timestamp < b.cooldownMs(e) {
+		return breakerOpen
+	}
+	if e.ProbeAt > 0 && now-e.ProbeAt < BreakerProbeMs {
+		// Another invocation's probe is still in flight.
+		return breakerOpen
+	}
+	return breakerHalfOpen
+}
+
+// allow reports whether a fetch may go to the network. While open it returns the
+// replayed error of the last failure instead. Going half-open claims the probe so
+// concurrent invocations keep backing off until it resolves.
+func (b *breaker) allow() error {
+	e, ok := readBudgetFailEntry()
+	if !ok {
+		return nil
 	}
-	_ = writeFileAtomic(budgetFailCacheFile(), data, 0o600)
+	now := nowFunc().UnixMilli()
+	switch b.state(e, now) {
+	case breakerOpen:
+		return errorFromFailEntry(e)
+	case breakerHalfOpen:
+		e.ProbeAt = now
+		writeBudgetFailEntry(e)
+	}
+	return nil
+}
+
+// success closes the breaker.
+func (b *breaker) success() {
+	clearBudgetFailCache()
+}
+
+// failure records a failed fetch, opening the breaker once threshold is reached.
+func (b *breaker) failure(err error) {
+	writeBudgetFailCache(err)
+}
+
+// clearBudgetFailCache ends a failure streak after a successful fetch.
+func clearBudgetFailCache() {
+	removeCacheFile(budgetFailCacheFile())
 }
 
 // errorFromFailEntry rebuilds an error equivalent to the original failed fetch so
@@ -352,24 +1155,141 @@ func errorFromFailEntry(e *BudgetFailEntry) error {
 		return &BudgetExceededError{Spend: e.Spend, MaxBudget: e.MaxBudget}
 	case "auth":
 		return &cachedError{msg: e.Message, sentinel: ErrAuth}
+	case "forbidden":
+		return &cachedError{msg: e.Message, sentinel: ErrForbidden}
 	default:
 		return &cachedError{msg: e.Message}
 	}
 }
 
-// readUpdateCache reads the cached latest GitHub release version from disk.
-// Returns "", false if the cache is missing, corrupt, or older than UpdateCheckTTLMs.
-func readUpdateCache() (string, bool) {
-	data, err := os.ReadFile(updateCacheFile())
+// readNotifyState returns the previously recorded budget percent, if any.
+func readNotifyState() (*NotifyStateEntry, bool) {
+	data, err := readCacheFile(notifyStateFile())
 	if err != nil {
-		return "", false
+		return nil, false
 	}
-	var entry UpdateCacheEntry
+	var entry NotifyStateEntry
 	if err := json.Unmarshal(data, &entry); err != nil {
-		return "", false
-	}
-	if time.Now().UnixMilli()-entry.Timestamp >= UpdateCheckTTLMs {
-		return "", false
+		return nil, false
+	}
+	return &entry, true
+}
+
+// writeNotifyState records the current budget percent. Errors are silently ignored.
+func writeNotifyState(percent float64) {
+	data, err := json.Marshal(NotifyStateEntry{Timestamp: nowFunc().UnixMilli(), LastPercent: percent})
+	if err != nil {
+		return
+	}
+	writeCacheFile(notifyStateFile(), data)
+}
+
+// readDisplayState returns the last-shown color state, if any.
+func readDisplayState() (*DisplayStateEntry, bool) {
+	data, err := readCacheFile(displayStateFile())
+	if err != nil {
+		return nil, false
+	}
+	var entry DisplayStateEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Color == "" {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// writeDisplayState records the last-shown color state. Errors are silently ignored.
+func writeDisplayState(entry DisplayStateEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	writeCacheFile(displayStateFile(), data)
+}
+
+// debouncedColor returns the color to show given the freshly computed one. A change
+// only shows once the new color has been seen continuously for LITELLM_DEBOUNCE_MS;
+// until then the previously shown color is kept, so tiny spend changes around a
+// threshold don't make the statusline flicker. Critical and exhausted colors show at
+// once: holding them back would hide a budget that is about to block requests.
+func debouncedColor(color string) string {
+	window := getDebounceMs()
+	if window <= 0 {
+		return color
+	}
+	nowMs := nowFunc().UnixMilli()
+	state, ok := readDisplayState()
+	switch {
+	case !ok || color == state.Color:
+		if !ok || state.Pending != "" {
+			writeDisplayState(DisplayStateEntry{Color: color})
+		}
+		return color
+	case color == ColorRed || color == ColorBrightRed:
+		writeDisplayState(DisplayStateEntry{Color: color})
+		return color
+	case color != state.Pending:
+		writeDisplayState(DisplayStateEntry{Color: state.Color, Pending: color, PendingSince: nowMs})
+		return state.Color
+	case nowMs-state.PendingSince >= window:
+		writeDisplayState(DisplayStateEntry{Color: color})
+		return color
+	}
+	return state.Color
+}
+
+// readSpendHistory returns the recorded spend samples, oldest first. A missing or
+// corrupt file yields no samples.
+func readSpendHistory() []SpendSample {
+	data, err := readCacheFile(spendHistoryFile())
+	if err != nil {
+		return nil
+	}
+	var entry SpendHistoryEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil
+	}
+	return entry.Samples
+}
+
+// spendWasReset reports whether spend fell from before to after by enough to mean a
+// budget reset (below SpendResetRatio of the previous value) rather than a refund or
+// rounding noise.
+func spendWasReset(before, after float64) bool {
+	return before > 0 && after < before*SpendResetRatio
+}
+
+// clearSpendHistory drops all recorded spend samples.
+func clearSpendHistory() {
+	removeCacheFile(spendHistoryFile())
+}
+
+// appendSpendHistory records a spend sample, keeping at most MaxHistorySamples.
+// Errors are silently ignored — history is best-effort.
+func appendSpendHistory(spend float64) {
+	samples := append(readSpendHistory(), SpendSample{Timestamp: nowFunc().UnixMilli(), Spend: spend})
+	if len(samples) > MaxHistorySamples {
+		samples = samples[len(samples)-MaxHistorySamples:]
+	}
+	data, err := json.Marshal(SpendHistoryEntry{Samples: samples})
+	if err != nil {
+		return
+	}
+	writeCacheFile(spendHistoryFile(), data)
+}
+
+// readUpdateCache reads the cached latest GitHub release version from disk.
+// Returns "", false if the cache is missing, corrupt, or older than UpdateCheckTTLMs.
+func readUpdateCache() (string, bool) {
+	data, err := readCacheFile(updateCacheFile())
+	if err != nil {
+		return "", false
+	}
+	var entry UpdateCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return "", false
+	}
+	if nowFunc().UnixMilli()-entry.Timestamp >= UpdateCheckTTLMs {
+		return "", false
 	}
 	return entry.LatestVersion, true
 }
@@ -381,17 +1301,14 @@ func readUpdateCache() (string, bool) {
 // Errors are silently ignored — caching is best-effort.
 func writeUpdateCache(version string) {
 	entry := UpdateCacheEntry{
-		Timestamp:     time.Now().UnixMilli(),
+		Timestamp:     nowFunc().UnixMilli(),
 		LatestVersion: version,
 	}
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return
 	}
-	if err := os.MkdirAll(cacheDir(), 0o755); err != nil {
-		return
-	}
-	_ = writeFileAtomic(updateCacheFile(), data, 0o600)
+	writeCacheFile(updateCacheFile(), data)
 }
 
 // fetchLatestVersion calls the GitHub releases API to get the latest release tag
@@ -429,6 +1346,9 @@ func getLatestVersion() string {
 	if version, ok := readUpdateCache(); ok {
 		return version
 	}
+	if isOfflineEnabled() {
+		return ""
+	}
 	latest := fetchLatestVersion()
 	// Persist even on "" (failure / rate-limit) so the next refresh reads the cache
 	// and backs off rather than re-attempting the network call.
@@ -465,6 +1385,24 @@ func isUpdateAvailable(current, latest string) bool {
 	return l != "" && semverGreater(l, c)
 }
 
+// debugOut receives debug logging; swapped out in tests.
+var debugOut io.Writer = os.Stderr
+
+// isDebugEnabled returns true when LITELLM_DEBUG is set. Debug output goes to stderr,
+// so it never corrupts the statusline on stdout.
+func isDebugEnabled() bool {
+	val := os.Getenv("LITELLM_DEBUG")
+	return val == "1" || val == "true"
+}
+
+// debugf writes a diagnostic line to debugOut when debug mode is enabled.
+func debugf(format string, args ...any) {
+	if !isDebugEnabled() {
+		return
+	}
+	_, _ = fmt.Fprintf(debugOut, "litellm debug: "+format+"\n", args...)
+}
+
 // getEnvWithFallback returns the first non-empty environment variable value
 func getEnvWithFallback(keys ...string) string {
 	for _, key := range keys {
@@ -475,10 +1413,76 @@ func getEnvWithFallback(keys ...string) string {
 	return ""
 }
 
-// getBaseURL returns the LiteLLM base URL from environment
+// warnEnvConflicts logs, in debug mode, each recognized variable that is shadowed by a
+// higher-priority one set to a different value (e.g. a stale ANTHROPIC_BASE_URL export
+// under LITELLM_PROXY_URL). URLs are compared without trailing slashes; API keys are
+// never printed, only named.
+func warnEnvConflicts() {
+	groups := []struct {
+		keys   []string
+		secret bool
+	}{
+		{[]string{"LITELLM_PROXY_URL", "ANTHROPIC_BASE_URL", "LITELLM_BASE_URL", "OPENAI_BASE_URL"}, false},
+		{[]string{"LITELLM_PROXY_API_KEY", "ANTHROPIC_AUTH_TOKEN"}, true},
+	}
+	for _, g := range groups {
+		winner, winVal := "", ""
+		for _, key := range g.keys {
+			val := os.Getenv(key)
+			if !g.secret {
+				val = strings.TrimRight(val, "/")
+			}
+			switch {
+			case val == "":
+			case winner == "":
+				winner, winVal = key, val
+			case val != winVal && g.secret:
+				debugf("%s is set but ignored: %s takes priority and has a different value", key, winner)
+			case val != winVal:
+				debugf("%s=%s is set but ignored: %s=%s takes priority", key, val, winner, winVal)
+			}
+		}
+	}
+}
+
+// fingerprintEnvVars are the variables outside the LITELLM_ prefix that change the
+// plugin's behavior, listed by logEnvFingerprint when set.
+var fingerprintEnvVars = []string{
+	"ANTHROPIC_BASE_URL", "ANTHROPIC_AUTH_TOKEN", "OPENAI_BASE_URL", "NO_COLOR", "XDG_CACHE_HOME", "XDG_CONFIG_HOME",
+}
+
+// logEnvFingerprint logs, in debug mode, a one-line summary of the effective setup for
+// triage: the names of the recognized variables that are set (never their values, so
+// pasted logs can't leak keys or URLs) and the resolved numeric tunables.
+func logEnvFingerprint() {
+	if !isDebugEnabled() {
+		return
+	}
+	var names []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "LITELLM_") || slices.Contains(fingerprintEnvVars, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	connect, read, _ := getPhaseTimeouts()
+	debugf("env fingerprint: version=%s set=[%s] cache_ttl_ms=%d retries=%d breaker_threshold=%d debounce_ms=%d reset_units=%d connect_timeout=%s read_timeout=%s",
+		Version, strings.Join(names, ","), getCacheTTLMs(), getRetries(), getBreakerThreshold(), getDebounceMs(), getResetUnits(), connect, read)
+}
+
+// getBaseURL returns the LiteLLM base URL from environment, checking
+// LITELLM_PROXY_URL, ANTHROPIC_BASE_URL, LITELLM_BASE_URL, then OPENAI_BASE_URL
+// (for setups that point the OpenAI SDK at LiteLLM). Trailing slashes are stripped.
 func getBaseURL() string {
-	url := getEnvWithFallback("LITELLM_PROXY_URL", "ANTHROPIC_BASE_URL")
-	return strings.TrimSuffix(url, "/")
+	url := getEnvWithFallback("LITELLM_PROXY_URL", "ANTHROPIC_BASE_URL", "LITELLM_BASE_URL", "OPENAI_BASE_URL")
+	return strings.TrimRight(url, "/")
+}
+
+// getFallbackURL returns the backup proxy from LITELLM_PROXY_URL_FALLBACK, tried when
+// the primary can't be reached. Trailing slashes are stripped.
+func getFallbackURL() string {
+	return strings.TrimRight(strings.TrimSpace(os.Getenv("LITELLM_PROXY_URL_FALLBACK")), "/")
 }
 
 // getToken returns the API token from environment
@@ -486,453 +1490,2834 @@ func getToken() string {
 	return getEnvWithFallback("LITELLM_PROXY_API_KEY", "ANTHROPIC_AUTH_TOKEN")
 }
 
-// isShowCostEnabled returns true only when LITELLM_PLUGIN_SHOW_COST is explicitly enabled.
-// Default is false — percent-only display, no dollar amounts.
-func isShowCostEnabled() bool {
-	val := os.Getenv("LITELLM_PLUGIN_SHOW_COST")
-	return val == "1" || val == "true"
+// getCacheTTLMs returns the budget cache TTL from LITELLM_CACHE_TTL_MS, defaulting to
+// CacheTTLMs. 0 disables caching (every call fetches); negative or unparseable values
+// fall back to the default.
+func getCacheTTLMs() int64 {
+	val := strings.TrimSpace(os.Getenv("LITELLM_CACHE_TTL_MS"))
+	if val == "" {
+		return CacheTTLMs
+	}
+	ttl, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || ttl < 0 {
+		return CacheTTLMs
+	}
+	return ttl
 }
 
-// getPrefix returns the status line prefix.
-// Precedence: LITELLM_PLUGIN_PREFIX (if set, even to empty) > stdin model display name > "LiteLLM: ".
-func getPrefix(input StatusInput) string {
-	if val, ok := os.LookupEnv("LITELLM_PLUGIN_PREFIX"); ok {
-		if val == "" {
-			return ""
+// getPhaseTimeouts returns the connect and read timeouts from LITELLM_CONNECT_TIMEOUT_MS
+// and LITELLM_READ_TIMEOUT_MS. split is false when neither is set to a positive
+// number, keeping the single HTTPTimeout; otherwise an unset phase defaults to
+// HTTPTimeout.
+func getPhaseTimeouts() (connect, read time.Duration, split bool) {
+	phase := func(name string) (time.Duration, bool) {
+		ms, err := strconv.ParseInt(strings.TrimSpace(os.Getenv(name)), 10, 64)
+		if err != nil || ms <= 0 {
+			return HTTPTimeout, false
 		}
-		return val + " "
+		return time.Duration(ms) * time.Millisecond, true
 	}
-	if name := strings.TrimSpace(input.Model.DisplayName); name != "" {
-		return name + ": "
+	connect, connectSet := phase("LITELLM_CONNECT_TIMEOUT_MS")
+	read, readSet := phase("LITELLM_READ_TIMEOUT_MS")
+	return connect, read, connectSet || readSet
+}
+
+// getRetries returns how many times a transient fetch failure is retried
+// (LITELLM_RETRIES), defaulting to DefaultRetries. 0 disables retries; negative or
+// unparseable values fall back to the default.
+func getRetries() int {
+	val := strings.TrimSpace(os.Getenv("LITELLM_RETRIES"))
+	if val == "" {
+		return DefaultRetries
 	}
-	return "LiteLLM: "
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		return DefaultRetries
+	}
+	return n
 }
 
-// getKeyInfo fetches budget info from the LiteLLM API, using a 30-second filesystem cache
-// to avoid hitting the API on every statusline refresh.
-// Each invocation of this binary is a fresh process, so all state must live on disk.
-// When the key has a team_id, a second call to /team/info populates the team budget
-// fields — the only budget the statusline displays (key-level budget is ignored).
-func getKeyInfo(apiKey string) (*KeyInfo, error) {
-	if info, ok := readBudgetCache(); ok {
-		return info, nil
+// getAlertBudget returns the personal soft cap in dollars from LITELLM_ALERT_BUDGET.
+// ok is false when unset, unparseable, or not positive.
+func getAlertBudget() (float64, bool) {
+	val := strings.TrimSpace(os.Getenv("LITELLM_ALERT_BUDGET"))
+	if val == "" {
+		return 0, false
 	}
-	// Recent failure → back off and replay the cached error instead of re-blocking
-	// on the network every refresh while the proxy is down / key is bad / over budget.
-	if failed, ok := readBudgetFailCache(); ok {
-		return nil, errorFromFailEntry(failed)
+	alert, err := strconv.ParseFloat(strings.TrimPrefix(val, "$"), 64)
+	if err != nil || alert <= 0 {
+		return 0, false
 	}
-	info, err := fetchKeyInfo(apiKey)
-	if err != nil {
-		writeBudgetFailCache(err)
-		return nil, err
+	return alert, true
+}
+
+// getMinSpend returns the spend floor in dollars from LITELLM_MIN_SPEND, below which
+// the statusline stays empty. ok is false when unset, unparseable, or not positive.
+func getMinSpend() (float64, bool) {
+	val := strings.TrimSpace(os.Getenv("LITELLM_MIN_SPEND"))
+	if val == "" {
+		return 0, false
 	}
-	if info.TeamID != nil && *info.TeamID != "" {
-		if teamResp, err := fetchTeamInfo(apiKey, *info.TeamID); err == nil {
-			ti := teamResp.TeamInfo
-			// Primary source: this member's own per-member budget from team_memberships.
-			// Both the budget and its matching spend come from the same membership row;
-			// the key's own spend is never used (it tracks a different, confusing window).
-			if info.UserID != nil && *info.UserID != "" {
-				for _, m := range teamResp.TeamMemberships {
-					if m.UserID != *info.UserID {
-						continue
-					}
-					if m.LitellmBudgetTable != nil && m.LitellmBudgetTable.MaxBudget != nil {
-						info.TeamSpend = m.Spend
-						info.TeamMaxBudget = m.LitellmBudgetTable.MaxBudget
-						info.TeamBudgetDuration = m.LitellmBudgetTable.BudgetDuration
-						info.TeamBudgetResetAt = m.LitellmBudgetTable.BudgetResetAt
-					}
-					break
-				}
-			}
-			// Fallback for instances that expose the budget at the team level instead:
-			// team_member_budget_table, else the team's own max_budget. Spend is paired
-			// with the team total — again, never the key's spend.
-			if info.TeamMaxBudget == nil {
-				switch {
-				case ti.TeamMemberBudgetTable != nil && ti.TeamMemberBudgetTable.MaxBudget != nil:
-					info.TeamMaxBudget = ti.TeamMemberBudgetTable.MaxBudget
-					info.TeamBudgetDuration = ti.TeamMemberBudgetTable.BudgetDuration
-				case ti.MaxBudget != nil:
-					info.TeamMaxBudget = ti.MaxBudget
-				}
-				if info.TeamMaxBudget != nil {
-					info.TeamSpend = ti.Spend
-					if info.TeamBudgetResetAt == nil {
-						info.TeamBudgetResetAt = ti.BudgetResetAt
-					}
-					if info.TeamBudgetDuration == nil {
-						info.TeamBudgetDuration = ti.BudgetDuration
-					}
-				}
-			}
-		}
+	floor, err := strconv.ParseFloat(strings.TrimPrefix(val, "$"), 64)
+	if err != nil || floor <= 0 {
+		return 0, false
 	}
-	writeBudgetCache(info)
-	return info, nil
+	return floor, true
 }
 
-// fetchKeyInfo makes the actual API call
-func fetchKeyInfo(apiKey string) (*KeyInfo, error) {
-	baseURL := getBaseURL()
-	if baseURL == "" {
-		return nil, fmt.Errorf("no LiteLLM proxy URL configured (set LITELLM_PROXY_URL or ANTHROPIC_BASE_URL)")
+// getScope returns LITELLM_SCOPE: "org" for the whole organization's spend from
+// /global/spend/report (admin keys only), or "key" (default) for the key's own budget.
+func getScope() string {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("LITELLM_SCOPE")), "org") {
+		return "org"
 	}
-	url := baseURL + "/key/info"
+	return "key"
+}
 
-	client := &http.Client{Timeout: HTTPTimeout}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("request creation failed: %w", err)
+// getOrgBudget returns the organization's monthly budget in dollars from
+// LITELLM_ORG_BUDGET, which the spend report doesn't carry. ok is false when unset,
+// unparseable, or not positive.
+func getOrgBudget() (float64, bool) {
+	val := strings.TrimSpace(os.Getenv("LITELLM_ORG_BUDGET"))
+	if val == "" {
+		return 0, false
 	}
+	budget, err := strconv.ParseFloat(strings.TrimPrefix(val, "$"), 64)
+	if err != nil || budget <= 0 {
+		return 0, false
+	}
+	return budget, true
+}
 
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
+// getTeamID returns the team to monitor alongside the key budget (LITELLM_TEAM_ID).
+// Empty means no team segment.
+func getTeamID() string {
+	return strings.TrimSpace(os.Getenv("LITELLM_TEAM_ID"))
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("connection error: %w [url=%s]", err, url)
-	}
-	defer func() { _ = resp.Body.Close() }()
+// getQueryKey returns the key to look up instead of the caller's own (LITELLM_QUERY_KEY),
+// sent as /key/info?key=. The request still authenticates with the usual token, which
+// must be an admin key allowed to read other keys. Empty means the caller's own key.
+func getQueryKey() string {
+	return strings.TrimSpace(os.Getenv("LITELLM_QUERY_KEY"))
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+// getOutputMode returns the output format selected by LITELLM_OUTPUT: "text" (the
+// default ANSI statusline), "json", "logfmt", or "tmux" (the statusline with tmux
+// style escapes). Unknown values fall back to "text".
+func getOutputMode() string {
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("LITELLM_OUTPUT"))); mode {
+	case "json", "logfmt", "tmux":
+		return mode
+	default:
+		return "text"
 	}
+}
 
-	if resp.StatusCode == 401 || resp.StatusCode == 403 {
-		return nil, fmt.Errorf("status=%d url=%s body=%s: %w", resp.StatusCode, url, string(body), ErrAuth)
-	}
+// isShowCostEnabled returns true only when LITELLM_PLUGIN_SHOW_COST is explicitly enabled.
+// Default is false — percent-only display, no dollar amounts.
+func isShowCostEnabled() bool {
+	val := os.Getenv("LITELLM_PLUGIN_SHOW_COST")
+	return val == "1" || val == "true"
+}
 
-	if resp.StatusCode != 200 {
-		var litellmErr liteLLMError
-		if json.Unmarshal(body, &litellmErr) == nil && litellmErr.Error.Type == "budget_exceeded" {
-			bErr := &BudgetExceededError{}
-			_, _ = fmt.Sscanf(litellmErr.Error.Message, "Budget has been exceeded! Current cost: %f, Max budget: %f", &bErr.Spend, &bErr.MaxBudget)
-			return nil, bErr
-		}
-		return nil, fmt.Errorf("HTTP error: status=%d url=%s body=%s", resp.StatusCode, url, string(body))
+// getUserAgent returns the User-Agent sent to the proxy: LITELLM_USER_AGENT, or
+// "claude-code-litellm-plugin/<version>" by default.
+func getUserAgent() string {
+	if val := strings.TrimSpace(os.Getenv("LITELLM_USER_AGENT")); val != "" {
+		return val
 	}
+	return "claude-code-litellm-plugin/" + Version
+}
 
-	var response KeyInfoResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("JSON parse error: %w [body=%s]", err, string(body))
-	}
+// isForceHTTP2Enabled returns true when LITELLM_FORCE_HTTP2 is set, making proxy
+// requests use HTTP/2 only (see apiTransport).
+func isForceHTTP2Enabled() bool {
+	val := os.Getenv("LITELLM_FORCE_HTTP2")
+	return val == "1" || val == "true"
+}
 
-	return &response.Info, nil
+// isUserInfoFallbackEnabled returns true when LITELLM_USER_INFO_FALLBACK is set, making a
+// 403 from /key/info retry against /user/info and display the user's own budget.
+func isUserInfoFallbackEnabled() bool {
+	val := os.Getenv("LITELLM_USER_INFO_FALLBACK")
+	return val == "1" || val == "true"
 }
 
-// fetchTeamInfo calls /team/info to get team-level budget data.
-// Returns nil, error on failure — callers treat this as best-effort.
-func fetchTeamInfo(apiKey, teamID string) (*TeamInfoAPIResponse, error) {
-	baseURL := getBaseURL()
-	if baseURL == "" {
-		return nil, fmt.Errorf("no LiteLLM proxy URL configured")
-	}
-	endpoint := baseURL + "/team/info?team_id=" + url.QueryEscape(teamID)
+// isNoNewlineEnabled returns true when LITELLM_NO_NEWLINE is set, for prompt frameworks
+// that embed the status inline and break on a trailing newline.
+func isNoNewlineEnabled() bool {
+	val := os.Getenv("LITELLM_NO_NEWLINE")
+	return val == "1" || val == "true"
+}
 
-	client := &http.Client{Timeout: HTTPTimeout}
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
+// isMarkNullSpendEnabled returns true when LITELLM_MARK_NULL_SPEND is set, showing a
+// budget whose spend the proxy reported as null as "$?/$100.00" instead of $0.00.
+func isMarkNullSpendEnabled() bool {
+	val := os.Getenv("LITELLM_MARK_NULL_SPEND")
+	return val == "1" || val == "true"
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer func() { _ = resp.Body.Close() }()
+// isPercentGlyphEnabled returns true when LITELLM_PERCENT_GLYPH is set, dropping the
+// numeric percent so the circle gauge glyph alone shows the fill level.
+func isPercentGlyphEnabled() bool {
+	val := os.Getenv("LITELLM_PERCENT_GLYPH")
+	return val == "1" || val == "true"
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("team info HTTP error: status=%d", resp.StatusCode)
+// isShowAllBudgetsEnabled returns true when LITELLM_SHOW_ALL_BUDGETS is set, listing
+// the member and team budgets side by side instead of only the binding one.
+func isShowAllBudgetsEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_ALL_BUDGETS")
+	return val == "1" || val == "true"
+}
+
+// isPercentRemainingEnabled reports whether LITELLM_PERCENT_MODE is "remaining": the
+// line then shows the share of the budget left ("75% left") instead of the share used.
+// Any other value keeps the default "used".
+func isPercentRemainingEnabled() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("LITELLM_PERCENT_MODE")), "remaining")
+}
+
+// getResetWarnHours returns LITELLM_RESET_WARN_HOURS: how far away the reset must be
+// for a near- or over-budget status to color the reset countdown (see resetColor).
+// ok is false when unset, unparseable, or negative.
+func getResetWarnHours() (float64, bool) {
+	val := os.Getenv("LITELLM_RESET_WARN_HOURS")
+	if val == "" {
+		return 0, false
+	}
+	hours, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil || hours < 0 || math.IsNaN(hours) || math.IsInf(hours, 0) {
+		return 0, false
 	}
+	return hours, true
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// getOnCritCommand returns LITELLM_ON_CRIT: a shell command run once each time usage
+// crosses into the critical band (e.g. to post to Slack). Empty means no hook.
+func getOnCritCommand() string {
+	return strings.TrimSpace(os.Getenv("LITELLM_ON_CRIT"))
+}
+
+// getBlockedMarker returns LITELLM_BLOCKED_MARKER, the label shown once spend reaches
+// the budget: "bracket" for [BLOCKED], "blink" for a blinking [BLOCKED]. Anything
+// else keeps the default "EXHAUSTED".
+func getBlockedMarker() string {
+	switch val := strings.ToLower(strings.TrimSpace(os.Getenv("LITELLM_BLOCKED_MARKER"))); val {
+	case "bracket", "blink":
+		return val
 	}
+	return ""
+}
 
-	var response TeamInfoAPIResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, err
+// exhaustedLabel returns the label that replaces the percent at or past the budget.
+// The blink is an ANSI attribute, so plain output (NO_COLOR) drops it with the colors.
+func exhaustedLabel() string {
+	switch getBlockedMarker() {
+	case "bracket":
+		return "[BLOCKED]"
+	case "blink":
+		return ColorBlink + "[BLOCKED]"
 	}
-	return &response, nil
+	return "EXHAUSTED"
 }
 
-// parseISOTime parses an ISO 8601 datetime string with timezone support
-func parseISOTime(s string) (time.Time, error) {
-	// Try common formats with timezone support
-	formats := []string{
-		time.RFC3339, // "2006-01-02T15:04:05Z07:00"
-		"2006-01-02T15:04:05.999999Z07:00",
-		"2006-01-02T15:04:05.999999",
-		"2006-01-02T15:04:05",
-		"2006-01-02 15:04:05.999999",
-		"2006-01-02 15:04:05",
-	}
+// isVerboseEnabled returns true when LITELLM_VERBOSE is set, the environment
+// equivalent of -verbose.
+func isVerboseEnabled() bool {
+	val := os.Getenv("LITELLM_VERBOSE")
+	return val == "1" || val == "true"
+}
 
-	for _, format := range formats {
-		if t, err := time.Parse(format, s); err == nil {
-			return t.UTC(), nil
-		}
-	}
+// isOfflineEnabled returns true when LITELLM_OFFLINE is set: only cached data is
+// shown (regardless of age) and no network request is ever made.
+func isOfflineEnabled() bool {
+	val := os.Getenv("LITELLM_OFFLINE")
+	return val == "1" || val == "true"
+}
 
-	return time.Time{}, fmt.Errorf("unable to parse time: %s", s)
+// isQuietErrorsEnabled returns true when LITELLM_QUIET_ERRORS is set, which swaps
+// transient error messages for the last cached budget (rendered dimmed).
+func isQuietErrorsEnabled() bool {
+	val := os.Getenv("LITELLM_QUIET_ERRORS")
+	return val == "1" || val == "true"
 }
 
-// normalizeDuration maps named duration aliases to their canonical day/hour form.
-func normalizeDuration(duration string) string {
-	switch strings.TrimSpace(strings.ToLower(duration)) {
-	case "monthly", "1mo":
-		return "30d"
-	case "weekly":
-		return "7d"
-	case "daily":
-		return "1d"
-	default:
-		return strings.TrimSpace(strings.ToLower(duration))
+// getLabel returns the fallback label text (LITELLM_LABEL, default "LiteLLM").
+// An explicitly empty LITELLM_LABEL returns "", which drops the prefix entirely.
+func getLabel() string {
+	if val, ok := os.LookupEnv("LITELLM_LABEL"); ok {
+		return strings.TrimSpace(val)
 	}
+	return "LiteLLM"
 }
 
-// calculateNextReset calculates when the budget will next reset.
-// Returns now + duration as a rolling window, matching LiteLLM's actual reset behavior.
-// Returns zero time if the duration format is unrecognized.
-func calculateNextReset(duration string) time.Time {
-	normalized := normalizeDuration(duration)
-	if d, ok := parseCustomDuration(normalized); ok {
-		return time.Now().UTC().Add(d)
+// isShowSafeRateEnabled returns true when LITELLM_SHOW_SAFE_RATE is set, appending the
+// hourly spend rate that would exactly use up the remaining budget by the next reset.
+func isShowSafeRateEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_SAFE_RATE")
+	return val == "1" || val == "true"
+}
+
+// isShowSparklineEnabled returns true when LITELLM_SHOW_SPARKLINE is set, appending a
+// trend graph of recent spend samples.
+func isShowSparklineEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_SPARKLINE")
+	return val == "1" || val == "true"
+}
+
+// getSparklineSamples returns how many recent samples the sparkline draws
+// (LITELLM_SPARKLINE_SAMPLES, 2..MaxHistorySamples). Invalid values fall back to the default.
+func getSparklineSamples() int {
+	val := strings.TrimSpace(os.Getenv("LITELLM_SPARKLINE_SAMPLES"))
+	if val == "" {
+		return DefaultSparklineSamples
 	}
-	return time.Time{}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 2 {
+		return DefaultSparklineSamples
+	}
+	return min(n, MaxHistorySamples)
 }
 
-// formatDuration formats a time.Duration as a human-readable string
-func formatDuration(diff time.Duration) string {
-	if diff <= 0 {
-		return "resetting"
+// isShowAllResetsEnabled returns true when LITELLM_SHOW_ALL_RESETS is set, showing
+// every reset window instead of only the nearest (see formatResetSegment).
+func isShowAllResetsEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_ALL_RESETS")
+	return val == "1" || val == "true"
+}
+
+// isHideResetEnabled returns true when LITELLM_HIDE_RESET is set, leaving the
+// "reset:" countdown out of the statusline even when the reset time is known.
+func isHideResetEnabled() bool {
+	val := os.Getenv("LITELLM_HIDE_RESET")
+	return val == "1" || val == "true"
+}
+
+// isHideWhenZeroEnabled returns true when LITELLM_HIDE_WHEN_ZERO is set, printing an
+// empty statusline while nothing has been spent in the current budget period.
+func isHideWhenZeroEnabled() bool {
+	val := os.Getenv("LITELLM_HIDE_WHEN_ZERO")
+	return val == "1" || val == "true"
+}
+
+// getShowModels returns how the allowed-models segment is shown (LITELLM_SHOW_MODELS):
+// "count" for 1/true/count, "list" for list, or "" (off) otherwise.
+func getShowModels() string {
+	switch os.Getenv("LITELLM_SHOW_MODELS") {
+	case "1", "true", "count":
+		return "count"
+	case "list":
+		return "list"
 	}
+	return ""
+}
 
-	days := int(diff.Hours()) / 24
-	hours := int(diff.Hours()) % 24
-	minutes := int(diff.Minutes()) % 60
+// getMetadataKey returns LITELLM_SHOW_METADATA_KEY: the key metadata field to show as
+// a label after the prefix (e.g. "cost_center"). Empty means no label.
+func getMetadataKey() string {
+	return strings.TrimSpace(os.Getenv("LITELLM_SHOW_METADATA_KEY"))
+}
 
-	if days > 0 {
-		return fmt.Sprintf("%dd%dh", days, hours)
+// getModelsMaxLen returns the maximum length of the model list from
+// LITELLM_MODELS_MAX_LEN, defaulting to DefaultModelsMaxLen. Values under 2 fall back
+// to the default.
+func getModelsMaxLen() int {
+	n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("LITELLM_MODELS_MAX_LEN")))
+	if err != nil || n < 2 {
+		return DefaultModelsMaxLen
 	}
-	if hours > 0 {
-		return fmt.Sprintf("%dh", hours)
+	return n
+}
+
+// isShowRPMEnabled returns true when LITELLM_SHOW_RPM is set, appending the key's
+// requests-per-minute usage against its rpm_limit.
+func isShowRPMEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_RPM")
+	return val == "1" || val == "true"
+}
+
+// isShowAgeEnabled returns true when LITELLM_SHOW_AGE is set, appending how long ago
+// the budget data was fetched.
+func isShowAgeEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_AGE")
+	return val == "1" || val == "true"
+}
+
+// isShowTokensEnabled returns true when LITELLM_SHOW_TOKENS is set, appending the
+// key's token usage when the proxy reports it.
+func isShowTokensEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_TOKENS")
+	return val == "1" || val == "true"
+}
+
+// isShowTopModelEnabled returns true when LITELLM_SHOW_TOP_MODEL is set, appending the
+// model with the highest spend today (from /spend/logs).
+func isShowTopModelEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_TOP_MODEL")
+	return val == "1" || val == "true"
+}
+
+// getDebounceMs returns LITELLM_DEBOUNCE_MS, how long a new status color must be seen
+// before it replaces the shown one. 0 (default), negative, or invalid values disable
+// debouncing.
+func getDebounceMs() int64 {
+	val := strings.TrimSpace(os.Getenv("LITELLM_DEBOUNCE_MS"))
+	if val == "" {
+		return 0
 	}
-	if minutes > 0 {
-		return fmt.Sprintf("%dm", minutes)
+	ms, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || ms < 0 {
+		return 0
 	}
-	return "resetting"
+	return ms
 }
 
-// getDurationLabel returns a human-readable label for the budget duration
-func getDurationLabel(duration string) string {
-	duration = strings.TrimSpace(strings.ToLower(duration))
-	switch duration {
-	case "30d", "1mo", "monthly":
-		return "monthly"
-	case "7d", "weekly":
-		return "weekly"
-	case "1d", "24h", "daily":
-		return "daily"
-	default:
-		return ""
+// getBreakerThreshold returns how many consecutive failed fetches open the circuit
+// breaker (LITELLM_BREAKER_THRESHOLD, default 1). Invalid values fall back to the default.
+func getBreakerThreshold() int {
+	n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("LITELLM_BREAKER_THRESHOLD")))
+	if err != nil || n < 1 {
+		return DefaultBreakerThreshold
 	}
+	return n
 }
 
-// formatTimeUntilReset formats the time remaining until budget reset.
-// Returns (timeString, durationLabel). timeString is "unknown" if the duration
-// format is present but unrecognized.
-func formatTimeUntilReset(resetAt *string, budgetDuration *string) (string, string) {
-	now := time.Now().UTC()
-	var durationLabel string
+// getOutputFile returns LITELLM_OUTPUT_FILE: a file (or named pipe) that receives a
+// copy of each status line, "" when unset.
+func getOutputFile() string {
+	return strings.TrimSpace(os.Getenv("LITELLM_OUTPUT_FILE"))
+}
 
-	if budgetDuration != nil && *budgetDuration != "" {
-		durationLabel = getDurationLabel(*budgetDuration)
+// socketPath returns the Unix socket used by -daemon and -client (LITELLM_SOCKET),
+// defaulting to daemon.sock in the cache directory.
+func socketPath() string {
+	if path := strings.TrimSpace(os.Getenv("LITELLM_SOCKET")); path != "" {
+		return path
 	}
+	return filepath.Join(cacheDir(), "daemon.sock")
+}
 
-	// First try to use budget_reset_at if provided
-	if resetAt != nil && *resetAt != "" {
-		t, err := parseISOTime(*resetAt)
-		if err == nil {
-			return formatDuration(t.Sub(now)), durationLabel
-		}
+// getResetUnits returns how many units the reset countdown shows (LITELLM_RESET_UNITS:
+// 1 "2d", 2 "2d3h", 3 "2d3h15m"). Unset or invalid values return 0, the classic
+// countdown (see formatDuration).
+func getResetUnits() int {
+	n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("LITELLM_RESET_UNITS")))
+	if err != nil || n < 1 || n > 3 {
+		return 0
 	}
+	return n
+}
 
-	// Fall back to calculating from budget_duration
-	if budgetDuration != nil && *budgetDuration != "" {
-		nextReset := calculateNextReset(*budgetDuration)
-		if !nextReset.IsZero() {
-			return formatDuration(nextReset.Sub(now)), durationLabel
-		}
-		// Duration is set but format is unrecognized — tell the user
-		return "unknown", durationLabel
+// getResetRound returns how the reset countdown's smallest shown unit is rounded
+// (LITELLM_RESET_ROUND): "down" (truncate, default), "up", or "nearest".
+func getResetRound() string {
+	switch val := strings.ToLower(strings.TrimSpace(os.Getenv("LITELLM_RESET_ROUND"))); val {
+	case "up", "nearest":
+		return val
 	}
+	return "down"
+}
 
-	return "", ""
+// getRounding returns how money is rounded to cents (LITELLM_ROUNDING):
+// "round" (half away from zero, default), "floor" (never overstate), or "ceil".
+func getRounding() string {
+	switch val := os.Getenv("LITELLM_ROUNDING"); val {
+	case "floor", "ceil":
+		return val
+	default:
+		return "round"
+	}
 }
 
-// budgetColor returns the ANSI color code for a budget usage percentage.
-func budgetColor(percent float64) string {
-	if percent >= 90 {
-		return ColorRed
+// getConversion returns the display currency (LITELLM_CONVERT_TO, e.g. "EUR") and the
+// static USD rate to convert with (LITELLM_FX_RATE, units of that currency per dollar).
+// ok is false — amounts stay in USD — unless both are set and the rate is positive.
+func getConversion() (code string, rate float64, ok bool) {
+	code = strings.ToUpper(strings.TrimSpace(os.Getenv("LITELLM_CONVERT_TO")))
+	if code == "" || code == "USD" {
+		return "", 0, false
 	}
-	if percent >= 75 {
-		return ColorYellow
+	rate, err := strconv.ParseFloat(os.Getenv("LITELLM_FX_RATE"), 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return "", 0, false
 	}
-	return ColorGreen
+	return code, rate, true
 }
 
-// circleGlyph returns a Unicode quadrant-fill glyph approximating the given
-// usage percentage as a circular gauge.
-// Buckets: empty (≤0) · quarter (<30) · half (<60) · three-quarter (<85) · full (≥85).
-func circleGlyph(percent float64) string {
-	switch {
-	case percent <= 0:
-		return "○"
-	case percent < 30:
-		return "◔"
-	case percent < 60:
-		return "◑"
-	case percent < 85:
-		return "◕"
-	default:
-		return "●"
+// isShowOriginalEnabled returns true when LITELLM_SHOW_ORIGINAL is set, appending the
+// unconverted USD amount to each converted one (see formatMoney).
+func isShowOriginalEnabled() bool {
+	val := os.Getenv("LITELLM_SHOW_ORIGINAL")
+	return val == "1" || val == "true"
+}
+
+// isMicroCentsEnabled returns true when LITELLM_MICRO_CENTS is set, showing sub-cent
+// amounts with extra precision instead of "$0.00" (see formatMoney).
+func isMicroCentsEnabled() bool {
+	val := os.Getenv("LITELLM_MICRO_CENTS")
+	return val == "1" || val == "true"
+}
+
+// getAuthType returns the API auth scheme from LITELLM_AUTH_TYPE: "basic", or
+// "bearer" (the default, also used for unrecognized values).
+func getAuthType() string {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("LITELLM_AUTH_TYPE")), "basic") {
+		return "basic"
 	}
+	return "bearer"
 }
 
-// parseCustomDuration parses a duration string like "48h", "2d" into time.Duration
-func parseCustomDuration(duration string) (time.Duration, bool) {
-	if len(duration) < 2 {
-		return 0, false
+// getResetLabel returns the text shown while a due reset is pending on the proxy
+// (LITELLM_RESET_LABEL, default "resetting").
+func getResetLabel() string {
+	if val := strings.TrimSpace(os.Getenv("LITELLM_RESET_LABEL")); val != "" {
+		return val
 	}
-	suffix := duration[len(duration)-1]
-	valueStr := duration[:len(duration)-1]
-	var value int
-	if _, err := fmt.Sscanf(valueStr, "%d", &value); err != nil {
-		return 0, false
+	return "resetting"
+}
+
+// getUnlimitedLabel returns the text shown when the key has no budget to measure
+// against (LITELLM_UNLIMITED_LABEL, default "no budget configured"), e.g. "unmetered".
+func getUnlimitedLabel() string {
+	if val := strings.TrimSpace(os.Getenv("LITELLM_UNLIMITED_LABEL")); val != "" {
+		return val
 	}
-	switch suffix {
-	case 'd':
-		return time.Duration(value) * 24 * time.Hour, true
-	case 'h':
-		return time.Duration(value) * time.Hour, true
-	case 'm':
-		return time.Duration(value) * time.Minute, true
-	case 's':
-		return time.Duration(value) * time.Second, true
+	return "no budget configured"
+}
+
+// getNoDataLabel returns the text shown in offline mode before anything was cached
+// (LITELLM_NODATA_LABEL, default "No cached data").
+func getNoDataLabel() string {
+	if val := strings.TrimSpace(os.Getenv("LITELLM_NODATA_LABEL")); val != "" {
+		return val
 	}
-	return 0, false
+	return "No cached data"
 }
 
-// contextColor returns the ANSI color code for a context-window usage percentage.
-// Mirrors budgetColor's thresholds but kept as a separate function so the two
-// can drift independently if user feedback warrants it.
-func contextColor(percent float64) string {
-	if percent >= 85 {
-		return ColorRed
+// getResetFormat returns LITELLM_RESET_FORMAT: "relative" (default), "absolute",
+// "both", or "human". Unrecognized values fall back to relative.
+func getResetFormat() string {
+	switch val := strings.ToLower(strings.TrimSpace(os.Getenv("LITELLM_RESET_FORMAT"))); val {
+	case "absolute", "both", "human":
+		return val
 	}
-	if percent >= 70 {
-		return ColorYellow
+	return "relative"
+}
+
+// getSeparator returns LITELLM_SEPARATOR, the text between status segments
+// (default " | "). Only a custom separator also goes before the reset segment (see
+// resetLead).
+func getSeparator() string {
+	if sep := os.Getenv("LITELLM_SEPARATOR"); sep != "" {
+		return sep
 	}
-	return ColorGreen
+	return DefaultSeparator
 }
 
-// formatContextSegment renders the " | 📖 ● <pct>%[ — suggestion]" segment from
-// Claude Code's stdin payload. Returns "" when the context window data is absent
-// (no field, null pointer, or pre-first-API-call).
-func formatContextSegment(input StatusInput) string {
-	if input.ContextWindow == nil || input.ContextWindow.UsedPercentage == nil {
-		return ""
+// getColorMode returns LITELLM_COLOR_MODE: "basic" (default, 8/16-color codes),
+// "256", or "truecolor". Unrecognized values fall back to basic.
+func getColorMode() string {
+	switch val := strings.ToLower(strings.TrimSpace(os.Getenv("LITELLM_COLOR_MODE"))); val {
+	case "256", "truecolor":
+		return val
 	}
-	pct := *input.ContextWindow.UsedPercentage
-	if pct < 0 {
-		pct = 0
-	} else if pct > 100 {
-		pct = 100
+	return "basic"
+}
+
+// colorNames maps the color names parseColor accepts to basic foreground codes.
+var colorNames = map[string]string{
+	"black":   "\x1b[30m",
+	"red":     ColorRed,
+	"green":   ColorGreen,
+	"yellow":  ColorYellow,
+	"blue":    "\x1b[34m",
+	"magenta": "\x1b[35m",
+	"cyan":    "\x1b[36m",
+	"white":   "\x1b[37m",
+	"gray":    ColorGray,
+	"grey":    ColorGray,
+}
+
+// parseColor resolves a configured color to an ANSI escape. It accepts a name from
+// colorNames ("blue"), raw SGR parameters ("34", "38;5;25"), a full escape sequence,
+// or "#RRGGBB" hex, which becomes a truecolor escape.
+func parseColor(s string) (string, error) {
+	val := strings.TrimSpace(s)
+	if c, ok := colorNames[strings.ToLower(val)]; ok {
+		return c, nil
 	}
-	color := contextColor(pct)
-	suggestion := ""
-	switch {
-	case pct >= 85:
-		suggestion = " — run /compact or /clear"
-	case pct >= 70:
-		suggestion = " — consider /compact"
+	if strings.HasPrefix(val, "\x1b[") && strings.HasSuffix(val, "m") {
+		return val, nil
 	}
-	return fmt.Sprintf(" %s|%s 📖 %s%s%s %.0f%%%s%s",
-		ColorGray, ColorReset, color, circleGlyph(pct), ColorReset, pct, suggestion, ColorReset)
+	if strings.Trim(val, "0123456789;") == "" && strings.Trim(val, ";") != "" {
+		return "\x1b[" + val + "m", nil
+	}
+	if hex, ok := strings.CutPrefix(val, "#"); ok && len(hex) == 6 {
+		if rgb, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return fmt.Sprintf("\x1b[38;2;%d;%d;%dm", rgb>>16, rgb>>8&0xff, rgb&0xff), nil
+		}
+	}
+	return "", fmt.Errorf("%w %q: want a color name, ANSI codes or #RRGGBB", ErrInvalidColor, s)
 }
 
-// formatStatusLine formats the budget info as a colored status circle with optional
-// dollar amounts, reset countdown, and context-window segment.
-// latestVersion is the latest GitHub release tag (empty string to skip update notice).
-func formatStatusLine(info *KeyInfo, latestVersion string, input StatusInput) string {
-	info = resolveEffectiveBudget(info)
-	spend := 0.0
-	if info.Spend != nil {
-		spend = *info.Spend
+// colorEnvVars lists the variables that hold a color for parseColor.
+var colorEnvVars = []string{"LITELLM_META_COLOR"}
+
+// validateColors checks every set color variable, so a typo is reported instead of
+// silently falling back to the default color.
+func validateColors() error {
+	for _, name := range colorEnvVars {
+		if val := os.Getenv(name); strings.TrimSpace(val) != "" {
+			if _, err := parseColor(val); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
 	}
+	return nil
+}
 
-	updateStr := ""
-	if isUpdateAvailable(Version, latestVersion) {
-		updateStr = fmt.Sprintf(" %s| update: %s%s", ColorYellow, latestVersion, ColorReset)
+// getMetaColor returns the escape used for the gray meta segments (reset countdown,
+// separators, age, top model, ...), set with LITELLM_META_COLOR (see parseColor).
+// Unset or invalid values keep ColorGray, which is hard to read on light themes;
+// run rejects invalid ones up front (see validateColors).
+func getMetaColor() string {
+	val := os.Getenv("LITELLM_META_COLOR")
+	if val == "" {
+		return ColorGray
 	}
+	if c, err := parseColor(val); err == nil {
+		return c
+	}
+	return ColorGray
+}
 
-	contextStr := formatContextSegment(input)
-	prefix := getPrefix(input)
+// isNotifyEnabled returns true when LITELLM_NOTIFY is set, enabling a one-time desktop
+// notification when budget usage crosses into the critical band.
+func isNotifyEnabled() bool {
+	val := os.Getenv("LITELLM_NOTIFY")
+	return val == "1" || val == "true"
+}
 
-	if info.MaxBudget == nil || *info.MaxBudget <= 0 {
-		// No team budget resolved — key-level spend is intentionally not shown as a fallback.
-		return formatError("no budget configured", input)
+// getPrefix returns the status line prefix.
+// Precedence: LITELLM_PLUGIN_PREFIX (if set, even to empty) > stdin model display name > "<label>: ".
+func getPrefix(input StatusInput) string {
+	if val, ok := os.LookupEnv("LITELLM_PLUGIN_PREFIX"); ok {
+		if val == "" {
+			return ""
+		}
+		return val + " "
+	}
+	if name := strings.TrimSpace(input.Model.DisplayName); name != "" {
+		return name + ": "
+	}
+	if label := getLabel(); label != "" {
+		return label + ": "
 	}
+	return ""
+}
 
-	budget := *info.MaxBudget
-	percent := (spend / budget) * 100
-	absColor := budgetColor(percent)
+// revalidations tracks in-process background cache refreshes started by getKeyInfo
+// (see startRevalidation).
+var revalidations sync.WaitGroup
 
-	var budgetStr string
-	if isShowCostEnabled() {
-		budgetStr = fmt.Sprintf("$%.2f/$%.2f (%.0f%%)", spend, budget, percent)
-	} else {
-		budgetStr = fmt.Sprintf("%.0f%%", percent)
+// detachRevalidation makes startRevalidation hand refreshes, and runCritHook the
+// LITELLM_ON_CRIT command, to a child process. run sets it for one-shot invocations,
+// which exit right after printing.
+var detachRevalidation bool
+
+// spawnRevalidation starts this binary with -revalidate, detached from our stdin and
+// stdout so the caller reading the statusline never waits on it. Overridden in tests.
+var spawnRevalidation = func() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
 	}
+	return exec.Command(exe, "-revalidate").Start()
+}
 
-	resetStr := ""
-	resetTime, durationLabel := formatTimeUntilReset(info.BudgetResetAt, info.BudgetDuration)
-	if resetTime != "" {
-		if durationLabel != "" {
-			resetStr = fmt.Sprintf(" %s%s reset: %s%s", ColorGray, durationLabel, resetTime, ColorReset)
-		} else {
-			resetStr = fmt.Sprintf(" %s reset: %s%s", ColorGray, resetTime, ColorReset)
+// claimRevalidation takes the on-disk lease for a -revalidate child, so the many
+// statusline invocations inside one stale window start a single child between them
+// (refreshShared only dedupes within a process). The lease file is created with
+// O_EXCL; the child removes it when done, and one older than RevalidateLease is
+// taken over in case its child died. Without a usable cache directory there is
+// nothing to coordinate on, so the refresh is allowed.
+func claimRevalidation() bool {
+	path := revalidateLeaseFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return true
+	}
+	for range 2 {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			_ = f.Close()
+			return true
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			debugf("could not take the revalidation lease: %v", err)
+			return true
 		}
+		// The lease is a real file, so its age is measured on the wall clock.
+		if st, err := os.Stat(path); err == nil && time.Since(st.ModTime()) < RevalidateLease {
+			return false
+		}
+		_ = os.Remove(path)
 	}
+	return false
+}
 
-	line := fmt.Sprintf("%s%s%s%s %s%s%s",
-		prefix, absColor, circleGlyph(percent), ColorReset, absColor, budgetStr, ColorReset)
+// releaseRevalidation drops the lease taken by claimRevalidation.
+func releaseRevalidation() {
+	_ = os.Remove(revalidateLeaseFile())
+}
 
-	line += resetStr + updateStr + contextStr
-	return line
+// detachRefresh hands a background refresh to a -revalidate child in a one-shot run,
+// which refreshes whatever is stale (see run). A child already refreshing for another
+// invocation (see claimRevalidation) is left to it. It reports false when the caller
+// should refresh in-process instead: in the daemon, or when no child could be started.
+func detachRefresh() bool {
+	if !detachRevalidation {
+		return false
+	}
+	if !claimRevalidation() {
+		return true
+	}
+	err := spawnRevalidation()
+	if err == nil {
+		return true
+	}
+	releaseRevalidation()
+	debugf("could not start background refresh, refreshing in-process: %v", err)
+	return false
 }
 
-// formatError formats an error message with red color
-func formatError(msg string, input StatusInput) string {
-	return fmt.Sprintf("%s%s%s%s", ColorRed, getPrefix(input), msg, ColorReset)
+// startRevalidation refreshes the cache in the background after getKeyInfo served a
+// stale entry. A one-shot run spawns a child process for it, so neither the
+// statusline nor the process exit waits on the network; the daemon outlives the fetch
+// and uses a goroutine.
+func startRevalidation(apiKey string, b *breaker) {
+	if detachRefresh() {
+		return
+	}
+	revalidations.Add(1)
+	go func() {
+		defer revalidations.Done()
+		_, _ = refreshShared(apiKey, b)
+	}()
 }
 
-// StatusJSON is the structured output emitted with --json, consumed by the VS Code
-// extension (and any other caller that prefers data over ANSI text). All fields are
-// optional — absent values are omitted so a minimal payload stays minimal.
+// getKeyInfo fetches budget info from the LiteLLM API, using a filesystem cache
+// (30 seconds by default, see getCacheTTLMs) to avoid hitting the API on every
+// statusline refresh.
+// Each invocation of this binary is a fresh process, so all state must live on disk.
+// Entries past the TTL but within StaleTTLMs are returned immediately while a background
+// refresh updates the cache for the next invocation (stale-while-revalidate, see
+// startRevalidation).
+func getKeyInfo(apiKey string) (*KeyInfo, error) {
+	if isOfflineEnabled() {
+		// Offline: serve whatever was cached last, however old, and never touch the network.
+		if entry, ok := readBudgetCacheEntry(); ok {
+			return &entry.Info, nil
+		}
+		return nil, ErrNoCachedData
+	}
+	ttl := getCacheTTLMs()
+	entry, cached := readBudgetCacheEntry()
+	cached = cached && ttl > 0
+	age := int64(0)
+	if cached {
+		age = nowFunc().UnixMilli() - entry.Timestamp
+		if age < ttl {
+			return &entry.Info, nil
+		}
+	}
+	// Breaker open → back off and replay the cached error instead of re-blocking
+	// on the network every refresh while the proxy is down / key is bad / over budget.
+	b := newBreaker()
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	if cached && age < StaleTTLMs {
+		startRevalidation(apiKey, b)
+		return &entry.Info, nil
+	}
+	return refreshShared(apiKey, b)
+}
+
+// inflightFetch is a budget fetch in progress, shared by every caller that asks for
+// the same key before it completes.
+type inflightFetch struct {
+	done chan struct{}
+	info *KeyInfo
+	err  error
+}
+
+// inflightFetches holds the fetches in progress, keyed by cacheKey and API key.
+var inflightFetches = struct {
+	sync.Mutex
+	m map[string]*inflightFetch
+}{m: make(map[string]*inflightFetch)}
+
+// refreshShared is refreshKeyInfo with overlapping calls for the same key collapsed
+// into one (singleflight): the daemon's connections or a background revalidation
+// racing a foreground fetch wait for the request already in flight instead of
+// sending their own.
+func refreshShared(apiKey string, b *breaker) (*KeyInfo, error) {
+	key := cacheKey() + "\x00" + apiKey
+	inflightFetches.Lock()
+	if f, ok := inflightFetches.m[key]; ok {
+		inflightFetches.Unlock()
+		<-f.done
+		return f.info, f.err
+	}
+	f := &inflightFetch{done: make(chan struct{})}
+	inflightFetches.m[key] = f
+	inflightFetches.Unlock()
+
+	defer func() {
+		inflightFetches.Lock()
+		delete(inflightFetches.m, key)
+		inflightFetches.Unlock()
+		close(f.done)
+	}()
+	f.info, f.err = refreshKeyInfo(apiKey, b)
+	return f.info, f.err
+}
+
+// refreshKeyInfo fetches fresh budget info and updates the filesystem cache, reporting
+// the outcome to the breaker (which negative-caches failures).
+// When the key has a team_id, a second call to /team/info populates the team budget
+// fields — the only budget the statusline displays (key-level budget is ignored).
+func refreshKeyInfo(apiKey string, b *breaker) (*KeyInfo, error) {
+	baseURL := getBaseURL()
+	info, err := fetchKeyInfoFrom(baseURL, apiKey)
+	// An unreachable primary fails over to the backup proxy, which then also serves the
+	// team/user lookups below.
+	if fallback := getFallbackURL(); fallback != "" && isConnectionError(err) {
+		debugf("primary proxy %s failed (%v), trying fallback %s", baseURL, err, fallback)
+		if info, err = fetchKeyInfoFrom(fallback, apiKey); err == nil {
+			debugf("budget served by fallback proxy %s", fallback)
+			baseURL = fallback
+		}
+	}
+	if errors.Is(err, ErrForbidden) && isUserInfoFallbackEnabled() {
+		if userInfo, uerr := fetchUserInfo(baseURL, apiKey); uerr == nil {
+			debugf("key info forbidden, using /user/info budget instead")
+			info, err = userInfo, nil
+		} else {
+			debugf("user info fallback failed: %v", uerr)
+		}
+	}
+	if err != nil {
+		b.failure(err)
+		return nil, err
+	}
+	b.success()
+	var keyTeam *TeamInfoAPIResponse
+	if info.TeamID != nil && *info.TeamID != "" {
+		if teamResp, err := fetchTeamInfo(baseURL, apiKey, *info.TeamID); err == nil {
+			keyTeam = teamResp
+			ti := teamResp.TeamInfo
+			// Primary source: this member's own per-member budget from team_memberships.
+			// Both the budget and its matching spend come from the same membership row;
+			// the key's own spend is never used (it tracks a different, confusing window).
+			if info.UserID != nil && *info.UserID != "" {
+				for _, m := range teamResp.TeamMemberships {
+					if m.UserID != *info.UserID {
+						continue
+					}
+					if m.LitellmBudgetTable != nil && m.LitellmBudgetTable.MaxBudget != nil {
+						info.TeamSpend = m.Spend
+						info.TeamMaxBudget = m.LitellmBudgetTable.MaxBudget
+						info.TeamBudgetDuration = m.LitellmBudgetTable.BudgetDuration
+						info.TeamBudgetResetAt = m.LitellmBudgetTable.BudgetResetAt
+						// The team's own budget may reset on another schedule; keep it as
+						// the secondary window.
+						if ti.MaxBudget != nil && (derefString(ti.BudgetDuration) != derefString(info.TeamBudgetDuration) ||
+							derefString(ti.BudgetResetAt) != derefString(info.TeamBudgetResetAt)) {
+							info.SecondaryBudgetResetAt = ti.BudgetResetAt
+							info.SecondaryBudgetDuration = ti.BudgetDuration
+						}
+					}
+					break
+				}
+			}
+			// Fallback for instances that expose the budget at the team level instead:
+			// team_member_budget_table, else the team's own max_budget. Spend is paired
+			// with the team total — again, never the key's spend.
+			if info.TeamMaxBudget == nil {
+				switch {
+				case ti.TeamMemberBudgetTable != nil && ti.TeamMemberBudgetTable.MaxBudget != nil:
+					info.TeamMaxBudget = ti.TeamMemberBudgetTable.MaxBudget
+					info.TeamBudgetDuration = ti.TeamMemberBudgetTable.BudgetDuration
+				case ti.MaxBudget != nil:
+					info.TeamMaxBudget = ti.MaxBudget
+				}
+				if info.TeamMaxBudget != nil {
+					info.TeamSpend = ti.Spend
+					if info.TeamBudgetResetAt == nil {
+						info.TeamBudgetResetAt = ti.BudgetResetAt
+					}
+					if info.TeamBudgetDuration == nil {
+						info.TeamBudgetDuration = ti.BudgetDuration
+					}
+				}
+			}
+		}
+	}
+	// Explicitly monitored team: reuse the key's own /team/info response when it's the
+	// same team. A missing/unknown team just leaves the segment off.
+	if teamID := getTeamID(); teamID != "" {
+		teamResp := keyTeam
+		if teamResp == nil || info.TeamID == nil || *info.TeamID != teamID {
+			teamResp, _ = fetchTeamInfo(baseURL, apiKey, teamID)
+		}
+		if teamResp != nil && teamResp.TeamInfo.MaxBudget != nil {
+			info.TeamTotalSpend = teamResp.TeamInfo.Spend
+			info.TeamTotalMaxBudget = teamResp.TeamInfo.MaxBudget
+		}
+	}
+	// Spend dropping sharply since the last fetch means the budget period rolled over.
+	// The cache is replaced below as always; the old period's spend history would
+	// skew the sparkline, so it starts over.
+	if prev, ok := readBudgetCacheEntry(); ok {
+		before := derefFloat(resolveEffectiveBudget(&prev.Info).Spend)
+		after := derefFloat(resolveEffectiveBudget(info).Spend)
+		if spendWasReset(before, after) {
+			debugf("spend dropped from %s to %s, treating it as a budget reset", formatMoney(before), formatMoney(after))
+			clearSpendHistory()
+		}
+	}
+	writeBudgetCache(info)
+	if isShowSparklineEnabled() {
+		if effective := resolveEffectiveBudget(info); effective.MaxBudget != nil {
+			appendSpendHistory(derefFloat(effective.Spend))
+		}
+	}
+	return info, nil
+}
+
+// fetchSpendLogs calls /spend/logs for today (UTC, the proxy's day boundary). With
+// LITELLM_QUERY_KEY the logs are filtered to that key, matching the budget shown.
+func fetchSpendLogs(apiKey string) ([]SpendLogEntry, error) {
+	baseURL := getBaseURL()
+	if baseURL == "" {
+		return nil, fmt.Errorf("no LiteLLM proxy URL configured")
+	}
+	today := nowFunc().UTC()
+	q := url.Values{}
+	q.Set("start_date", today.Format("2006-01-02"))
+	q.Set("end_date", today.AddDate(0, 0, 1).Format("2006-01-02"))
+	if queryKey := getQueryKey(); queryKey != "" {
+		q.Set("api_key", queryKey)
+	}
+	endpoint, err := apiURL(baseURL, "/spend/logs", q)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newAPIClient()
+	req, err := newAPIRequest(endpoint, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("spend logs HTTP error: status=%d", resp.StatusCode)
+	}
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []SpendLogEntry
+	if err := json.Unmarshal(body, &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// fetchOrgSpendReport calls /global/spend/report for the current calendar month (UTC).
+func fetchOrgSpendReport(apiKey string) ([]OrgSpendReportEntry, error) {
+	baseURL := getBaseURL()
+	if baseURL == "" {
+		return nil, fmt.Errorf("no LiteLLM proxy URL configured (set LITELLM_PROXY_URL or ANTHROPIC_BASE_URL)")
+	}
+	now := nowFunc().UTC()
+	q := url.Values{}
+	q.Set("start_date", time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format("2006-01-02"))
+	q.Set("end_date", now.AddDate(0, 0, 1).Format("2006-01-02"))
+	endpoint, err := apiURL(baseURL, "/global/spend/report", q)
+	if err != nil {
+		return nil, err
+	}
+	url, _ := apiURL(baseURL, "/global/spend/report", nil)
+
+	client := newAPIClient()
+	req, err := newAPIRequest(endpoint, apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("request creation failed: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		debugf("GET %s failed: %v", url, err)
+		return nil, fmt.Errorf("connection error: %w [url=%s]", err, url)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	debugf("GET %s status=%d", url, resp.StatusCode)
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("status=%d url=%s: %w", resp.StatusCode, url, ErrAuth)
+	case http.StatusForbidden:
+		// Only admin keys may read the org-wide report.
+		return nil, fmt.Errorf("status=%d url=%s: %w", resp.StatusCode, url, ErrForbidden)
+	default:
+		return nil, fmt.Errorf("HTTP error: status=%d url=%s body=%s", resp.StatusCode, url, string(body))
+	}
+
+	var report []OrgSpendReportEntry
+	if err := json.Unmarshal(body, &report); err != nil {
+		debugf("GET %s returned an unparseable spend report: %v [body=%s]", url, err, bodySnippet(body, apiKey))
+		return nil, fmt.Errorf("spend report %s: %w", url, ErrBadResponse)
+	}
+	return report, nil
+}
+
+// orgKeyInfo maps a month's org spend report onto the budget fields the statusline
+// renders, like fetchUserInfo does for /user/info: the summed spend against
+// LITELLM_ORG_BUDGET, resetting at the start of next month (UTC).
+func orgKeyInfo(report []OrgSpendReportEntry, now time.Time) *KeyInfo {
+	spend := 0.0
+	for _, day := range report {
+		spend += day.spend()
+	}
+	now = now.UTC()
+	resetAt := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	duration := "monthly"
+	info := &KeyInfo{TeamSpend: &spend, TeamBudgetResetAt: &resetAt, TeamBudgetDuration: &duration}
+	if budget, ok := getOrgBudget(); ok {
+		info.TeamMaxBudget = &budget
+	}
+	return info
+}
+
+// getOrgInfo returns the org-wide budget for LITELLM_SCOPE=org, cached for
+// OrgReportTTLMs since the report is expensive for the proxy to build. Offline mode
+// serves the last cached value, however old.
+func getOrgInfo(apiKey string) (*KeyInfo, error) {
+	cached, _ := readOrgCacheEntry()
+	if isOfflineEnabled() {
+		if cached == nil {
+			return nil, ErrNoCachedData
+		}
+		return &cached.Info, nil
+	}
+	if cached != nil && nowFunc().UnixMilli()-cached.Timestamp < OrgReportTTLMs {
+		return &cached.Info, nil
+	}
+	report, err := fetchOrgSpendReport(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	info := orgKeyInfo(report, nowFunc())
+	if data, err := json.Marshal(BudgetCacheEntry{Timestamp: nowFunc().UnixMilli(), Info: *info}); err == nil {
+		writeCacheFile(orgReportCacheFile(), data)
+	}
+	return info, nil
+}
+
+// readOrgCacheEntry reads the cached org budget regardless of its age. Returns nil,
+// false if the cache is missing or corrupt.
+func readOrgCacheEntry() (*BudgetCacheEntry, bool) {
+	data, err := readCacheFile(orgReportCacheFile())
+	if err != nil {
+		return nil, false
+	}
+	var entry BudgetCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// readScopeCacheEntry reads the cached budget for the configured LITELLM_SCOPE
+// regardless of its age, with the TTL it is refreshed after.
+func readScopeCacheEntry() (entry *BudgetCacheEntry, ttlMs int64, ok bool) {
+	if getScope() == "org" {
+		entry, ok = readOrgCacheEntry()
+		return entry, OrgReportTTLMs, ok
+	}
+	entry, ok = readBudgetCacheEntry()
+	return entry, getCacheTTLMs(), ok
+}
+
+// orgSpendWithoutBudget returns the month's org spend when LITELLM_SCOPE=org has no
+// LITELLM_ORG_BUDGET to measure it against, so the spend is still shown.
+func orgSpendWithoutBudget(info *KeyInfo) (float64, bool) {
+	if info == nil || info.TeamSpend == nil || (info.TeamMaxBudget != nil && *info.TeamMaxBudget > 0) {
+		return 0, false
+	}
+	if getScope() != "org" {
+		return 0, false
+	}
+	return *info.TeamSpend, true
+}
+
+// getBudgetInfo returns the budget for the configured LITELLM_SCOPE.
+func getBudgetInfo(apiKey string) (*KeyInfo, error) {
+	if getScope() == "org" {
+		return getOrgInfo(apiKey)
+	}
+	return getKeyInfo(apiKey)
+}
+
+// topModel aggregates spend logs by model and returns the one with the highest total.
+// Ties go to the alphabetically first model so the output is stable. ok is false when
+// no model has positive spend.
+func topModel(logs []SpendLogEntry) (model string, spend float64, ok bool) {
+	totals := map[string]float64{}
+	for _, entry := range logs {
+		if len(entry.Models) > 0 {
+			for m, v := range entry.Models {
+				totals[m] += v
+			}
+			continue
+		}
+		if entry.Model != "" {
+			totals[entry.Model] += entry.Spend
+		}
+	}
+	for m, v := range totals {
+		if v <= 0 {
+			continue
+		}
+		if !ok || v > spend || (v == spend && m < model) {
+			model, spend, ok = m, v, true
+		}
+	}
+	return model, spend, ok
+}
+
+// refreshTopModel updates the top-model cache from /spend/logs when it's older than
+// TopModelTTLMs. Failures are cached as an empty entry and otherwise ignored — the
+// segment simply disappears.
+func refreshTopModel(apiKey string) {
+	if entry, ok := readTopModelCache(); ok && nowFunc().UnixMilli()-entry.Timestamp < TopModelTTLMs {
+		return
+	}
+	entry := TopModelCacheEntry{Timestamp: nowFunc().UnixMilli()}
+	logs, err := fetchSpendLogs(apiKey)
+	if err != nil {
+		debugf("top model lookup failed: %v", err)
+	} else if model, spend, ok := topModel(logs); ok {
+		entry.Model, entry.Spend = model, spend
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	writeCacheFile(topModelCacheFile(), data)
+}
+
+// topModelRefresh is held while the daemon refreshes the top-model cache, so
+// overlapping requests don't each call /spend/logs.
+var topModelRefresh sync.Mutex
+
+// startTopModelRefresh updates the top-model cache in the background when it's older
+// than TopModelTTLMs, the way startRevalidation does for the budget. The statusline
+// only reads the cache (see formatTopModelSegment), so it never waits on /spend/logs.
+func startTopModelRefresh(apiKey string) {
+	if entry, ok := readTopModelCache(); ok && nowFunc().UnixMilli()-entry.Timestamp < TopModelTTLMs {
+		return
+	}
+	if detachRefresh() || !topModelRefresh.TryLock() {
+		return
+	}
+	revalidations.Add(1)
+	go func() {
+		defer revalidations.Done()
+		defer topModelRefresh.Unlock()
+		refreshTopModel(apiKey)
+	}()
+}
+
+// readTopModelCache reads the cached top-model summary regardless of age.
+func readTopModelCache() (*TopModelCacheEntry, bool) {
+	data, err := readCacheFile(topModelCacheFile())
+	if err != nil {
+		return nil, false
+	}
+	var entry TopModelCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// newAPIClient returns the HTTP client for proxy requests, using apiTransport.
+// HTTPTimeout bounds each request end to end unless LITELLM_CONNECT_TIMEOUT_MS or
+// LITELLM_READ_TIMEOUT_MS split it into phases (see withPhaseTimeouts); the overall
+// limit is then their sum.
+func newAPIClient() *http.Client {
+	transport := apiTransport(isForceHTTP2Enabled())
+	connect, read, split := getPhaseTimeouts()
+	if !split {
+		return &http.Client{Timeout: HTTPTimeout, Transport: transport}
+	}
+	return &http.Client{Timeout: connect + read, Transport: withPhaseTimeouts(transport, connect, read)}
+}
+
+// withPhaseTimeouts returns a copy of rt that gives up on connecting (dial and TLS
+// handshake) after connect, and on waiting for the response headers after read. A
+// slow-but-working link then gets a long read budget while a dead host still fails
+// fast.
+func withPhaseTimeouts(rt http.RoundTripper, connect, read time.Duration) http.RoundTripper {
+	t := rt.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = connect
+	t.ResponseHeaderTimeout = read
+	return t
+}
+
+// apiTransport returns the transport for proxy requests. By default that is Go's
+// standard transport (HTTP/1.1, or HTTP/2 when negotiated over TLS). forceHTTP2 limits
+// it to HTTP/2 only: over TLS for https, and with prior knowledge (h2c) for plain
+// http, for gateways that don't support negotiation.
+func apiTransport(forceHTTP2 bool) http.RoundTripper {
+	if !forceHTTP2 {
+		return http.DefaultTransport
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	t.Protocols = &protocols
+	return t
+}
+
+// fetchTrace times the phases of one request (DNS, connect, TLS, first byte) through
+// httptrace, so debug mode shows where a slow or failed fetch spent its time. The
+// callbacks can run on the transport's dialing goroutines, hence the mutex.
+type fetchTrace struct {
+	mu                        sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+	reused                    bool
+}
+
+func newFetchTrace() *fetchTrace {
+	return &fetchTrace{start: time.Now()}
+}
+
+// mark sets *t to the current time.
+func (ft *fetchTrace) mark(t *time.Time) {
+	ft.mu.Lock()
+	*t = time.Now()
+	ft.mu.Unlock()
+}
+
+// clientTrace returns the hooks that fill in ft.
+func (ft *fetchTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { ft.mark(&ft.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { ft.mark(&ft.dnsDone) },
+		ConnectStart: func(string, string) {
+			ft.mu.Lock()
+			// Dual-stack dialing may start several connects; time from the first.
+			if ft.connectStart.IsZero() {
+				ft.connectStart = time.Now()
+			}
+			ft.mu.Unlock()
+		},
+		ConnectDone:          func(string, string, error) { ft.mark(&ft.connectDone) },
+		TLSHandshakeStart:    func() { ft.mark(&ft.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { ft.mark(&ft.tlsDone) },
+		GotFirstResponseByte: func() { ft.mark(&ft.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			ft.mu.Lock()
+			ft.reused = info.Reused
+			ft.mu.Unlock()
+		},
+	}
+}
+
+// String lists the phase durations that were reached, e.g.
+// "dns=2ms connect=15ms tls=40ms first_byte=120ms total=121ms". first_byte and
+// total are measured from the start of the request; a phase that never completed
+// (the connect of a refused connection) is left out.
+func (ft *fetchTrace) String() string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	var parts []string
+	phase := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			parts = append(parts, name+"="+to.Sub(from).Round(time.Microsecond).String())
+		}
+	}
+	if ft.reused {
+		parts = append(parts, "reused")
+	}
+	phase("dns", ft.dnsStart, ft.dnsDone)
+	phase("connect", ft.connectStart, ft.connectDone)
+	phase("tls", ft.tlsStart, ft.tlsDone)
+	phase("first_byte", ft.start, ft.firstByte)
+	phase("total", ft.start, time.Now())
+	return strings.Join(parts, " ")
+}
+
+// newAPIRequest builds an authenticated GET request against the LiteLLM proxy: a
+// Bearer token by default, or HTTP Basic with the key as the password when
+// LITELLM_AUTH_TYPE=basic (for gateways in front of the proxy).
+// Accept-Encoding is set explicitly (which turns off net/http's transparent gzip
+// handling), so responses must be read with readBody.
+func newAPIRequest(endpoint, apiKey string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if getAuthType() == "basic" {
+		req.SetBasicAuth(os.Getenv("LITELLM_AUTH_USER"), apiKey)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	req.Header.Set("X-Request-ID", newRequestID())
+	req.Header.Set("User-Agent", getUserAgent())
+	return req, nil
+}
+
+// newRequestID generates the X-Request-ID sent with each API request, so a failing
+// call can be matched against the proxy's logs (see the debug output of fetchKeyInfo).
+// Tests replace it for deterministic IDs.
+var newRequestID = func() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // UUID version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// readBody reads the response body, decompressing it according to Content-Encoding.
+// Gateways in front of the proxy may gzip or deflate responses; "deflate" is accepted
+// both zlib-wrapped (per the RFC) and raw, since servers disagree on which to send.
+// Bodies over MaxBodyBytes, before or after decompression, fail with ErrBadResponse.
+func readBody(resp *http.Response) ([]byte, error) {
+	raw, err := readLimited(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var r io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return raw, nil
+	case "gzip", "x-gzip":
+		if r, err = gzip.NewReader(bytes.NewReader(raw)); err != nil {
+			return nil, fmt.Errorf("gzip decode: %w", err)
+		}
+	case "deflate":
+		if r, err = zlib.NewReader(bytes.NewReader(raw)); err != nil {
+			r = flate.NewReader(bytes.NewReader(raw))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	defer func() { _ = r.Close() }()
+	body, err := readLimited(r)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s body: %w", resp.Header.Get("Content-Encoding"), err)
+	}
+	return body, nil
+}
+
+// readLimited reads r to the end, giving up with ErrBadResponse once it passes
+// MaxBodyBytes.
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxBodyBytes {
+		return nil, fmt.Errorf("%w: body larger than %d bytes", ErrBadResponse, MaxBodyBytes)
+	}
+	return data, nil
+}
+
+// apiURL joins an API path and query onto the proxy base URL. Parsing the base keeps
+// bracketed IPv6 hosts, ports, and path prefixes (e.g. a proxy mounted at /litellm)
+// intact; query parameters already on the base are kept.
+func apiURL(baseURL, path string, query url.Values) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid proxy URL %q: %w", baseURL, err)
+	}
+	u = u.JoinPath(path)
+	if len(query) > 0 {
+		q := u.Query()
+		for k, v := range query {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+// bodySnippet returns the first 100 bytes of a response body for logging, on one line,
+// with the API key and anything that looks like a LiteLLM key ("sk-…") redacted.
+func bodySnippet(body []byte, apiKey string) string {
+	snippet := string(body)
+	if apiKey != "" {
+		snippet = strings.ReplaceAll(snippet, apiKey, "[REDACTED]")
+	}
+	snippet = secretKeyPattern.ReplaceAllString(snippet, "sk-[REDACTED]")
+	if len(snippet) > 100 {
+		snippet = strings.ToValidUTF8(snippet[:100], "")
+	}
+	return strings.Join(strings.Fields(snippet), " ")
+}
+
+// secretKeyPattern matches LiteLLM virtual keys and similar "sk-" API keys.
+var secretKeyPattern = regexp.MustCompile(`sk-[A-Za-z0-9_\-]+`)
+
+// retrySleep waits between fetch attempts; swapped out in tests.
+var retrySleep = time.Sleep
+
+// fetchKeyInfo calls /key/info on the configured proxy (see fetchKeyInfoFrom).
+func fetchKeyInfo(apiKey string) (*KeyInfo, error) {
+	return fetchKeyInfoFrom(getBaseURL(), apiKey)
+}
+
+// fetchKeyInfoFrom calls /key/info on the proxy at baseURL, retrying transient proxy
+// errors (see APIError) and dropped connections (see isConnReset) up to getRetries
+// times.
+func fetchKeyInfoFrom(baseURL, apiKey string) (*KeyInfo, error) {
+	info, err := fetchKeyInfoOnce(baseURL, apiKey)
+	retries := getRetries()
+	for attempt := 1; attempt <= retries; attempt++ {
+		var apiErr *APIError
+		switch {
+		case errors.As(err, &apiErr) && apiErr.Transient():
+			debugf("transient proxy error %q, retrying (%d/%d)", apiErr.Message, attempt, retries)
+			retrySleep(RetryDelay)
+		case isConnReset(err):
+			// The idle pool may hold more connections the proxy (or a middlebox) has
+			// dropped; close them so the retry dials a fresh one instead of failing again.
+			debugf("connection dropped (%v), retrying on a fresh connection (%d/%d)", err, attempt, retries)
+			newAPIClient().CloseIdleConnections()
+		default:
+			return info, err
+		}
+		info, err = fetchKeyInfoOnce(baseURL, apiKey)
+	}
+	return info, err
+}
+
+// isConnReset reports whether err is an established connection being cut off (reset
+// by the peer, broken pipe, or closed mid-response), as opposed to a proxy that can't
+// be reached at all. Those usually work on a new connection. The message check covers
+// Windows, whose WSAECONNRESET doesn't match syscall.ECONNRESET.
+func isConnReset(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset") || strings.Contains(msg, "forcibly closed")
+}
+
+// fetchKeyInfoOnce makes the actual API call
+func fetchKeyInfoOnce(baseURL, apiKey string) (*KeyInfo, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("no LiteLLM proxy URL configured (set LITELLM_PROXY_URL or ANTHROPIC_BASE_URL)")
+	}
+	var query url.Values
+	if queryKey := getQueryKey(); queryKey != "" {
+		query = url.Values{"key": {queryKey}}
+	}
+	endpoint, err := apiURL(baseURL, "/key/info", query)
+	if err != nil {
+		return nil, err
+	}
+	// url is what logs and errors show; it leaves out the queried key.
+	url, _ := apiURL(baseURL, "/key/info", nil)
+
+	client := newAPIClient()
+	req, err := newAPIRequest(endpoint, apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("request creation failed: %w", err)
+	}
+
+	requestID := req.Header.Get("X-Request-ID")
+	var trace *fetchTrace
+	if isDebugEnabled() {
+		trace = newFetchTrace()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+	}
+	resp, err := client.Do(req)
+	if trace != nil {
+		debugf("GET %s request_id=%s timing: %s", url, requestID, trace)
+	}
+	if err != nil {
+		debugf("GET %s request_id=%s failed: %v", url, requestID, err)
+		return nil, fmt.Errorf("connection error: %w [url=%s]", err, url)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	debugf("GET %s request_id=%s status=%d", url, requestID, resp.StatusCode)
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case 401:
+		return nil, fmt.Errorf("status=%d url=%s body=%s: %w", resp.StatusCode, url, string(body), ErrAuth)
+	case 403:
+		return nil, fmt.Errorf("status=%d url=%s body=%s: %w", resp.StatusCode, url, string(body), ErrForbidden)
+	}
+
+	if resp.StatusCode != 200 {
+		var litellmErr liteLLMError
+		if json.Unmarshal(body, &litellmErr) == nil && litellmErr.Error.Type == "budget_exceeded" {
+			bErr := &BudgetExceededError{}
+			_, _ = fmt.Sscanf(litellmErr.Error.Message, "Budget has been exceeded! Current cost: %f, Max budget: %f", &bErr.Spend, &bErr.MaxBudget)
+			return nil, bErr
+		}
+		httpErr := fmt.Errorf("HTTP error: status=%d url=%s body=%s", resp.StatusCode, url, string(body))
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), nowFunc()); ok {
+				return nil, &RetryAfterError{Err: httpErr, After: after}
+			}
+		}
+		return nil, httpErr
+	}
+
+	var response KeyInfoResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		// Typically an HTML page served with 200 (login wall, misrouted request).
+		// Retrying won't help, so it surfaces as its own error.
+		debugf("GET %s request_id=%s returned unparseable JSON: %v [body=%s]", url, requestID, err, bodySnippet(body, apiKey))
+		return nil, fmt.Errorf("%w: JSON parse error: %v", ErrBadResponse, err)
+	}
+	// An error envelope with a 200 would otherwise parse as an empty KeyInfo ($0.00).
+	var litellmErr liteLLMError
+	if json.Unmarshal(body, &litellmErr) == nil && (litellmErr.Error.Message != "" || litellmErr.Error.Type != "") {
+		debugf("GET %s request_id=%s returned an error object: %s", url, requestID, bodySnippet(body, apiKey))
+		return nil, &litellmErr.Error
+	}
+
+	return &response.Info, nil
+}
+
+// fetchTeamInfo calls /team/info to get team-level budget data.
+// Returns nil, error on failure — callers treat this as best-effort.
+func fetchTeamInfo(baseURL, apiKey, teamID string) (*TeamInfoAPIResponse, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("no LiteLLM proxy URL configured")
+	}
+	endpoint, err := apiURL(baseURL, "/team/info", url.Values{"team_id": {teamID}})
+	if err != nil {
+		return nil, err
+	}
+
+	client := newAPIClient()
+	req, err := newAPIRequest(endpoint, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("team info HTTP error: status=%d", resp.StatusCode)
+	}
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var response TeamInfoAPIResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// fetchUserInfo calls /user/info and maps the user's own budget onto the team budget
+// fields, so the rest of the pipeline displays it like any other budget.
+func fetchUserInfo(baseURL, apiKey string) (*KeyInfo, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("no LiteLLM proxy URL configured")
+	}
+	endpoint, err := apiURL(baseURL, "/user/info", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newAPIClient()
+	req, err := newAPIRequest(endpoint, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user info HTTP error: status=%d", resp.StatusCode)
+	}
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var response UserInfoAPIResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("%w: JSON parse error: %v", ErrBadResponse, err)
+	}
+	ui := response.UserInfo
+	info := &KeyInfo{
+		TeamSpend:          ui.Spend,
+		TeamMaxBudget:      ui.MaxBudget,
+		TeamBudgetDuration: ui.BudgetDuration,
+		TeamBudgetResetAt:  ui.BudgetResetAt,
+	}
+	if response.UserID != "" {
+		info.UserID = &response.UserID
+	}
+	return info, nil
+}
+
+// parseISOTimeHook, when set (tests only), is called on every parseISOTime call.
+var parseISOTimeHook func(s string)
+
+// resetTimeMemo remembers parsed reset times by their raw string. One render reads
+// the same reset strings several times (countdown, safe rate, logfmt) for both the
+// primary and the secondary window, and they only change when a budget resets, so
+// each is parsed once per distinct value.
+var resetTimeMemo struct {
+	sync.Mutex
+	parsed map[string]parsedResetTime
+}
+
+// parsedResetTime is one resetTimeMemo entry.
+type parsedResetTime struct {
+	t   time.Time
+	err error
+}
+
+// parseResetTime is parseISOTime memoized on the raw string (see resetTimeMemo).
+func parseResetTime(raw string) (time.Time, error) {
+	resetTimeMemo.Lock()
+	defer resetTimeMemo.Unlock()
+	p, ok := resetTimeMemo.parsed[raw]
+	if !ok {
+		if resetTimeMemo.parsed == nil || len(resetTimeMemo.parsed) >= MaxResetTimeMemo {
+			resetTimeMemo.parsed = make(map[string]parsedResetTime, MaxResetTimeMemo)
+		}
+		p.t, p.err = parseISOTime(raw)
+		resetTimeMemo.parsed[raw] = p
+	}
+	return p.t, p.err
+}
+
+// parseISOTime parses an ISO 8601 datetime string with timezone support
+func parseISOTime(s string) (time.Time, error) {
+	if parseISOTimeHook != nil {
+		parseISOTimeHook(s)
+	}
+	// Try common formats with timezone support
+	formats := []string{
+		time.RFC3339, // "2006-01-02T15:04:05Z07:00"
+		"2006-01-02T15:04:05.999999Z07:00",
+		"2006-01-02T15:04:05.999999",
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05.999999",
+		"2006-01-02 15:04:05",
+		time.RFC1123Z, // "Mon, 02 Jan 2006 15:04:05 -0700"
+		time.RFC1123,  // "Mon, 02 Jan 2006 15:04:05 GMT", as some proxies send
+		time.RFC822Z,
+		time.RFC822,
+	}
+
+	for _, format := range formats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unable to parse time: %s", s)
+}
+
+// normalizeDuration maps named duration aliases to their canonical day/hour form.
+func normalizeDuration(duration string) string {
+	switch strings.TrimSpace(strings.ToLower(duration)) {
+	case "monthly", "1mo":
+		return "30d"
+	case "weekly":
+		return "7d"
+	case "daily":
+		return "1d"
+	default:
+		return strings.TrimSpace(strings.ToLower(duration))
+	}
+}
+
+// calculateNextReset calculates when the budget will next reset.
+// Returns now + duration as a rolling window, matching LiteLLM's actual reset behavior.
+// Returns zero time if the duration format is unrecognized.
+func calculateNextReset(duration string) time.Time {
+	normalized := normalizeDuration(duration)
+	if d, ok := parseCustomDuration(normalized); ok {
+		return nowFunc().UTC().Add(d)
+	}
+	return time.Time{}
+}
+
+// formatDuration formats a time.Duration as a human-readable countdown of at most
+// `units` units, e.g. "2d3h" at 2. units 0 is the classic countdown: days and hours
+// ("2d3h", also "2d0h"), hours alone under a day ("5h"), then minutes ("20m"). Under
+// a minute it shows the reset label. The smallest unit shown is rounded per
+// LITELLM_RESET_ROUND (see getResetRound).
+func formatDuration(diff time.Duration, units int) string {
+	if diff <= 0 {
+		return getResetLabel()
+	}
+
+	suffixes := [...]string{"d", "h", "m"}
+	values := durationValues(diff)
+	if start := largestUnit(values); start < len(values) {
+		last := min(start+units, len(values)) - 1
+		if units == 0 {
+			// The classic countdown ends at hours unless under an hour is left.
+			last = max(start, 1)
+		}
+		step := [...]time.Duration{24 * time.Hour, time.Hour, time.Minute}[last]
+		switch getResetRound() {
+		case "up":
+			diff = (diff + step - 1).Truncate(step)
+		case "nearest":
+			diff = diff.Round(step)
+		}
+		// Rounding can carry into a larger unit: 23h59m up to hours is "1d".
+		values = durationValues(diff)
+	}
+	if units == 0 {
+		switch days, hours, minutes := values[0], values[1], values[2]; {
+		case days > 0:
+			return strconv.Itoa(days) + "d" + strconv.Itoa(hours) + "h"
+		case hours > 0:
+			return strconv.Itoa(hours) + "h"
+		case minutes > 0:
+			return strconv.Itoa(minutes) + "m"
+		}
+		return getResetLabel()
+	}
+
+	// Show `units` positions starting at the largest non-zero unit, skipping zeros
+	// inside that window so 2 days and 5 minutes reads "2d", never "2d0h".
+	start := largestUnit(values)
+	var b strings.Builder
+	for i := start; i < len(values) && i < start+units; i++ {
+		if values[i] > 0 {
+			fmt.Fprintf(&b, "%d%s", values[i], suffixes[i])
+		}
+	}
+	if b.Len() == 0 {
+		return getResetLabel()
+	}
+	return b.String()
+}
+
+// durationValues splits d into whole days, hours and minutes.
+func durationValues(d time.Duration) [3]int {
+	return [3]int{
+		int(d.Hours()) / 24,
+		int(d.Hours()) % 24,
+		int(d.Minutes()) % 60,
+	}
+}
+
+// largestUnit returns the index of the first non-zero value, or len(values) if all
+// are zero.
+func largestUnit(values [3]int) int {
+	i := 0
+	for i < len(values) && values[i] == 0 {
+		i++
+	}
+	return i
+}
+
+// getDurationLabel returns a human-readable label for the budget duration
+func getDurationLabel(duration string) string {
+	duration = strings.TrimSpace(strings.ToLower(duration))
+	switch duration {
+	case "30d", "1mo", "monthly":
+		return "monthly"
+	case "7d", "weekly":
+		return "weekly"
+	case "1d", "24h", "daily":
+		return "daily"
+	default:
+		return ""
+	}
+}
+
+// resolvedLocation caches the *time.Location for LITELLM_TIMEZONE. The binary runs on
+// every statusline refresh, so the zone is loaded at most once per process.
+var (
+	locationOnce     sync.Once
+	resolvedLocation *time.Location
+)
+
+// displayLocation returns the time zone used for absolute timestamps:
+// LITELLM_TIMEZONE when it names a valid IANA zone, else the local zone.
+func displayLocation() *time.Location {
+	locationOnce.Do(func() {
+		resolvedLocation = loadLocation(os.Getenv("LITELLM_TIMEZONE"))
+	})
+	return resolvedLocation
+}
+
+// loadLocation resolves an IANA zone name, falling back to time.Local (with a debug
+// warning) when the name is invalid.
+func loadLocation(name string) *time.Location {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		debugf("invalid LITELLM_TIMEZONE %q, using local time: %v", name, err)
+		return time.Local
+	}
+	return loc
+}
+
+// plausibleReset reports whether a countdown of diff is believable. A reset more than
+// twice the budget window away (or over MaxPlausibleReset with no known window) means
+// the local clock or the proxy's clock is off.
+func plausibleReset(diff time.Duration, budgetDuration *string) bool {
+	if budgetDuration != nil && *budgetDuration != "" {
+		if window, ok := parseCustomDuration(normalizeDuration(*budgetDuration)); ok && window > 0 {
+			return diff <= 2*window
+		}
+	}
+	return diff <= MaxPlausibleReset
+}
+
+// derefFloat returns *f, or 0 for nil.
+func derefFloat(f *float64) float64 {
+	if f == nil {
+		return 0
+	}
+	return *f
+}
+
+// derefString returns *s, or "" for nil.
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// formatTimeUntilReset formats the time remaining until budget reset.
+// Returns (timeString, durationLabel). timeString is "unknown" if the duration
+// format is present but unrecognized, and "?" if the reset is implausibly far away
+// (clock skew).
+func formatTimeUntilReset(resetAt *string, budgetDuration *string) (string, string) {
+	now := nowFunc().UTC()
+	var durationLabel string
+
+	if budgetDuration != nil && *budgetDuration != "" {
+		durationLabel = getDurationLabel(*budgetDuration)
+	}
+
+	// First try to use budget_reset_at if provided
+	if resetAt != nil && *resetAt != "" {
+		t, err := parseResetTime(*resetAt)
+		if err == nil {
+			diff := t.Sub(now)
+			if !plausibleReset(diff, budgetDuration) {
+				debugf("possible clock skew: reset %s is %s away (budget_duration=%q, local time %s)",
+					*resetAt, diff.Round(time.Minute), derefString(budgetDuration), now.Format(time.RFC3339))
+				return "?", durationLabel
+			}
+			return formatResetTime(t, now), durationLabel
+		}
+	}
+
+	// Fall back to calculating from budget_duration
+	if budgetDuration != nil && *budgetDuration != "" {
+		nextReset := calculateNextReset(*budgetDuration)
+		if !nextReset.IsZero() {
+			return formatResetTime(nextReset, now), durationLabel
+		}
+		// Duration is set but format is unrecognized — tell the user
+		return "unknown", durationLabel
+	}
+
+	return "", ""
+}
+
+// formatResetTime renders the reset moment per LITELLM_RESET_FORMAT: the relative
+// countdown ("3d"), the absolute time in the display timezone ("Jan 15 10:00"),
+// both ("3d (Jan 15 10:00)"), or the day in words ("tomorrow", see humanResetDay).
+// A reset that is due shows the reset label ("resetting") in every mode, or
+// "overdue by 20m" once the proxy is past ProxyResetGrace.
+func formatResetTime(reset, now time.Time) string {
+	diff := reset.Sub(now)
+	if overdue := -diff; overdue > ProxyResetGrace {
+		return "overdue by " + formatDuration(overdue, getResetUnits())
+	}
+	if diff < time.Minute {
+		return getResetLabel()
+	}
+	relative := formatDuration(diff, getResetUnits())
+	absolute := formatMonthDay(reset.In(displayLocation()), "Jan 2 15:04")
+	switch getResetFormat() {
+	case "absolute":
+		return absolute
+	case "both":
+		return relative + " (" + absolute + ")"
+	case "human":
+		return humanResetDay(reset, now)
+	}
+	return relative
+}
+
+// humanResetDay names the calendar day of reset as seen from now in the display
+// timezone: "today", "tomorrow", the weekday within the coming week ("Monday"),
+// or the date further out ("Jan 15").
+func humanResetDay(reset, now time.Time) string {
+	loc := displayLocation()
+	r, n := reset.In(loc), now.In(loc)
+	// Compare dates at UTC midnight so a DST change can't skew the day count.
+	days := int(time.Date(r.Year(), r.Month(), r.Day(), 0, 0, 0, 0, time.UTC).
+		Sub(time.Date(n.Year(), n.Month(), n.Day(), 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	switch {
+	case days <= 0:
+		return "today"
+	case days == 1:
+		return "tomorrow"
+	case days < 7:
+		return r.Weekday().String()
+	}
+	return formatMonthDay(r, "Jan 2")
+}
+
+// localeMonths holds abbreviated month names for the LITELLM_LOCALE languages with
+// a translation, keyed by base language. Other languages keep the English names.
+var localeMonths = map[string][12]string{
+	"de": {"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+	"es": {"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+	"fr": {"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+	"it": {"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+	"nl": {"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+	"pt": {"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+}
+
+// formatMonthDay formats t with a layout starting with "Jan", swapping in the
+// LITELLM_LOCALE month name when localeMonths has one ("Mär 2 15:04").
+func formatMonthDay(t time.Time, layout string) string {
+	s := t.Format(layout)
+	tag, ok := localeTag()
+	if !ok {
+		return s
+	}
+	base, _ := tag.Base()
+	names, ok := localeMonths[base.String()]
+	if !ok {
+		return s
+	}
+	return names[t.Month()-1] + s[len("Jan"):]
+}
+
+// formatResetSegment renders the reset countdown for the effective budget, e.g.
+// " weekly reset: 3d1h". With a secondary window it shows the nearer of the two, or
+// both with LITELLM_SHOW_ALL_RESETS (" reset: 3h (daily) / 12d (monthly)"), in color
+// (see resetColor).
+func formatResetSegment(info *KeyInfo, color string) string {
+	primaryAt, primaryDur := info.BudgetResetAt, info.BudgetDuration
+	if derefString(info.SecondaryBudgetResetAt) != "" || derefString(info.SecondaryBudgetDuration) != "" {
+		if isShowAllResetsEnabled() {
+			var parts []string
+			for _, w := range [][2]*string{{primaryAt, primaryDur}, {info.SecondaryBudgetResetAt, info.SecondaryBudgetDuration}} {
+				resetTime, label := formatTimeUntilReset(w[0], w[1])
+				if resetTime == "" {
+					continue
+				}
+				if label != "" {
+					resetTime += " (" + label + ")"
+				}
+				parts = append(parts, resetTime)
+			}
+			if len(parts) == 0 {
+				return ""
+			}
+			return resetLead() + color + withIcon(getIcons().Clock, "reset: "+strings.Join(parts, " / ")) + ColorReset
+		}
+		primary, primaryOK := resetDeadline(primaryAt, primaryDur)
+		secondary, secondaryOK := resetDeadline(info.SecondaryBudgetResetAt, info.SecondaryBudgetDuration)
+		if secondaryOK && (!primaryOK || secondary.Before(primary)) {
+			primaryAt, primaryDur = info.SecondaryBudgetResetAt, info.SecondaryBudgetDuration
+		}
+	}
+
+	resetTime, durationLabel := formatTimeUntilReset(primaryAt, primaryDur)
+	switch {
+	case resetTime == "":
+		return ""
+	case durationLabel != "":
+		return resetLead() + color + withIcon(getIcons().Clock, durationLabel+" reset: "+resetTime) + ColorReset
+	default:
+		return resetLead() + color + withIcon(getIcons().Clock, "reset: "+resetTime) + ColorReset
+	}
+}
+
+// resetLead is the text before the reset segment: a plain space by default, so the
+// line keeps reading "25% weekly reset: 3h", or the separator once LITELLM_SEPARATOR
+// is set.
+func resetLead() string {
+	if os.Getenv("LITELLM_SEPARATOR") == "" {
+		return " "
+	}
+	return separator(ColorGray)
+}
+
+// resetColor returns the color for the reset segment. It is gray unless
+// LITELLM_RESET_WARN_HOURS is set and usage is in the warn band or beyond while the
+// nearest reset is further away than that, i.e. a long wait is ahead: then yellow, or
+// red in the critical band (which includes an exhausted budget). info should already
+// be resolved.
+func resetColor(info *KeyInfo, percent float64, now time.Time) string {
+	hours, ok := getResetWarnHours()
+	if !ok || percent < BudgetWarnPercent {
+		return ColorGray
+	}
+	deadline, ok := resetDeadline(info.BudgetResetAt, info.BudgetDuration)
+	if secondary, secondaryOK := resetDeadline(info.SecondaryBudgetResetAt, info.SecondaryBudgetDuration); secondaryOK && (!ok || secondary.Before(deadline)) {
+		deadline, ok = secondary, true
+	}
+	if !ok || deadline.Sub(now) <= time.Duration(hours*float64(time.Hour)) {
+		return ColorGray
+	}
+	if percent >= BudgetCritPercent {
+		return ColorRed
+	}
+	return ColorYellow
+}
+
+// resetDeadline returns when the budget next resets, preferring budget_reset_at and
+// falling back to a rolling budget_duration window. ok is false when neither is usable.
+func resetDeadline(resetAt *string, budgetDuration *string) (time.Time, bool) {
+	if resetAt != nil && *resetAt != "" {
+		if t, err := parseResetTime(*resetAt); err == nil {
+			return t, true
+		}
+	}
+	if budgetDuration != nil && *budgetDuration != "" {
+		if next := calculateNextReset(*budgetDuration); !next.IsZero() {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// proxyDataLooksStale flags budget data the proxy itself may be serving from a stale
+// cache: budget_reset_at passed more than ProxyResetGrace ago, yet spend hasn't dropped
+// to near zero (at most a cent or 1% of the budget). info should already be resolved.
+// A constant spend across fetches is deliberately not used — idle keys do that.
+func proxyDataLooksStale(info *KeyInfo, now time.Time) bool {
+	if info.BudgetResetAt == nil || *info.BudgetResetAt == "" || info.MaxBudget == nil {
+		return false
+	}
+	reset, err := parseResetTime(*info.BudgetResetAt)
+	if err != nil || now.Sub(reset) <= ProxyResetGrace {
+		return false
+	}
+	return derefFloat(info.Spend) > max(0.01, *info.MaxBudget*0.01)
+}
+
+// safeRatePerHour returns the spend rate (dollars/hour) that would use exactly the
+// remaining budget by the next reset: (max_budget - spend) / hours_until_reset.
+// info should already be resolved (see resolveEffectiveBudget). ok is false when the
+// budget or reset time is unknown, or the reset is not in the future. An exhausted
+// budget yields 0.
+func safeRatePerHour(info *KeyInfo, now time.Time) (float64, bool) {
+	if info.MaxBudget == nil || *info.MaxBudget <= 0 {
+		return 0, false
+	}
+	deadline, ok := resetDeadline(info.BudgetResetAt, info.BudgetDuration)
+	if !ok {
+		return 0, false
+	}
+	hours := deadline.Sub(now).Hours()
+	if hours <= 0 {
+		return 0, false
+	}
+	spend := 0.0
+	if info.Spend != nil {
+		spend = *info.Spend
+	}
+	remaining := *info.MaxBudget - spend
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining / hours, true
+}
+
+// sparkBlocks are the eight block heights used by sparkline, lowest first.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline renders samples as a row of block characters, normalizing the range
+// min..max onto the eight heights (a flat series renders at the lowest height).
+// Returns "" for fewer than two samples, where there's no trend to show.
+func sparkline(samples []float64) string {
+	if len(samples) < 2 {
+		return ""
+	}
+	lo, hi := samples[0], samples[0]
+	for _, v := range samples {
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	var b strings.Builder
+	for _, v := range samples {
+		idx := 0
+		if hi > lo {
+			idx = int(math.Round((v - lo) / (hi - lo) * float64(len(sparkBlocks)-1)))
+		}
+		b.WriteRune(sparkBlocks[idx])
+	}
+	return b.String()
+}
+
+// separator renders the segment separator (LITELLM_SEPARATOR, default " | ") in
+// color. Surrounding whitespace stays outside the color codes and every mark is
+// closed with ColorReset, so segments can't bleed color into one another.
+func separator(color string) string {
+	sep := getSeparator()
+	mark := strings.TrimSpace(sep)
+	if mark == "" {
+		return sep
+	}
+	lead := sep[:strings.Index(sep, mark)]
+	trail := sep[len(lead)+len(mark):]
+	return lead + color + mark + ColorReset + trail
+}
+
+// formatSparklineSegment renders the " | ▁▂▃▅▇" spend trend from the last
+// getSparklineSamples() history samples, or "" when disabled or too few samples exist.
+func formatSparklineSegment() string {
+	if !isShowSparklineEnabled() {
+		return ""
+	}
+	history := readSpendHistory()
+	if n := getSparklineSamples(); len(history) > n {
+		history = history[len(history)-n:]
+	}
+	values := make([]float64, len(history))
+	for i, sample := range history {
+		values[i] = sample.Spend
+	}
+	spark := sparkline(values)
+	if spark == "" {
+		return ""
+	}
+	return separator(ColorGray) + spark
+}
+
+// formatModelsSegment renders the key's allowed models per LITELLM_SHOW_MODELS: a
+// count (" | 5 models") by default, or with "list" the names joined and cut to
+// getModelsMaxLen (" | gpt-4,sonnet"). An empty list means no restriction and shows
+// " | all models".
+func formatModelsSegment(info *KeyInfo) string {
+	mode := getShowModels()
+	if mode == "" {
+		return ""
+	}
+	var text string
+	switch {
+	case len(info.Models) == 0:
+		text = "all models"
+	case mode == "list":
+		text = truncateRunes(strings.Join(info.Models, ","), getModelsMaxLen())
+	case len(info.Models) == 1:
+		text = "1 model"
+	default:
+		text = strconv.Itoa(len(info.Models)) + " models"
+	}
+	return separator(ColorGray) + ColorGray + text + ColorReset
+}
+
+// metadataLabel returns the key metadata field named by LITELLM_SHOW_METADATA_KEY as
+// text. Strings, numbers and booleans are shown; a missing, null, empty or nested
+// value yields ok=false.
+func metadataLabel(info *KeyInfo) (string, bool) {
+	name := getMetadataKey()
+	if name == "" {
+		return "", false
+	}
+	var text string
+	switch v := info.Metadata[name].(type) {
+	case string:
+		text = strings.TrimSpace(v)
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		text = strconv.FormatBool(v)
+	}
+	return text, text != ""
+}
+
+// formatMetadataSegment renders the metadata label as "[marketing] ", placed right
+// after the prefix so keys from different cost centers are told apart at a glance.
+func formatMetadataSegment(info *KeyInfo) string {
+	label, ok := metadataLabel(info)
+	if !ok {
+		return ""
+	}
+	return ColorGray + "[" + label + "]" + ColorReset + " "
+}
+
+// truncateRunes shortens s to at most max runes, ending in "…" when cut.
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// formatRPMSegment renders " | 120/500 rpm", colored by how close usage is to the
+// limit (same thresholds as the budget), or " | 500 rpm" in gray when only the limit
+// is known. It is "" when disabled or the key has no rpm_limit.
+func formatRPMSegment(info *KeyInfo) string {
+	if !isShowRPMEnabled() || info.RPMLimit == nil || *info.RPMLimit <= 0 {
+		return ""
+	}
+	limit := strconv.FormatInt(*info.RPMLimit, 10)
+	if info.RPMUsage == nil {
+		return separator(ColorGray) + ColorGray + limit + " rpm" + ColorReset
+	}
+	color := budgetColor(float64(*info.RPMUsage) / float64(*info.RPMLimit) * 100)
+	return separator(ColorGray) + color + strconv.FormatInt(*info.RPMUsage, 10) + "/" + limit + " rpm" + ColorReset
+}
+
+// formatAgeSegment renders " | 2m ago", the age of the cached budget data (the last
+// successful fetch, of the org report in org scope), gray normally and yellow once
+// older than its TTL. It is "" when disabled or nothing is cached.
+func formatAgeSegment() string {
+	if !isShowAgeEnabled() {
+		return ""
+	}
+	entry, ttl, ok := readScopeCacheEntry()
+	if !ok {
+		return ""
+	}
+	age := nowFunc().UnixMilli() - entry.Timestamp
+	color := ColorGray
+	if ttl > 0 && age > ttl {
+		color = ColorYellow
+	}
+	return separator(ColorGray) + color + formatAge(time.Duration(age)*time.Millisecond) + ColorReset
+}
+
+// formatAge renders how long ago something happened: "just now" under a minute,
+// then whole minutes, hours, or days ("2m ago", "3h ago", "2d ago").
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age/time.Minute))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age/time.Hour))
+	}
+	return fmt.Sprintf("%dd ago", int(age/(24*time.Hour)))
+}
+
+// formatTokensSegment renders " | 1.2M tok" from the key's token usage, or "" when
+// disabled or the proxy doesn't report tokens.
+func formatTokensSegment(info *KeyInfo) string {
+	if !isShowTokensEnabled() || info.TotalTokens == nil {
+		return ""
+	}
+	return separator(ColorGray) + formatCompact(float64(*info.TotalTokens)) + " tok"
+}
+
+// formatCompact renders n with a k/M/B suffix and one decimal (1234567 → "1.2M"),
+// dropping a trailing ".0". Values under 1000 are shown as-is.
+func formatCompact(n float64) string {
+	if n < 999.5 {
+		return strconv.FormatFloat(math.Round(n), 'f', -1, 64)
+	}
+	suffix := ""
+	for _, s := range []string{"k", "M", "B"} {
+		suffix = s
+		n /= 1000
+		// Stop unless rounding would print "1000.0" of this unit.
+		if n < 999.95 {
+			break
+		}
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", n), ".0") + suffix
+}
+
+// formatTopModelSegment renders " | top: gpt-4 $12.00" from the top-model cache (see
+// startTopModelRefresh), or "" when disabled or nothing is known.
+func formatTopModelSegment() string {
+	if !isShowTopModelEnabled() {
+		return ""
+	}
+	entry, ok := readTopModelCache()
+	if !ok || entry.Model == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%stop: %s %s%s", separator(ColorGray), ColorGray, entry.Model, formatMoney(entry.Spend), ColorReset)
+}
+
+// formatMoney formats a dollar amount with two decimals. With LITELLM_MICRO_CENTS, a
+// nonzero amount below one cent keeps two significant digits instead of rounding to
+// "$0.00" (e.g. "$0.003"), and anything too small for six decimals shows as "<$0.01".
+func formatMoney(amount float64) string {
+	code, rate, ok := getConversion()
+	if !ok {
+		return formatAmount("$", amount)
+	}
+	s := formatAmount(currencySymbol(code), amount*rate)
+	if isShowOriginalEnabled() {
+		s += " (USD " + formatAmount("$", amount) + ")"
+	}
+	return s
+}
+
+// unknownMoney renders an amount the proxy didn't report, e.g. "$?", in the display
+// currency.
+func unknownMoney() string {
+	if code, _, ok := getConversion(); ok {
+		return currencySymbol(code) + "?"
+	}
+	return "$?"
+}
+
+// formatAmount renders amount with the given currency symbol: two decimals rounded
+// per LITELLM_ROUNDING, or more for sub-cent amounts when LITELLM_MICRO_CENTS is set.
+// Digit grouping and the decimal separator follow LITELLM_LOCALE (see numberPrinter).
+// Negative amounts put the sign before the symbol ("-$5.00").
+func formatAmount(symbol string, amount float64) string {
+	if amount < 0 {
+		return "-" + formatAmount(symbol, -amount)
+	}
+	p := numberPrinter()
+	if !isMicroCentsEnabled() || amount <= 0 || amount >= 0.01 {
+		rounded := roundCents(amount, getRounding())
+		if p != nil {
+			return symbol + p.Sprintf("%.2f", rounded)
+		}
+		return fmt.Sprintf("%s%.2f", symbol, rounded)
+	}
+	prec := min(1-int(math.Floor(math.Log10(amount))), 6)
+	digits := strings.TrimRight(strconv.FormatFloat(amount, 'f', prec, 64), "0")
+	if digits == "0." {
+		if p != nil {
+			return "<" + symbol + p.Sprintf("%.2f", 0.01)
+		}
+		return "<" + symbol + "0.01"
+	}
+	if p != nil {
+		// Re-render with the same number of decimals in the locale's notation.
+		return symbol + p.Sprintf("%.*f", len(digits)-strings.Index(digits, ".")-1, amount)
+	}
+	return symbol + digits
+}
+
+// numberPrinter returns a locale-aware printer for LITELLM_LOCALE (a BCP 47 tag such
+// as "de" or "fr-CH"), or nil for English and unknown locales, which keep the plain
+// formatting ("1234.50").
+func numberPrinter() *message.Printer {
+	tag, ok := localeTag()
+	if !ok {
+		return nil
+	}
+	return message.NewPrinter(tag)
+}
+
+// localeTag parses LITELLM_LOCALE. It reports false when the variable is unset,
+// invalid, or any English tag ("en", "en-US", "en-GB"), all of which mean the
+// default formatting.
+func localeTag() (language.Tag, bool) {
+	val := strings.TrimSpace(os.Getenv("LITELLM_LOCALE"))
+	if val == "" {
+		return language.Und, false
+	}
+	tag, err := language.Parse(val)
+	if err != nil {
+		debugf("ignoring LITELLM_LOCALE=%q: %v", val, err)
+		return language.Und, false
+	}
+	if base, _ := tag.Base(); base.String() == "en" {
+		return language.Und, false
+	}
+	return tag, true
+}
+
+// roundCents rounds amount to whole cents with the given mode (round|floor|ceil).
+// The cent value is first snapped to 6 decimals so float noise doesn't decide the
+// result (25.005 is stored as 25.00499999…, but rounds half-up to 25.01).
+func roundCents(amount float64, mode string) float64 {
+	cents := math.Round(amount*100*1e6) / 1e6
+	switch mode {
+	case "floor":
+		cents = math.Floor(cents)
+	case "ceil":
+		cents = math.Ceil(cents)
+	default:
+		cents = math.Round(cents)
+	}
+	return cents / 100
+}
+
+// currencySymbols maps LITELLM_CONVERT_TO codes to their symbol. Other codes are
+// shown as a prefix instead (e.g. "CHF 23.10").
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"CNY": "¥",
+	"INR": "₹",
+	"KRW": "₩",
+}
+
+// currencySymbol returns the display symbol for an ISO 4217 currency code.
+func currencySymbol(code string) string {
+	if sym, ok := currencySymbols[code]; ok {
+		return sym
+	}
+	return code + " "
+}
+
+// budgetColor returns the ANSI color code for a budget usage percentage.
+func budgetColor(percent float64) string {
+	if percent >= BudgetCritPercent {
+		return ColorRed
+	}
+	if percent >= BudgetWarnPercent {
+		return ColorYellow
+	}
+	return ColorGreen
+}
+
+// colorState names the budget state a status color stands for ("OK", "WARN",
+// "CRIT"), so it survives when the line is shown without color.
+func colorState(color string) string {
+	switch color {
+	case ColorGreen:
+		return "OK"
+	case ColorYellow:
+		return "WARN"
+	}
+	return "CRIT"
+}
+
+// circleGlyph returns a Unicode quadrant-fill glyph approximating the given
+// usage percentage as a circular gauge.
+// Buckets: empty (≤0) · quarter (<30) · half (<60) · three-quarter (<85) · full (≥85).
+func circleGlyph(percent float64) string {
+	switch {
+	case percent <= 0:
+		return "○"
+	case percent < 30:
+		return "◔"
+	case percent < 60:
+		return "◑"
+	case percent < 85:
+		return "◕"
+	default:
+		return "●"
+	}
+}
+
+// parseCustomDuration parses a duration string like "48h", "2d" into time.Duration
+func parseCustomDuration(duration string) (time.Duration, bool) {
+	if len(duration) < 2 {
+		return 0, false
+	}
+	suffix := duration[len(duration)-1]
+	valueStr := duration[:len(duration)-1]
+	var value int
+	if _, err := fmt.Sscanf(valueStr, "%d", &value); err != nil {
+		return 0, false
+	}
+	switch suffix {
+	case 'd':
+		return time.Duration(value) * 24 * time.Hour, true
+	case 'h':
+		return time.Duration(value) * time.Hour, true
+	case 'm':
+		return time.Duration(value) * time.Minute, true
+	case 's':
+		return time.Duration(value) * time.Second, true
+	}
+	return 0, false
+}
+
+// contextColor returns the ANSI color code for a context-window usage percentage.
+// Mirrors budgetColor's thresholds but kept as a separate function so the two
+// can drift independently if user feedback warrants it.
+func contextColor(percent float64) string {
+	if percent >= 85 {
+		return ColorRed
+	}
+	if percent >= 70 {
+		return ColorYellow
+	}
+	return ColorGreen
+}
+
+// formatContextSegment renders the " | 📖 ● <pct>%[ — suggestion]" segment from
+// Claude Code's stdin payload. Returns "" when the context window data is absent
+// (no field, null pointer, or pre-first-API-call).
+func formatContextSegment(input StatusInput) string {
+	if input.ContextWindow == nil || input.ContextWindow.UsedPercentage == nil {
+		return ""
+	}
+	pct := *input.ContextWindow.UsedPercentage
+	if pct < 0 {
+		pct = 0
+	} else if pct > 100 {
+		pct = 100
+	}
+	color := contextColor(pct)
+	suggestion := ""
+	switch {
+	case pct >= 85:
+		suggestion = " — run /compact or /clear"
+	case pct >= 70:
+		suggestion = " — consider /compact"
+	}
+	return fmt.Sprintf("%s📖 %s%s%s %.0f%%%s%s",
+		separator(ColorGray), color, circleGlyph(pct), ColorReset, pct, suggestion, ColorReset)
+}
+
+// formatTeamSegment renders the " | team <pct>%" segment for the team named by
+// LITELLM_TEAM_ID, with dollar amounts when LITELLM_PLUGIN_SHOW_COST is enabled.
+// Returns "" when no team totals were fetched.
+func formatTeamSegment(info *KeyInfo) string {
+	if info.TeamTotalMaxBudget == nil || *info.TeamTotalMaxBudget <= 0 {
+		return ""
+	}
+	spend := 0.0
+	if info.TeamTotalSpend != nil {
+		spend = *info.TeamTotalSpend
+	}
+	budget := *info.TeamTotalMaxBudget
+	percent := (spend / budget) * 100
+
+	var teamStr string
+	if isShowCostEnabled() {
+		teamStr = fmt.Sprintf("team %s/%s", formatMoney(spend), formatMoney(budget))
+	} else {
+		teamStr = fmt.Sprintf("team %.0f%%", percent)
+	}
+	return fmt.Sprintf("%s%s%s%s", separator(ColorGray), budgetColor(percent), teamStr, ColorReset)
+}
+
+// formatAllBudgets renders every hard limit on the key with its own color, e.g.
+// "daily 40% / team 72%", for LITELLM_SHOW_ALL_BUDGETS. The member budget is named
+// after its window ("daily", "weekly", "monthly") or "member" otherwise. Returns ""
+// unless both the member budget and the LITELLM_TEAM_ID team total are known.
+func formatAllBudgets(info *KeyInfo) string {
+	effective := resolveEffectiveBudget(info)
+	if effective.MaxBudget == nil || *effective.MaxBudget <= 0 || info.TeamTotalMaxBudget == nil || *info.TeamTotalMaxBudget <= 0 {
+		return ""
+	}
+	memberLabel := getDurationLabel(derefString(effective.BudgetDuration))
+	if memberLabel == "" {
+		memberLabel = "member"
+	}
+	budgets := []struct {
+		label string
+		c     budgetConstraint
+	}{
+		{memberLabel, budgetConstraint{Spend: derefFloat(effective.Spend), Limit: *effective.MaxBudget}},
+		{"team", budgetConstraint{Tag: "team", Spend: derefFloat(info.TeamTotalSpend), Limit: *info.TeamTotalMaxBudget}},
+	}
+	parts := make([]string, len(budgets))
+	for i, b := range budgets {
+		pct := b.c.percent()
+		parts[i] = budgetColor(pct) + b.label + " " + strconv.FormatFloat(pct, 'f', 0, 64) + "%" + ColorReset
+	}
+	return strings.Join(parts, " / ")
+}
+
+// formatStatusLine formats the budget info as a colored status circle with optional
+// dollar amounts, reset countdown, and context-window segment.
+// latestVersion is the latest GitHub release tag (empty string to skip update notice).
+func formatStatusLine(info *KeyInfo, latestVersion string, input StatusInput) string {
+	teamStr := formatTeamSegment(info)
+	allBudgetsStr := ""
+	if isShowAllBudgetsEnabled() {
+		// Every budget is listed up front, so the separate team segment would repeat it.
+		if allBudgetsStr = formatAllBudgets(info); allBudgetsStr != "" {
+			teamStr = ""
+		}
+	}
+	metadataStr := formatMetadataSegment(info)
+	// Key-level segments read fields the resolved budget below doesn't carry.
+	tokensStr, rpmStr, modelsStr := formatTokensSegment(info), formatRPMSegment(info), formatModelsSegment(info)
+	binding, hasBudget := bindingConstraint(info)
+	raw := info
+	info = resolveEffectiveBudget(info)
+	spend := derefFloat(info.Spend)
+
+	updateStr := ""
+	if isUpdateAvailable(Version, latestVersion) {
+		updateStr = fmt.Sprintf("%s%supdate: %s%s", separator(ColorYellow), ColorYellow, latestVersion, ColorReset)
+	}
+
+	contextStr := formatContextSegment(input)
+	prefix := getPrefix(input) + metadataStr
+
+	if !hasBudget {
+		// Org scope has nothing to measure the spend against without LITELLM_ORG_BUDGET,
+		// so it is shown plainly, without a color or percent.
+		if orgSpend, ok := orgSpendWithoutBudget(raw); ok {
+			resetStr := ""
+			if !isHideResetEnabled() {
+				resetStr = formatResetSegment(&KeyInfo{BudgetResetAt: raw.TeamBudgetResetAt, BudgetDuration: raw.TeamBudgetDuration}, ColorGray)
+			}
+			return prefix + ColorGray + withIcon(getIcons().Money, formatMoney(orgSpend)+" this month") + ColorReset + resetStr + updateStr + contextStr
+		}
+		// No team budget resolved — key-level spend is intentionally not shown as a fallback.
+		return formatError(getUnlimitedLabel(), input)
+	}
+	// A budget without a spend is a proxy data issue; showing $0.00 would hide it.
+	spendUnknown := info.Spend == nil && binding.Tag == ""
+	if spendUnknown {
+		debugf("proxy returned max_budget %s with a null spend, treating spend as %s", formatMoney(binding.Limit), formatMoney(0))
+	}
+
+	// Color, glyph and figures follow whichever limit is closest to running out.
+	percent := binding.percent()
+	absColor := bindingColor(binding)
+	if input.shownColor != "" {
+		absColor = input.shownColor
+	}
+	// At or past the limit new requests are rejected, so say so instead of "100%".
+	exhausted := binding.Spend >= binding.Limit
+	tagStr := ""
+	if binding.Tag != "" {
+		tagStr = " (" + binding.Tag + ")"
+	}
+
+	icons := getIcons()
+
+	// Personal alert budget: once spend passes it, never show green even if the key's
+	// own budget has plenty of headroom.
+	alertStr := ""
+	if alert, ok := getAlertBudget(); ok && spend > alert {
+		if absColor == ColorGreen {
+			absColor = ColorYellow
+		}
+		alertStr = " " + absColor + withIcon(icons.Warning, "over alert") + ColorReset
+	}
+
+	// Nothing spent yet and nothing to warn about: stay out of the way if asked to.
+	if isHideWhenZeroEnabled() && binding.Spend == 0 && alertStr == "" {
+		return ""
+	}
+	// Likewise below a spend floor, unless a small budget is already near its cap.
+	if floor, ok := getMinSpend(); ok && binding.Spend < floor && absColor == ColorGreen && alertStr == "" {
+		return ""
+	}
+
+	// The figure can count down instead (LITELLM_PERCENT_MODE=remaining); colors still
+	// follow usage, so a small remaining share is red.
+	shownPercent, percentSuffix := percent, "%"
+	if isPercentRemainingEnabled() {
+		shownPercent, percentSuffix = max(100-percent, 0), "% left"
+	}
+
+	var budgetStr string
+	switch {
+	case exhausted && isShowCostEnabled():
+		budgetStr = withIcon(icons.Money, fmt.Sprintf("%s/%s %s%s", formatMoney(binding.Spend), formatMoney(binding.Limit), exhaustedLabel(), tagStr))
+		// A budget lowered below the spend leaves a negative remainder; say by how much.
+		if over := binding.Spend - binding.Limit; over > 0 {
+			budgetStr += " (" + formatMoney(-over) + " over)"
+		}
+	case exhausted:
+		budgetStr = exhaustedLabel() + tagStr
+	case spendUnknown && isMarkNullSpendEnabled() && isShowCostEnabled():
+		budgetStr = withIcon(icons.Money, unknownMoney()+"/"+formatMoney(binding.Limit)+tagStr)
+	case spendUnknown && isMarkNullSpendEnabled():
+		budgetStr = "?%" + tagStr
+	case allBudgetsStr != "":
+		budgetStr = allBudgetsStr
+	case isShowCostEnabled() && isPercentGlyphEnabled():
+		budgetStr = withIcon(icons.Money, formatMoney(binding.Spend)+"/"+formatMoney(binding.Limit)+tagStr)
+	case isShowCostEnabled():
+		budgetStr = withIcon(icons.Money, formatMoney(binding.Spend)+"/"+formatMoney(binding.Limit)+" ("+strconv.FormatFloat(shownPercent, 'f', 0, 64)+percentSuffix+")"+tagStr)
+	case isPercentGlyphEnabled():
+		// The gauge glyph alone carries the fill level.
+		budgetStr = strings.TrimPrefix(tagStr, " ")
+	default:
+		budgetStr = strconv.FormatFloat(shownPercent, 'f', 0, 64) + percentSuffix + tagStr
+	}
+
+	// Without color the warn/crit state would be lost (monochrome terminals, screen
+	// readers), so spell it out. An exhausted budget already says so in words.
+	stateStr := ""
+	if plainOutput && !exhausted {
+		stateStr = " " + colorState(absColor)
+	}
+
+	resetStr := ""
+	if !isHideResetEnabled() {
+		resetStr = formatResetSegment(info, resetColor(info, percent, nowFunc()))
+	}
+	if isDebugEnabled() && proxyDataLooksStale(info, nowFunc()) {
+		resetStr += " " + ColorGray + "(stale?)" + ColorReset
+	}
+
+	rateStr := ""
+	if isShowSafeRateEnabled() {
+		if rate, ok := safeRatePerHour(info, nowFunc()); ok {
+			rateStr = separator(ColorGray) + ColorGray + formatMoney(rate) + "/h left" + ColorReset
+		}
+	}
+
+	// This runs on every refresh, so the line is assembled in one pre-sized buffer
+	// rather than through chained Sprintf/concatenation (see BenchmarkFormatStatusLine).
+	segments := [...]string{
+		stateStr, alertStr, resetStr, rateStr, formatSparklineSegment(), tokensStr,
+		rpmStr, modelsStr, formatTopModelSegment(), formatAgeSegment(), teamStr, updateStr, contextStr,
+	}
+	glyph := circleGlyph(percent)
+	size := len(prefix) + 2*len(absColor) + len(glyph) + 1 + len(budgetStr) + 2*len(ColorReset)
+	for _, seg := range segments {
+		size += len(seg)
+	}
+	var b strings.Builder
+	b.Grow(size)
+	b.WriteString(prefix)
+	b.WriteString(absColor)
+	b.WriteString(glyph)
+	b.WriteString(ColorReset)
+	if budgetStr != "" {
+		b.WriteByte(' ')
+		b.WriteString(absColor)
+		b.WriteString(budgetStr)
+		b.WriteString(ColorReset)
+	}
+	for _, seg := range segments {
+		b.WriteString(seg)
+	}
+	return b.String()
+}
+
+// renderStaleLine renders a cached (possibly expired) budget entirely in gray so the
+// user can tell it's the last known value rather than a fresh fetch.
+func renderStaleLine(info *KeyInfo, latestVersion string, input StatusInput) string {
+	return ColorGray + stripANSI(formatStatusLine(info, latestVersion, input)) + ColorReset
+}
+
+// iconSet holds the glyphs placed before the money figures, the reset countdown, and
+// the alert marker. An empty glyph is left out along with its trailing space.
+type iconSet struct {
+	Money   string
+	Clock   string
+	Warning string
+}
+
+// iconPresets are the LITELLM_PRESET choices. "plain" (default) matches the classic
+// look; "nerdfont" uses Nerd Font glyphs (nf-fa-dollar, nf-fa-clock_o, nf-fa-warning).
+var iconPresets = map[string]iconSet{
+	"plain":    {Warning: "⚠"},
+	"nerdfont": {Money: "\uf155", Clock: "\uf017", Warning: "\uf071"},
+}
+
+// getIcons returns the LITELLM_PRESET icon set (unknown presets fall back to plain),
+// with LITELLM_ICON_MONEY, LITELLM_ICON_CLOCK, and LITELLM_ICON_WARNING overriding
+// single glyphs. Setting one of those to "" removes that icon.
+func getIcons() iconSet {
+	icons, ok := iconPresets[os.Getenv("LITELLM_PRESET")]
+	if !ok {
+		icons = iconPresets["plain"]
+	}
+	if val, ok := os.LookupEnv("LITELLM_ICON_MONEY"); ok {
+		icons.Money = val
+	}
+	if val, ok := os.LookupEnv("LITELLM_ICON_CLOCK"); ok {
+		icons.Clock = val
+	}
+	if val, ok := os.LookupEnv("LITELLM_ICON_WARNING"); ok {
+		icons.Warning = val
+	}
+	return icons
+}
+
+// withIcon prefixes text with icon and a space, or returns text as-is without an icon.
+func withIcon(icon, text string) string {
+	if icon == "" {
+		return text
+	}
+	return icon + " " + text
+}
+
+// formatError formats an error message with red color
+func formatError(msg string, input StatusInput) string {
+	return fmt.Sprintf("%s%s%s%s", ColorRed, getPrefix(input), msg, ColorReset)
+}
+
+// StatusJSONSchemaVersion is the schema_version of the --json output. Bump it when a
+// field is removed, renamed, or changes type or meaning; adding an optional field is
+// not a breaking change and keeps the version.
+const StatusJSONSchemaVersion = 1
+
+// StatusJSON is the structured output emitted with --json, consumed by the VS Code
+// extension (and any other caller that prefers data over ANSI text). All fields are
+// optional — absent values are omitted so a minimal payload stays minimal.
 //
 // Text is the fully-rendered status line (ANSI stripped) — editors forward it
 // directly instead of re-implementing the format. Percent is kept alongside so
 // editors can apply their own background-color theming (which can't be forwarded).
+//
+// SchemaVersion is always present so consumers can detect incompatible output.
 type StatusJSON struct {
+	SchemaVersion   int     `json:"schema_version"`
 	Prefix          string  `json:"prefix,omitempty"`
 	Text            string  `json:"text"`
 	Percent         float64 `json:"percent"`
@@ -944,168 +4329,1272 @@ type StatusJSON struct {
 	UpdateAvailable string  `json:"update_available,omitempty"`
 	ContextPercent  float64 `json:"context_percent,omitempty"`
 	HasContext      bool    `json:"has_context"`
+	TeamSpend       float64 `json:"team_spend,omitempty"`
+	TeamMaxBudget   float64 `json:"team_max_budget,omitempty"`
+	OverAlert       bool    `json:"over_alert,omitempty"`
+	Binding         string  `json:"binding,omitempty"` // tag of the limit driving the color, "" for the member budget
+	Stale           bool    `json:"stale,omitempty"`
 	Error           string  `json:"error,omitempty"`
 }
 
-// stripANSI removes all ANSI escape sequences from s, leaving plain text.
-func stripANSI(s string) string {
-	for _, c := range []string{ColorRed, ColorYellow, ColorGreen, ColorGray, ColorReset} {
-		s = strings.ReplaceAll(s, c, "")
+// plainOutput strips ANSI color from text-mode output. Set once in main (see useColor).
+var plainOutput bool
+
+// useColor decides whether text output may contain ANSI color. The -color flag wins:
+// "always" and "never" force it on or off. In "auto" mode (the default), NO_COLOR (any
+// non-empty value, per no-color.org) disables it, as does a console that failed to
+// enable virtual-terminal processing (older Windows), which would print raw escape
+// codes. There's deliberately no TTY check: Claude Code reads stdout through a pipe
+// and renders the colors itself.
+func useColor(mode, noColor string, vtErr error) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return noColor == "" && vtErr == nil
+}
+
+// colorModeReplacers translate the basic 8/16-color codes the formatters emit into
+// the 256-color (\x1b[38;5;Nm) or 24-bit (\x1b[38;2;R;G;Bm) families. Formatting stays
+// in one palette; the mode is applied once, at output.
+var colorModeReplacers = map[string]*strings.Replacer{
+	"256": strings.NewReplacer(
+		ColorGreen, "\x1b[38;5;35m",
+		ColorYellow, "\x1b[38;5;220m",
+		ColorRed, "\x1b[38;5;196m",
+		ColorBrightRed, "\x1b[38;5;197m",
+		ColorGray, "\x1b[38;5;244m",
+	),
+	"truecolor": strings.NewReplacer(
+		ColorGreen, "\x1b[38;2;34;197;94m",
+		ColorYellow, "\x1b[38;2;234;179;8m",
+		ColorRed, "\x1b[38;2;239;68;68m",
+		ColorBrightRed, "\x1b[38;2;255;23;68m",
+		ColorGray, "\x1b[38;2;107;114;128m",
+	),
+}
+
+// translateColors rewrites the basic color codes in line for the given color mode
+// ("basic", "256" or "truecolor"). Basic and unknown modes leave line unchanged.
+func translateColors(line, mode string) string {
+	if r, ok := colorModeReplacers[mode]; ok {
+		return r.Replace(line)
+	}
+	return line
+}
+
+// stripANSI removes all ANSI escape sequences from s, leaving plain text.
+func stripANSI(s string) string {
+	for _, c := range []string{ColorRed, ColorBrightRed, ColorYellow, ColorGreen, ColorGray, ColorBlink, ColorReset} {
+		s = strings.ReplaceAll(s, c, "")
+	}
+	return s
+}
+
+// isConnectionError reports whether err looks like a transient network failure
+// (timeout, refused/reset connection, DNS). Replayed negative-cache errors keep their
+// original message, so they classify the same way as the live failure did.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "timeout") ||
+		strings.Contains(msg, "connection") ||
+		strings.Contains(msg, "dial")
+}
+
+// quietFallback returns the last cached budget, ignoring its age, when err is
+// transient and either quiet errors are enabled or the breaker is cooling down (a
+// replayed failure: the cached budget beats repeating an error nothing is retrying
+// yet). Auth/budget errors are never masked — those need the user's attention — and
+// ok is false when nothing has ever been cached.
+func quietFallback(err error) (*KeyInfo, bool) {
+	var replay *cachedError
+	cooldown := errors.As(err, &replay) && replay.sentinel == nil
+	if !cooldown && (!isQuietErrorsEnabled() || !isConnectionError(err)) {
+		return nil, false
+	}
+	entry, _, ok := readScopeCacheEntry()
+	if !ok {
+		return nil, false
+	}
+	return &entry.Info, true
+}
+
+// renderLine produces the fully-rendered status line (with ANSI color) for the
+// current state. Both the stdout path (main) and the --json Text field use this,
+// so the two output modes can never drift. buildStatusJSON strips the ANSI for JSON.
+func renderLine(info *KeyInfo, latestVersion string, input StatusInput, err error) string {
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrBudgetExceeded):
+			var bErr *BudgetExceededError
+			if errors.As(err, &bErr) && bErr.MaxBudget > 0 {
+				pct := (bErr.Spend / bErr.MaxBudget) * 100
+				return fmt.Sprintf("%s%s%s/%s (%.0f%%)%s%sBudget exceeded%s",
+					ColorRed, getPrefix(input), formatMoney(bErr.Spend), formatMoney(bErr.MaxBudget), pct, separator(ColorRed), ColorRed, ColorReset)
+			}
+			return formatError("Budget exceeded", input)
+		case errors.Is(err, ErrAuth):
+			return formatError("Auth error", input)
+		case errors.Is(err, ErrForbidden):
+			return formatError("No permission", input)
+		case isConnectionError(err):
+			return formatError("Connection error", input)
+		default:
+			if errors.Is(err, ErrNoAPIKey) {
+				return formatError("No API key", input)
+			}
+			if errors.Is(err, ErrNoCachedData) {
+				return formatError(getNoDataLabel(), input)
+			}
+			if errors.Is(err, ErrBadResponse) {
+				return formatError("Unexpected response", input)
+			}
+			if errors.Is(err, ErrConfig) {
+				return formatError("Config error", input)
+			}
+			if errors.Is(err, ErrInvalidColor) {
+				// Name the variable and value so the typo can be found.
+				return formatError(err.Error(), input)
+			}
+			if errors.Is(err, ErrInternal) {
+				return formatError("internal error", input)
+			}
+			return formatError("Error", input)
+		}
+	}
+	if info == nil {
+		return formatError("Error", input)
+	}
+	return formatStatusLine(info, latestVersion, input)
+}
+
+// buildStatusJSON gathers the same data as the ANSI path but returns a structured
+// StatusJSON. info may be nil (fetch failed); err carries the reason. The caller
+// decides whether to render the ANSI line or emit this struct.
+func buildStatusJSON(info *KeyInfo, latestVersion string, input StatusInput, err error) StatusJSON {
+	out := StatusJSON{SchemaVersion: StatusJSONSchemaVersion, Prefix: strings.TrimSpace(getPrefix(input))}
+	out.Text = stripANSI(renderLine(info, latestVersion, input, err))
+
+	if input.ContextWindow != nil && input.ContextWindow.UsedPercentage != nil {
+		pct := *input.ContextWindow.UsedPercentage
+		if pct < 0 {
+			pct = 0
+		} else if pct > 100 {
+			pct = 100
+		}
+		out.HasContext = true
+		out.ContextPercent = pct
+	}
+
+	if isUpdateAvailable(Version, latestVersion) {
+		out.UpdateAvailable = latestVersion
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrBudgetExceeded):
+			var bErr *BudgetExceededError
+			if errors.As(err, &bErr) && bErr.MaxBudget > 0 {
+				out.HasBudget = true
+				out.Spend = bErr.Spend
+				out.MaxBudget = bErr.MaxBudget
+				out.Percent = (bErr.Spend / bErr.MaxBudget) * 100
+			}
+			out.Error = "budget exceeded"
+		case errors.Is(err, ErrAuth):
+			out.Error = "auth error"
+		case errors.Is(err, ErrForbidden):
+			out.Error = "no permission"
+		case errors.Is(err, ErrNoAPIKey):
+			out.Error = "no api key"
+		case errors.Is(err, ErrNoCachedData):
+			out.Error = "no cached data"
+		case errors.Is(err, ErrBadResponse):
+			out.Error = "unexpected response"
+		case errors.Is(err, ErrConfig):
+			out.Error = "config error"
+		case errors.Is(err, ErrInvalidColor):
+			out.Error = "invalid color"
+		case errors.Is(err, ErrInternal):
+			out.Error = "internal error"
+		case isConnectionError(err):
+			out.Error = "connection error"
+		default:
+			out.Error = "error"
+		}
+		return out
+	}
+
+	if info == nil {
+		out.Error = "error"
+		return out
+	}
+
+	if info.TeamTotalMaxBudget != nil && *info.TeamTotalMaxBudget > 0 {
+		out.TeamMaxBudget = *info.TeamTotalMaxBudget
+		if info.TeamTotalSpend != nil {
+			out.TeamSpend = *info.TeamTotalSpend
+		}
+	}
+
+	binding, _ := bindingConstraint(info)
+	out.Binding = binding.Tag
+	if spend, ok := orgSpendWithoutBudget(info); ok {
+		out.Spend = spend
+		return out
+	}
+
+	info = resolveEffectiveBudget(info)
+	if info.MaxBudget == nil || *info.MaxBudget <= 0 {
+		out.Error = "no budget configured"
+		return out
+	}
+
+	out.HasBudget = true
+	out.MaxBudget = *info.MaxBudget
+	if info.Spend != nil {
+		out.Spend = *info.Spend
+	}
+	// Same figure as the text's color and percent, so editors theme from the
+	// binding limit too.
+	out.Percent = binding.percent()
+	if alert, ok := getAlertBudget(); ok && out.Spend > alert {
+		out.OverAlert = true
+	}
+
+	resetTime, durationLabel := formatTimeUntilReset(info.BudgetResetAt, info.BudgetDuration)
+	out.ResetTime = resetTime
+	out.ResetLabel = durationLabel
+
+	return out
+}
+
+// colorName returns a human-readable name for one of the status ANSI colors.
+func colorName(color string) string {
+	switch color {
+	case ColorGreen:
+		return "green"
+	case ColorYellow:
+		return "yellow"
+	case ColorRed:
+		return "red"
+	case ColorBrightRed:
+		return "bright red"
+	case ColorGray:
+		return "gray"
+	}
+	return "default"
+}
+
+// writeExplanation writes, one reason per line, why the status got its color: the
+// binding limit, its percent against the warn/crit thresholds, and any alert budget
+// override. It mirrors formatStatusLine's decisions and is printed by -explain.
+func writeExplanation(w io.Writer, info *KeyInfo, err error) {
+	explain := func(format string, args ...any) {
+		fmt.Fprintf(w, "litellm explain: "+format+"\n", args...)
+	}
+	if err != nil {
+		explain("red because the fetch failed: %v", err)
+		return
+	}
+	if info == nil {
+		explain("red because no budget info was returned")
+		return
+	}
+	binding, ok := bindingConstraint(info)
+	if !ok {
+		explain("red because no team/member budget is configured for this key")
+		return
+	}
+
+	name := "member budget"
+	if binding.Tag != "" {
+		name = binding.Tag + " budget"
+	}
+	percent := binding.percent()
+	explain("%s binds: $%.2f of $%.2f (%.0f%%)", name, binding.Spend, binding.Limit, percent)
+
+	color := budgetColor(percent)
+	if binding.Spend >= binding.Limit {
+		color = ColorBrightRed
+	}
+	switch color {
+	case ColorBrightRed:
+		explain("bright red EXHAUSTED because spend reached the limit; new requests will be rejected")
+	case ColorRed:
+		explain("red because %.0f%% ≥ crit %d%%", percent, BudgetCritPercent)
+	case ColorYellow:
+		explain("yellow because %.0f%% ≥ warn %d%% (crit %d%%)", percent, BudgetWarnPercent, BudgetCritPercent)
+	default:
+		explain("green because %.0f%% < warn %d%%", percent, BudgetWarnPercent)
+	}
+
+	if alert, ok := getAlertBudget(); ok {
+		spend := derefFloat(resolveEffectiveBudget(info).Spend)
+		switch {
+		case spend <= alert:
+			explain("alert budget $%.2f not reached ($%.2f spent)", alert, spend)
+		case color == ColorGreen:
+			explain("yellow instead because spend $%.2f > alert budget $%.2f", spend, alert)
+		default:
+			explain("spend $%.2f > alert budget $%.2f (already %s)", spend, alert, colorName(color))
+		}
+	}
+}
+
+// writeVerbose writes the budget figures at full precision, as returned by the API,
+// for reconciling against the rounded statusline. It is printed by -verbose.
+func writeVerbose(w io.Writer, info *KeyInfo) {
+	if info == nil {
+		return
+	}
+	raw := func(f *float64) string {
+		if f == nil {
+			return "null"
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+	effective := resolveEffectiveBudget(info)
+	fmt.Fprintf(w, "litellm verbose: spend=%s max_budget=%s", raw(effective.Spend), raw(effective.MaxBudget))
+	if effective.MaxBudget != nil && *effective.MaxBudget > 0 {
+		fmt.Fprintf(w, " percent=%.6f", derefFloat(effective.Spend) / *effective.MaxBudget * 100)
+	}
+	fmt.Fprintln(w)
+	if info.TeamTotalMaxBudget != nil {
+		fmt.Fprintf(w, "litellm verbose: team_spend=%s team_max_budget=%s\n", raw(info.TeamTotalSpend), raw(info.TeamTotalMaxBudget))
+	}
+}
+
+// selfTestCheck is one line of the -selftest checklist. Hint says how to fix a
+// failure; a failed Critical check makes -selftest exit non-zero.
+type selfTestCheck struct {
+	Name     string
+	Passed   bool
+	Critical bool
+	Hint     string
+}
+
+// runSelfTest validates the configuration end to end: token, base URL, reachability
+// of /key/info, and budget fields in its response. It stops at the first failed
+// critical check, since the later ones depend on it.
+func runSelfTest() []selfTestCheck {
+	var checks []selfTestCheck
+	add := func(c selfTestCheck) bool {
+		checks = append(checks, c)
+		return c.Passed || !c.Critical
+	}
+
+	token := getToken()
+	if !add(selfTestCheck{
+		Name:     "API key is set",
+		Passed:   token != "",
+		Critical: true,
+		Hint:     "set LITELLM_PROXY_API_KEY or ANTHROPIC_AUTH_TOKEN",
+	}) {
+		return checks
+	}
+
+	baseURL := getBaseURL()
+	urlCheck := selfTestCheck{Name: "proxy URL is valid", Critical: true}
+	if u, err := url.Parse(baseURL); baseURL == "" {
+		urlCheck.Hint = "set LITELLM_PROXY_URL or ANTHROPIC_BASE_URL"
+	} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		urlCheck.Hint = fmt.Sprintf("%q is not an http(s) URL, e.g. https://litellm.example.com", baseURL)
+	} else {
+		urlCheck.Name = "proxy URL is valid (" + baseURL + ")"
+		urlCheck.Passed = true
+	}
+	if !add(urlCheck) {
+		return checks
+	}
+
+	info, err := fetchKeyInfo(token)
+	reach := selfTestCheck{Name: "/key/info is reachable", Passed: err == nil, Critical: true}
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrBudgetExceeded):
+		// The proxy answered and the key works; it's just out of budget.
+		reach.Passed = true
+	case errors.Is(err, ErrAuth):
+		reach.Hint = "the proxy rejected the API key; check it is a valid LiteLLM virtual key"
+	case errors.Is(err, ErrForbidden):
+		reach.Hint = "the key is valid but may not call /key/info; ask an admin for access or set LITELLM_USER_INFO_FALLBACK=1"
+	case isConnectionError(err):
+		reach.Hint = fmt.Sprintf("could not connect (%v); check the URL and your network", err)
+	default:
+		reach.Hint = err.Error()
+	}
+	if !add(reach) {
+		return checks
+	}
+
+	// Judge the budget the way the statusline does: through getBudgetInfo (scope,
+	// fallback proxy, team lookup) and the binding limit, which ignores a key-level
+	// max_budget.
+	budget := selfTestCheck{
+		Name: "response has budget fields",
+		Hint: "no team or member budget applies to this key (a key-level max_budget is not shown); ask your proxy admin to set one",
+	}
+	if errors.Is(err, ErrBudgetExceeded) {
+		budget.Passed = true
+	} else if info, err = getBudgetInfo(token); errors.Is(err, ErrBudgetExceeded) {
+		budget.Passed = true
+	} else if err != nil {
+		budget.Hint = err.Error()
+	} else {
+		_, budget.Passed = bindingConstraint(info)
+	}
+	add(budget)
+	return checks
+}
+
+// writeSelfTest prints the checklist (✓ pass, ✗ critical failure, ! warning) with
+// hints for failures, and returns ExitError if any critical check failed.
+func writeSelfTest(w io.Writer, checks []selfTestCheck) int {
+	code := ExitOK
+	for _, c := range checks {
+		mark := "✓"
+		if !c.Passed {
+			mark = "!"
+			if c.Critical {
+				mark = "✗"
+				code = ExitError
+			}
+		}
+		fmt.Fprintf(w, "%s %s\n", mark, c.Name)
+		if !c.Passed && c.Hint != "" {
+			fmt.Fprintf(w, "    %s\n", c.Hint)
+		}
+	}
+	return code
+}
+
+// crossedCritical reports whether usage moved from below the critical threshold to
+// at/above it. With no previous record, being critical counts as a crossing so the
+// first invocation over budget still alerts. Staying above the threshold never re-fires.
+func crossedCritical(prev float64, hasPrev bool, cur float64) bool {
+	if cur < BudgetCritPercent {
+		return false
+	}
+	return !hasPrev || prev < BudgetCritPercent
+}
+
+// notifyCommand builds the platform notifier invocation for goos, or nil when the
+// platform has no supported notifier.
+func notifyCommand(goos, title, message string) *exec.Cmd {
+	switch goos {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		return exec.Command("notify-send", title, message)
+	case "darwin":
+		quote := func(s string) string {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+		return exec.Command("osascript", "-e", "display notification "+quote(message)+" with title "+quote(title))
+	case "windows":
+		quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+		script := "Add-Type -AssemblyName System.Windows.Forms; " +
+			"$n = New-Object System.Windows.Forms.NotifyIcon; " +
+			"$n.Icon = [System.Drawing.SystemIcons]::Warning; $n.Visible = $true; " +
+			"$n.ShowBalloonTip(10000, " + quote(title) + ", " + quote(message) + ", 'Warning'); " +
+			"Start-Sleep -Seconds 10; $n.Dispose()"
+		return exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		return nil
+	}
+}
+
+// desktopNotifier sends a desktop notification. It starts the notifier without waiting
+// so the statusline never blocks on it. Overridden in tests.
+var desktopNotifier = func(title, message string) error {
+	cmd := notifyCommand(runtime.GOOS, title, message)
+	if cmd == nil {
+		return fmt.Errorf("no notifier for %s", runtime.GOOS)
 	}
-	return s
+	return cmd.Start()
 }
 
-// renderLine produces the fully-rendered status line (with ANSI color) for the
-// current state. Both the stdout path (main) and the --json Text field use this,
-// so the two output modes can never drift. buildStatusJSON strips the ANSI for JSON.
-func renderLine(info *KeyInfo, latestVersion string, input StatusInput, err error) string {
+// HookTimeout bounds how long a LITELLM_ON_CRIT command may run.
+const HookTimeout = 5 * time.Second
+
+// startShellHook starts command through the platform shell with env added to the
+// environment and returns without waiting, like desktopNotifier, so the statusline
+// never waits on the hook. Output is discarded rather than piped, and WaitDelay
+// bounds Wait after the HookTimeout kill, so a child the hook backgrounds can't keep
+// it open. done receives the exit status from a background goroutine.
+func startShellHook(command string, env []string, done func(exitCode int, err error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		defer cancel()
+		err := cmd.Wait()
+		done(cmd.ProcessState.ExitCode(), err)
+	}()
+	return nil
+}
+
+// critHook starts the LITELLM_ON_CRIT command. Overridden in tests.
+var critHook = startShellHook
+
+// spawnHookRunner starts this binary with -run-hook and env added to the environment,
+// detached from our stdin and stdout. In debug mode it shares our stderr for the exit
+// status line, holding it at most HookTimeout plus the WaitDelay. Overridden in tests.
+var spawnHookRunner = func(env []string) error {
+	exe, err := os.Executable()
 	if err != nil {
-		switch {
-		case errors.Is(err, ErrBudgetExceeded):
-			var bErr *BudgetExceededError
-			if errors.As(err, &bErr) && bErr.MaxBudget > 0 {
-				pct := (bErr.Spend / bErr.MaxBudget) * 100
-				return fmt.Sprintf("%s%s$%.2f/$%.2f (%.0f%%) | Budget exceeded%s",
-					ColorRed, getPrefix(input), bErr.Spend, bErr.MaxBudget, pct, ColorReset)
-			}
-			return formatError("Budget exceeded", input)
-		case errors.Is(err, ErrAuth):
-			return formatError("Auth error", input)
-		case strings.Contains(err.Error(), "timeout") ||
-			strings.Contains(err.Error(), "connection") ||
-			strings.Contains(err.Error(), "dial"):
-			return formatError("Connection error", input)
-		default:
-			if errors.Is(err, ErrNoAPIKey) {
-				return formatError("No API key", input)
-			}
-			return formatError("Error", input)
+		return err
+	}
+	cmd := exec.Command(exe, "-run-hook")
+	cmd.Env = append(os.Environ(), env...)
+	if isDebugEnabled() {
+		cmd.Stderr = os.Stderr
+	}
+	return cmd.Start()
+}
+
+// runCritHook runs the LITELLM_ON_CRIT command with env. A one-shot run exits right
+// after printing, before the command finishes, so it hands the command to a -run-hook
+// helper that waits on it and logs the exit status; the daemon starts it directly.
+func runCritHook(command string, env []string) {
+	if detachRevalidation {
+		err := spawnHookRunner(env)
+		if err == nil {
+			return
 		}
+		debugf("could not start the LITELLM_ON_CRIT helper, starting the command directly: %v", err)
 	}
-	if info == nil {
-		return formatError("Error", input)
+	err := critHook(command, env, func(code int, err error) {
+		debugf("LITELLM_ON_CRIT exited with status %d (err=%v)", code, err)
+	})
+	if err != nil {
+		debugf("LITELLM_ON_CRIT failed to start: %v", err)
 	}
-	return formatStatusLine(info, latestVersion, input)
 }
 
-// buildStatusJSON gathers the same data as the ANSI path but returns a structured
-// StatusJSON. info may be nil (fetch failed); err carries the reason. The caller
-// decides whether to render the ANSI line or emit this struct.
-func buildStatusJSON(info *KeyInfo, latestVersion string, input StatusInput, err error) StatusJSON {
-	out := StatusJSON{Prefix: strings.TrimSpace(getPrefix(input))}
-	out.Text = stripANSI(renderLine(info, latestVersion, input, err))
+// checkBudgetNotification fires a desktop notification (LITELLM_NOTIFY) and runs the
+// LITELLM_ON_CRIT command (see runCritHook) when usage crosses into the critical band
+// since the previous invocation, then records the current percent. Best-effort:
+// notifier and hook failures are only logged in debug mode.
+func checkBudgetNotification(info *KeyInfo) {
+	hook := getOnCritCommand()
+	if (!isNotifyEnabled() && hook == "") || info == nil {
+		return
+	}
+	effective := resolveEffectiveBudget(info)
+	if effective.MaxBudget == nil || *effective.MaxBudget <= 0 {
+		return
+	}
+	spend := 0.0
+	if effective.Spend != nil {
+		spend = *effective.Spend
+	}
+	percent := (spend / *effective.MaxBudget) * 100
 
-	if input.ContextWindow != nil && input.ContextWindow.UsedPercentage != nil {
-		pct := *input.ContextWindow.UsedPercentage
-		if pct < 0 {
-			pct = 0
-		} else if pct > 100 {
-			pct = 100
+	prev, hasPrev := readNotifyState()
+	prevPercent := 0.0
+	if hasPrev {
+		prevPercent = prev.LastPercent
+	}
+	if crossedCritical(prevPercent, hasPrev, percent) {
+		if isNotifyEnabled() {
+			msg := fmt.Sprintf("Budget usage at %.0f%% (%s of %s)", percent, formatMoney(spend), formatMoney(*effective.MaxBudget))
+			_ = desktopNotifier("LiteLLM budget alert", msg)
+		}
+		if hook != "" {
+			runCritHook(hook, []string{
+				"LITELLM_PERCENT=" + strconv.FormatFloat(percent, 'f', 2, 64),
+				"LITELLM_SPEND=" + strconv.FormatFloat(spend, 'f', -1, 64),
+				"LITELLM_MAX_BUDGET=" + strconv.FormatFloat(*effective.MaxBudget, 'f', -1, 64),
+			})
 		}
-		out.HasContext = true
-		out.ContextPercent = pct
 	}
+	writeNotifyState(percent)
+}
 
-	if isUpdateAvailable(Version, latestVersion) {
-		out.UpdateAvailable = latestVersion
+// logfmtErrorCodes maps StatusJSON error strings to compact, grep-friendly codes.
+var logfmtErrorCodes = map[string]string{
+	"budget exceeded":      "budget_exceeded",
+	"auth error":           "auth",
+	"no permission":        "forbidden",
+	"no api key":           "no_api_key",
+	"no cached data":       "no_cached_data",
+	"connection error":     "connection",
+	"unexpected response":  "bad_response",
+	"no budget configured": "no_budget",
+	"config error":         "config",
+	"invalid color":        "invalid_color",
+	"internal error":       "internal",
+	"error":                "error",
+}
+
+// logfmtValue quotes v when it would otherwise break key=value parsing.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+		return strconv.Quote(v)
 	}
+	return v
+}
 
-	if err != nil {
-		switch {
-		case errors.Is(err, ErrBudgetExceeded):
-			var bErr *BudgetExceededError
-			if errors.As(err, &bErr) && bErr.MaxBudget > 0 {
-				out.HasBudget = true
-				out.Spend = bErr.Spend
-				out.MaxBudget = bErr.MaxBudget
-				out.Percent = (bErr.Spend / bErr.MaxBudget) * 100
+// buildLogfmt renders the status as logfmt key=value pairs for log pipelines, e.g.
+// "spend=25.00 max_budget=100.00 percent=25 reset_seconds=3600 alias=prod".
+// It shares buildStatusJSON's classification so all output modes agree.
+func buildLogfmt(info *KeyInfo, latestVersion string, input StatusInput, err error) string {
+	out := buildStatusJSON(info, latestVersion, input, err)
+
+	var pairs []string
+	add := func(key, value string) {
+		pairs = append(pairs, key+"="+logfmtValue(value))
+	}
+
+	if out.HasBudget {
+		add("spend", fmt.Sprintf("%.2f", out.Spend))
+		add("max_budget", fmt.Sprintf("%.2f", out.MaxBudget))
+		add("percent", fmt.Sprintf("%.0f", out.Percent))
+	}
+	if err == nil && info != nil {
+		effective := resolveEffectiveBudget(info)
+		if deadline, ok := resetDeadline(effective.BudgetResetAt, effective.BudgetDuration); ok {
+			secs := int64(deadline.Sub(nowFunc()).Seconds())
+			if secs < 0 {
+				secs = 0
 			}
-			out.Error = "budget exceeded"
-		case errors.Is(err, ErrAuth):
-			out.Error = "auth error"
-		case errors.Is(err, ErrNoAPIKey):
-			out.Error = "no api key"
-		case strings.Contains(err.Error(), "timeout") ||
-			strings.Contains(err.Error(), "connection") ||
-			strings.Contains(err.Error(), "dial"):
-			out.Error = "connection error"
-		default:
-			out.Error = "error"
+			add("reset_seconds", strconv.FormatInt(secs, 10))
 		}
-		return out
+		if info.KeyAlias != nil && *info.KeyAlias != "" {
+			add("alias", *info.KeyAlias)
+		}
+	}
+	if out.Error != "" {
+		code, ok := logfmtErrorCodes[out.Error]
+		if !ok {
+			code = "error"
+		}
+		add("error", code)
 	}
+	return strings.Join(pairs, " ")
+}
 
-	if info == nil {
-		out.Error = "error"
-		return out
+// formatOutput renders the status in the selected output mode. stale marks a cached
+// value served in place of a transient error (see quietFallback).
+func formatOutput(mode string, info *KeyInfo, latestVersion string, input StatusInput, err error, stale bool) string {
+	switch mode {
+	case "json":
+		out := buildStatusJSON(info, latestVersion, input, err)
+		out.Stale = stale
+		return marshalStatusJSON(out)
+	case "logfmt":
+		line := buildLogfmt(info, latestVersion, input, err)
+		if stale {
+			line += " stale=true"
+		}
+		return line
+	case "tmux":
+		line := renderLine(info, latestVersion, input, err)
+		if stale {
+			line = renderStaleLine(info, latestVersion, input)
+		}
+		return renderTmux(line)
+	default:
+		line := renderLine(info, latestVersion, input, err)
+		if stale {
+			line = renderStaleLine(info, latestVersion, input)
+		}
+		return renderText(line)
 	}
+}
 
-	info = resolveEffectiveBudget(info)
-	if info.MaxBudget == nil || *info.MaxBudget <= 0 {
-		out.Error = "no budget configured"
-		return out
+// tmuxStyles maps the statusline's ANSI codes to tmux style escapes. "#" is doubled
+// first so text such as a "#1" label isn't read as a tmux format.
+var tmuxStyles = strings.NewReplacer(
+	"#", "##",
+	ColorGreen, "#[fg=green]",
+	ColorYellow, "#[fg=yellow]",
+	ColorRed, "#[fg=red]",
+	ColorBrightRed, "#[fg=brightred]",
+	ColorGray, "#[fg=brightblack]",
+	ColorBlink, "#[blink]",
+	ColorReset, "#[default]",
+)
+
+// renderTmux converts a text status line for tmux's status-right, which takes
+// #[fg=...] styles rather than ANSI escapes. Plain output (NO_COLOR) drops the styles.
+func renderTmux(line string) string {
+	if plainOutput {
+		line = stripANSI(line)
 	}
+	return tmuxStyles.Replace(line)
+}
 
-	out.HasBudget = true
-	out.MaxBudget = *info.MaxBudget
-	if info.Spend != nil {
-		out.Spend = *info.Spend
+// renderText applies the terminal-facing color settings to a text status line:
+// stripped entirely for plain output (NO_COLOR), otherwise recolored with
+// LITELLM_META_COLOR and translated to the LITELLM_COLOR_MODE escape family.
+func renderText(line string) string {
+	if plainOutput {
+		return stripANSI(line)
+	}
+	if meta := getMetaColor(); meta != ColorGray {
+		line = strings.ReplaceAll(line, ColorGray, meta)
 	}
-	out.Percent = (out.Spend / out.MaxBudget) * 100
+	return translateColors(line, getColorMode())
+}
 
-	resetTime, durationLabel := formatTimeUntilReset(info.BudgetResetAt, info.BudgetDuration)
-	out.ResetTime = resetTime
-	out.ResetLabel = durationLabel
+// printStatus writes the status in the selected output mode (see formatOutput).
+func printStatus(mode string, info *KeyInfo, latestVersion string, input StatusInput, err error, stale bool) {
+	writeOutput(formatOutput(mode, info, latestVersion, input, err, stale))
+}
 
-	return out
+// outputFileOnly suppresses stdout when LITELLM_OUTPUT_FILE is set (-file-only).
+// Set once in main.
+var outputFileOnly bool
+
+// statusOut receives the status line; swapped out in tests.
+var statusOut io.Writer = os.Stdout
+
+// writeOutput prints line to stdout and, when LITELLM_OUTPUT_FILE is set, also writes
+// it to that file for an external reader (e.g. tmux polling a file). A failed file
+// write is only logged in debug mode; stdout is still written unless -file-only.
+// LITELLM_NO_NEWLINE drops the trailing newline from both.
+func writeOutput(line string) {
+	if !isNoNewlineEnabled() {
+		line += "\n"
+	}
+	if path := getOutputFile(); path != "" {
+		if err := writeStatusFile(path, []byte(line)); err != nil {
+			debugf("writing status to %s: %v", path, err)
+		}
+		if outputFileOnly {
+			return
+		}
+	}
+	_, _ = io.WriteString(statusOut, line)
+}
+
+// writeStatusFile replaces the contents of path with data. Regular files are written
+// atomically (temp file + rename) so a reader never sees a partial line. A named pipe
+// is written in place instead — renaming over it would replace the pipe — and without
+// blocking, so a pipe with no reader is skipped rather than hanging the statusline.
+func writeStatusFile(path string, data []byte) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o644)
+}
+
+// cliOptions holds the parsed command-line flags.
+type cliOptions struct {
+	version    bool
+	json       bool
+	explain    bool
+	fileOnly   bool
+	exitCode   bool
+	selfTest   bool
+	configPath string
+	baseURL    string
+	token      string
+	color      string
+	daemon     bool
+	client     bool
+	manifest   bool
+	verbose    bool
+	fast       bool
+	revalidate bool
+	runHook    bool
+}
+
+// parseArgs parses the command line. Flags accept either - or -- (e.g. --json).
+func parseArgs(args []string) (cliOptions, error) {
+	var opts cliOptions
+	fs := flag.NewFlagSet("claude-code-litellm-plugin", flag.ContinueOnError)
+	fs.BoolVar(&opts.version, "version", false, "print the version and exit")
+	fs.BoolVar(&opts.version, "v", false, "shorthand for -version")
+	fs.BoolVar(&opts.json, "json", false, "emit structured JSON instead of the ANSI statusline")
+	fs.BoolVar(&opts.explain, "explain", false, "print why the status got its color to stderr")
+	fs.BoolVar(&opts.verbose, "verbose", false, "print the full-precision spend and budget to stderr")
+	fs.BoolVar(&opts.fast, "fast", false, "make a single quick attempt (no retries, short timeouts) for use by hand")
+	fs.BoolVar(&opts.fileOnly, "file-only", false, "write the status only to LITELLM_OUTPUT_FILE, not stdout")
+	fs.BoolVar(&opts.exitCode, "exit-code", false, "exit 3/4 when usage is in the warn/critical band (1 on errors)")
+	fs.BoolVar(&opts.selfTest, "selftest", false, "check the configuration end to end and print a checklist")
+	fs.StringVar(&opts.baseURL, "base-url", "", "LiteLLM proxy URL, overriding the environment")
+	fs.StringVar(&opts.token, "token", "", "API key, overriding the environment")
+	fs.StringVar(&opts.configPath, "config", "", "config file path (default $XDG_CONFIG_HOME/litellm-statusline/config.json)")
+	fs.BoolVar(&opts.manifest, "manifest", false, "print the statusline plugin manifest as JSON and exit")
+	fs.BoolVar(&opts.daemon, "daemon", false, "serve the statusline on LITELLM_SOCKET until interrupted")
+	fs.BoolVar(&opts.client, "client", false, "print the statusline from a running -daemon, rendering in-process if none answers")
+	fs.StringVar(&opts.color, "color", "auto", "colorize the statusline: always, never, or auto (honors NO_COLOR)")
+	fs.BoolVar(&opts.revalidate, "revalidate", false, "refresh the budget cache and exit (started in the background by the statusline)")
+	fs.BoolVar(&opts.runHook, "run-hook", false, "run LITELLM_ON_CRIT and log its exit status (started in the background by the statusline)")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	switch opts.color {
+	case "always", "never", "auto":
+	default:
+		err := fmt.Errorf("invalid -color %q: want always, never, or auto", opts.color)
+		fmt.Fprintln(fs.Output(), err)
+		return opts, err
+	}
+	return opts, nil
 }
 
 func main() {
-	args := os.Args[1:]
+	os.Exit(run(os.Args[1:]))
+}
+
+// run is the whole program minus os.Exit, so it can be driven from tests. It returns
+// the exit code: always ExitOK unless the flags are invalid or -exit-code asks for
+// the budget state.
+//
+// A panic anywhere on this path is recovered into an "internal error" status in the
+// selected output mode with ExitOK, so a bug never leaves Claude Code with a blank or
+// crashed statusline.
+func run(args []string) (code int) {
+	var (
+		opts  cliOptions
+		input StatusInput
+	)
+	outputMode := func() string {
+		if opts.json {
+			return "json"
+		}
+		return getOutputMode()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			debugf("panic: %v\n%s", r, debug.Stack())
+			writeOutput(formatOutput(outputMode(), nil, "", input, ErrInternal, false))
+			code = ExitOK
+		}
+	}()
 
-	if len(args) > 0 && (args[0] == "--version" || args[0] == "-v") {
+	opts, err := parseArgs(args)
+	if err != nil {
+		return ExitUsage
+	}
+
+	if opts.version {
 		fmt.Println(Version)
-		return
+		return ExitOK
+	}
+	if opts.manifest {
+		writeManifest(os.Stdout)
+		return ExitOK
+	}
+
+	// -selftest and -daemon are run by hand from a terminal, where stdin has no JSON
+	// to wait for; -revalidate and -run-hook are started with no stdin at all.
+	if !opts.selfTest && !opts.daemon && !opts.revalidate && !opts.runHook {
+		input = readStatusInput(os.Stdin)
+	}
+
+	vtErr := enableVirtualTerminal()
+	if vtErr != nil {
+		debugf("could not enable ANSI support on this console, disabling color: %v", vtErr)
+	}
+	plainOutput = !useColor(opts.color, os.Getenv("NO_COLOR"), vtErr)
+	outputFileOnly = opts.fileOnly
+
+	exit := func(info *KeyInfo, err error) int {
+		if !opts.exitCode {
+			return ExitOK
+		}
+		return budgetExitCode(info, err)
+	}
+
+	cfgPath, required := opts.configPath, opts.configPath != ""
+	if !required {
+		cfgPath = configFile()
+	}
+	cfg, cfgErr := loadConfig(cfgPath, required)
+	if cfgErr != nil {
+		if opts.selfTest {
+			return writeSelfTest(os.Stdout, []selfTestCheck{{Name: "config file is valid", Critical: true, Hint: cfgErr.Error()}})
+		}
+		debugf("%v", cfgErr)
+		err := fmt.Errorf("%w: %w", ErrConfig, cfgErr)
+		writeOutput(formatOutput(outputMode(), nil, "", input, err, false))
+		return exit(nil, err)
+	}
+	applyConfig(cfg)
+	// The config file may set NO_COLOR.
+	plainOutput = !useColor(opts.color, os.Getenv("NO_COLOR"), vtErr)
+	// Flags beat the environment and the config file: they set the highest-priority
+	// variables that getBaseURL and getToken check first.
+	if opts.baseURL != "" {
+		_ = os.Setenv("LITELLM_PROXY_URL", opts.baseURL)
+	}
+	if opts.token != "" {
+		_ = os.Setenv("LITELLM_PROXY_API_KEY", opts.token)
+	}
+	// Someone at a terminal would rather see an error now than sit through retries;
+	// Claude Code's invocations keep the resilient defaults.
+	if opts.fast {
+		_ = os.Setenv("LITELLM_RETRIES", "0")
+		_ = os.Setenv("LITELLM_CONNECT_TIMEOUT_MS", strconv.FormatInt(FastConnectTimeout.Milliseconds(), 10))
+		_ = os.Setenv("LITELLM_READ_TIMEOUT_MS", strconv.FormatInt(FastReadTimeout.Milliseconds(), 10))
+	}
+	logEnvFingerprint()
+	warnEnvConflicts()
+
+	if colorErr := validateColors(); colorErr != nil {
+		if opts.selfTest {
+			return writeSelfTest(os.Stdout, []selfTestCheck{{Name: "colors are valid", Critical: true, Hint: colorErr.Error()}})
+		}
+		debugf("%v", colorErr)
+		writeOutput(formatOutput(outputMode(), nil, "", input, colorErr, false))
+		return exit(nil, colorErr)
+	}
+
+	if opts.selfTest {
+		return writeSelfTest(os.Stdout, runSelfTest())
+	}
+	// The budget figures for the hook are already in the environment (see runCritHook).
+	if opts.runHook {
+		if hook := getOnCritCommand(); hook != "" {
+			finished := make(chan struct{})
+			err := critHook(hook, nil, func(code int, err error) {
+				debugf("LITELLM_ON_CRIT exited with status %d (err=%v)", code, err)
+				close(finished)
+			})
+			if err != nil {
+				debugf("LITELLM_ON_CRIT failed to start: %v", err)
+			} else {
+				<-finished
+			}
+		}
+		return ExitOK
+	}
+	// The parent already checked the breaker before serving its stale entry. The child
+	// may have been started for the budget or the top-model cache, so it refreshes only
+	// what has expired.
+	if opts.revalidate {
+		defer releaseRevalidation()
+		if token := getToken(); token != "" {
+			if entry, ok := readBudgetCacheEntry(); ok && nowFunc().UnixMilli()-entry.Timestamp >= getCacheTTLMs() {
+				_, _ = refreshShared(token, newBreaker())
+			}
+			if isShowTopModelEnabled() {
+				refreshTopModel(token)
+			}
+		}
+		return ExitOK
 	}
 
-	jsonMode := len(args) > 0 && args[0] == "--json"
+	mode := outputMode()
 
-	input := readStatusInput(os.Stdin)
+	if opts.daemon {
+		return runDaemon(mode)
+	}
+	if opts.client {
+		reply, err := queryDaemon(daemonRequest{Input: input, Mode: mode, Plain: plainOutput})
+		if err == nil {
+			writeOutput(reply.Line)
+			if !opts.exitCode {
+				return ExitOK
+			}
+			return reply.ExitCode
+		}
+		debugf("daemon unavailable, rendering in-process: %v", err)
+	}
 
 	token := getToken()
 	if token == "" {
-		noKey := fmt.Errorf("%w", ErrNoAPIKey)
-		if jsonMode {
-			emitJSON(buildStatusJSON(nil, "", input, noKey))
-			return
+		err := fmt.Errorf("%w", ErrNoAPIKey)
+		printStatus(mode, nil, "", input, err, false)
+		return exit(nil, err)
+	}
+
+	// This process exits right after printing, so a stale-while-revalidate refresh
+	// has to run in a child to land in the cache.
+	detachRevalidation = true
+	defer func() { detachRevalidation = false }()
+	info, err := getBudgetInfo(token)
+	latestVersion := getLatestVersion()
+	if isShowTopModelEnabled() && err == nil && !isOfflineEnabled() {
+		startTopModelRefresh(token)
+	}
+
+	// Quiet mode: a transient failure with anything cached shows the last known value
+	// (dimmed) instead of flickering "Connection error" into the statusline.
+	if cached, ok := quietFallback(err); ok {
+		printStatus(mode, cached, latestVersion, input, nil, true)
+		if opts.explain {
+			fmt.Fprintf(os.Stderr, "litellm explain: gray because the fetch failed (%v) and the last cached value is shown\n", err)
+			writeExplanation(os.Stderr, cached, nil)
 		}
-		fmt.Println(renderLine(nil, "", input, noKey))
-		return
+		if opts.verbose || isVerboseEnabled() {
+			writeVerbose(os.Stderr, cached)
+		}
+		return exit(cached, nil)
+	}
+
+	if err == nil {
+		input = withShownColor(mode, info, input)
+	}
+	printStatus(mode, info, latestVersion, input, err, false)
+	if opts.explain {
+		writeExplanation(os.Stderr, info, err)
+	}
+	if opts.verbose || isVerboseEnabled() {
+		writeVerbose(os.Stderr, info)
+	}
+	if err == nil {
+		checkBudgetNotification(info)
+	}
+	return exit(info, err)
+}
+
+// runDaemon serves status lines on socketPath() until SIGINT/SIGTERM, so each
+// Claude Code turn costs a socket round trip instead of a process start. The budget
+// is kept in memory (see budgetMemory), written through to the on-disk cache.
+func runDaemon(mode string) int {
+	budgetMemory.Lock()
+	budgetMemory.entries = make(map[string]BudgetCacheEntry)
+	budgetMemory.Unlock()
+	path := socketPath()
+	l, err := listenDaemon(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "litellm daemon: %v\n", err)
+		return ExitError
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	debugf("daemon listening on %s", path)
+	if err := serveDaemon(l, mode); err != nil {
+		fmt.Fprintf(os.Stderr, "litellm daemon: %v\n", err)
+		return ExitError
+	}
+	return ExitOK
+}
+
+// listenDaemon listens on the Unix socket at path. A leftover socket from a daemon
+// that died is removed first; one that still answers means a daemon is running.
+func listenDaemon(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, DaemonDialTimeout); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The socket serves budget data, so keep it to the owner like the cache files.
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// daemonRequest is what -client sends: Claude Code's status JSON plus the client's
+// own output settings, so the reply matches what the client would have rendered.
+// An empty Mode means the daemon's own.
+type daemonRequest struct {
+	Input StatusInput `json:"input"`
+	Mode  string      `json:"mode,omitempty"`
+	Plain bool        `json:"plain,omitempty"`
+}
+
+// daemonReply is the daemon's answer: the rendered line and the -exit-code status
+// for it, which the client returns only when asked to.
+type daemonReply struct {
+	Line     string `json:"line"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// serveDaemon answers connections on l until it is closed. Each client sends a
+// daemonRequest and half-closes; the daemon replies with a daemonReply and closes.
+// mode is used for requests that don't name one. Connections are served one at a
+// time: renders are fast, and the caches and render state (including plainOutput,
+// set per request) aren't built for concurrent use.
+func serveDaemon(l net.Listener, mode string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		handleDaemonConn(conn, mode)
+	}
+}
+
+// handleDaemonConn serves one client. Like run, a panic becomes an "internal error"
+// line rather than taking the daemon down. Budget notifications are checked only
+// after the reply is sent and the connection closed.
+func handleDaemonConn(conn net.Conn, mode string) {
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(DaemonConnTimeout))
+	var req daemonRequest
+	origPlain := plainOutput
+	defer func() { plainOutput = origPlain }()
+	// Registered after the restore above, so it still renders with the client's
+	// color setting.
+	defer func() {
+		if r := recover(); r != nil {
+			debugf("panic: %v\n%s", r, debug.Stack())
+			m := req.Mode
+			if m == "" {
+				m = mode
+			}
+			_ = json.NewEncoder(conn).Encode(daemonReply{Line: formatOutput(m, nil, "", req.Input, ErrInternal, false)})
+		}
+	}()
+	_ = json.NewDecoder(conn).Decode(&req)
+	if req.Mode == "" {
+		req.Mode = mode
 	}
+	plainOutput = req.Plain
+	reply, fresh := daemonStatus(req.Input, req.Mode)
+	_ = json.NewEncoder(conn).Encode(reply)
+	_ = conn.Close()
+	if fresh != nil {
+		checkBudgetNotification(fresh)
+	}
+}
 
-	info, err := getKeyInfo(token)
+// daemonStatus renders the reply for one daemon request. It follows run's pipeline
+// without -explain. fresh is the successfully fetched budget for the caller's
+// notification check, or nil.
+func daemonStatus(input StatusInput, mode string) (reply daemonReply, fresh *KeyInfo) {
+	token := getToken()
+	if token == "" {
+		err := fmt.Errorf("%w", ErrNoAPIKey)
+		return daemonReply{formatOutput(mode, nil, "", input, err, false), budgetExitCode(nil, err)}, nil
+	}
+	info, err := getBudgetInfo(token)
 	latestVersion := getLatestVersion()
+	if isShowTopModelEnabled() && err == nil && !isOfflineEnabled() {
+		startTopModelRefresh(token)
+	}
+	if cached, ok := quietFallback(err); ok {
+		return daemonReply{formatOutput(mode, cached, latestVersion, input, nil, true), budgetExitCode(cached, nil)}, nil
+	}
+	if err == nil {
+		fresh = info
+		input = withShownColor(mode, info, input)
+	}
+	return daemonReply{formatOutput(mode, info, latestVersion, input, err, false), budgetExitCode(info, err)}, fresh
+}
 
-	if jsonMode {
-		emitJSON(buildStatusJSON(info, latestVersion, input, err))
-		return
+// queryDaemon sends req to the daemon on socketPath() and returns its reply.
+func queryDaemon(req daemonRequest) (daemonReply, error) {
+	var reply daemonReply
+	conn, err := net.DialTimeout("unix", socketPath(), DaemonDialTimeout)
+	if err != nil {
+		return reply, err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(DaemonConnTimeout))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return reply, err
+	}
+	if uc, ok := conn.(*net.UnixConn); ok {
+		_ = uc.CloseWrite()
+	}
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return reply, fmt.Errorf("bad reply from daemon: %w", err)
 	}
+	return reply, nil
+}
 
-	if err != nil || info == nil {
-		fmt.Println(renderLine(info, latestVersion, input, err))
-		return
+// PluginManifest describes this binary as a Claude Code statusline command, for
+// -manifest.
+type PluginManifest struct {
+	Name              string `json:"name"`
+	Version           string `json:"version"`
+	Type              string `json:"type"`
+	Command           string `json:"command"`
+	RefreshIntervalMs int64  `json:"refresh_interval_ms"`
+}
+
+// writeManifest writes the plugin manifest as indented JSON. The command is the
+// absolute path of the running binary when it can be resolved, so the output can go
+// straight into a Claude Code config; the refresh interval matches the cache TTL,
+// since refreshing faster only re-reads the cache.
+func writeManifest(w io.Writer) {
+	command := "claude-code-litellm-plugin"
+	if exe, err := os.Executable(); err == nil {
+		command = exe
 	}
+	data, _ := json.MarshalIndent(PluginManifest{
+		Name:              "claude-code-litellm-plugin",
+		Version:           Version,
+		Type:              "command",
+		Command:           command,
+		RefreshIntervalMs: getCacheTTLMs(),
+	}, "", "  ")
+	_, _ = w.Write(append(data, '\n'))
+}
 
-	fmt.Println(renderLine(info, latestVersion, input, nil))
+// budgetExitCode maps the budget state to the -exit-code exit status, using the same
+// binding-limit percent that colors the statusline: ExitOK below the warn threshold,
+// ExitWarn and ExitCrit in the warn and critical bands. An exceeded budget counts as
+// critical; any other failure (or no budget at all) is ExitError.
+func budgetExitCode(info *KeyInfo, err error) int {
+	if errors.Is(err, ErrBudgetExceeded) {
+		return ExitCrit
+	}
+	if err != nil || info == nil {
+		return ExitError
+	}
+	binding, ok := bindingConstraint(info)
+	if !ok {
+		if _, org := orgSpendWithoutBudget(info); org {
+			return ExitOK
+		}
+		return ExitError
+	}
+	switch percent := binding.percent(); {
+	case percent >= BudgetCritPercent:
+		return ExitCrit
+	case percent >= BudgetWarnPercent:
+		return ExitWarn
+	}
+	return ExitOK
 }
 
-// emitJSON marshals out to stdout. A failure to marshal would indicate a programming
+// marshalStatusJSON encodes out. A failure to marshal would indicate a programming
 // error (nil pointers on the struct fields can't happen), so it panics — the binary
 // should never produce unparseable JSON in --json mode.
-func emitJSON(out StatusJSON) {
+func marshalStatusJSON(out StatusJSON) string {
 	data, err := json.Marshal(out)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println(string(data))
+	return string(data)
 }
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -17,7 +31,20 @@ func strPtr(s string) *string {
 	return &s
 }
 
+// fixedNow is the pinned clock used by time-dependent tests (see setNow).
+var fixedNow = time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+
+// setNow pins nowFunc to now for the rest of the test.
+func setNow(t testing.TB, now time.Time) {
+	t.Helper()
+	orig := nowFunc
+	nowFunc = func() time.Time { return now }
+	t.Cleanup(func() { nowFunc = orig })
+}
+
 func TestFormatTimeUntilReset(t *testing.T) {
+	setNow(t, fixedNow)
+	t.Setenv("LITELLM_RESET_LABEL", "")
 	tests := []struct {
 		name           string
 		resetAt        *string
@@ -47,33 +74,40 @@ func TestFormatTimeUntilReset(t *testing.T) {
 			expectedLabel:  "",
 		},
 		{
-			name:           "past time",
-			resetAt:        strPtr("2020-01-01T00:00:00Z"),
+			name:           "just passed",
+			resetAt:        strPtr("2025-06-15T11:55:00Z"),
 			budgetDuration: nil,
 			expectedTime:   "resetting",
 			expectedLabel:  "",
 		},
 		{
 			name:           "with monthly duration label",
-			resetAt:        strPtr("2020-01-01T00:00:00Z"),
+			resetAt:        strPtr("2025-06-15T11:55:00Z"),
 			budgetDuration: strPtr("30d"),
 			expectedTime:   "resetting",
 			expectedLabel:  "monthly",
 		},
 		{
 			name:           "with weekly duration label",
-			resetAt:        strPtr("2020-01-01T00:00:00Z"),
+			resetAt:        strPtr("2025-06-15T11:55:00Z"),
 			budgetDuration: strPtr("7d"),
 			expectedTime:   "resetting",
 			expectedLabel:  "weekly",
 		},
 		{
 			name:           "with daily duration label",
-			resetAt:        strPtr("2020-01-01T00:00:00Z"),
+			resetAt:        strPtr("2025-06-15T11:55:00Z"),
 			budgetDuration: strPtr("1d"),
 			expectedTime:   "resetting",
 			expectedLabel:  "daily",
 		},
+		{
+			name:           "long overdue",
+			resetAt:        strPtr("2025-06-15T10:40:00Z"),
+			budgetDuration: nil,
+			expectedTime:   "overdue by 1h",
+			expectedLabel:  "",
+		},
 		{
 			name:           "unknown duration format shows unknown",
 			resetAt:        nil,
@@ -95,31 +129,28 @@ func TestFormatTimeUntilReset(t *testing.T) {
 		})
 	}
 
-	// Test future times (dynamic)
+	// Test future times against a pinned clock
 	t.Run("future time with days", func(t *testing.T) {
-		future := time.Now().UTC().Add(50 * time.Hour)
-		resetAt := future.Format("2006-01-02T15:04:05Z")
-		result, _ := formatTimeUntilReset(&resetAt, nil)
-		if !strings.Contains(result, "d") {
-			t.Errorf("expected result to contain 'd' for days, got %q", result)
+		setNow(t, fixedNow)
+		resetAt := fixedNow.Add(50 * time.Hour).Format("2006-01-02T15:04:05Z")
+		if result, _ := formatTimeUntilReset(&resetAt, nil); result != "2d2h" {
+			t.Errorf("expected 2d2h, got %q", result)
 		}
 	})
 
 	t.Run("future time with hours only", func(t *testing.T) {
-		future := time.Now().UTC().Add(5 * time.Hour)
-		resetAt := future.Format("2006-01-02T15:04:05Z")
-		result, _ := formatTimeUntilReset(&resetAt, nil)
-		if !strings.Contains(result, "h") {
-			t.Errorf("expected result to contain 'h' for hours, got %q", result)
+		setNow(t, fixedNow)
+		resetAt := fixedNow.Add(5 * time.Hour).Format("2006-01-02T15:04:05Z")
+		if result, _ := formatTimeUntilReset(&resetAt, nil); result != "5h" {
+			t.Errorf("expected 5h, got %q", result)
 		}
 	})
 
 	t.Run("future time with minutes only", func(t *testing.T) {
-		future := time.Now().UTC().Add(30 * time.Minute)
-		resetAt := future.Format("2006-01-02T15:04:05Z")
-		result, _ := formatTimeUntilReset(&resetAt, nil)
-		if !strings.Contains(result, "m") {
-			t.Errorf("expected result to contain 'm' for minutes, got %q", result)
+		setNow(t, fixedNow)
+		resetAt := fixedNow.Add(30 * time.Minute).Format("2006-01-02T15:04:05Z")
+		if result, _ := formatTimeUntilReset(&resetAt, nil); result != "30m" {
+			t.Errorf("expected 30m, got %q", result)
 		}
 	})
 
@@ -156,38 +187,38 @@ func TestFormatTimeUntilReset(t *testing.T) {
 }
 
 func TestCalculateNextReset(t *testing.T) {
-	now := time.Now().UTC()
-	tolerance := 2 * time.Second
+	now := fixedNow
+	setNow(t, now)
 
 	t.Run("daily reset (1d)", func(t *testing.T) {
 		result := calculateNextReset("1d")
 		expected := now.Add(24 * time.Hour)
-		if diff := result.Sub(expected); diff < -tolerance || diff > tolerance {
-			t.Errorf("calculateNextReset(1d) = %v, want approximately %v", result, expected)
+		if !result.Equal(expected) {
+			t.Errorf("calculateNextReset(1d) = %v, want %v", result, expected)
 		}
 	})
 
 	t.Run("daily reset (24h)", func(t *testing.T) {
 		result := calculateNextReset("24h")
 		expected := now.Add(24 * time.Hour)
-		if diff := result.Sub(expected); diff < -tolerance || diff > tolerance {
-			t.Errorf("calculateNextReset(24h) = %v, want approximately %v", result, expected)
+		if !result.Equal(expected) {
+			t.Errorf("calculateNextReset(24h) = %v, want %v", result, expected)
 		}
 	})
 
 	t.Run("daily alias", func(t *testing.T) {
 		result := calculateNextReset("daily")
 		expected := now.Add(24 * time.Hour)
-		if diff := result.Sub(expected); diff < -tolerance || diff > tolerance {
-			t.Errorf("calculateNextReset(daily) = %v, want approximately %v", result, expected)
+		if !result.Equal(expected) {
+			t.Errorf("calculateNextReset(daily) = %v, want %v", result, expected)
 		}
 	})
 
 	t.Run("weekly reset (7d)", func(t *testing.T) {
 		result := calculateNextReset("7d")
 		expected := now.Add(7 * 24 * time.Hour)
-		if diff := result.Sub(expected); diff < -tolerance || diff > tolerance {
-			t.Errorf("calculateNextReset(7d) = %v, want approximately %v", result, expected)
+		if !result.Equal(expected) {
+			t.Errorf("calculateNextReset(7d) = %v, want %v", result, expected)
 		}
 		if result.Before(now) {
 			t.Errorf("calculateNextReset(7d) = %v, should be in the future", result)
@@ -197,16 +228,16 @@ func TestCalculateNextReset(t *testing.T) {
 	t.Run("weekly alias", func(t *testing.T) {
 		result := calculateNextReset("weekly")
 		expected := now.Add(7 * 24 * time.Hour)
-		if diff := result.Sub(expected); diff < -tolerance || diff > tolerance {
-			t.Errorf("calculateNextReset(weekly) = %v, want approximately %v", result, expected)
+		if !result.Equal(expected) {
+			t.Errorf("calculateNextReset(weekly) = %v, want %v", result, expected)
 		}
 	})
 
 	t.Run("monthly reset (30d)", func(t *testing.T) {
 		result := calculateNextReset("30d")
 		expected := now.Add(30 * 24 * time.Hour)
-		if diff := result.Sub(expected); diff < -tolerance || diff > tolerance {
-			t.Errorf("calculateNextReset(30d) = %v, want approximately %v", result, expected)
+		if !result.Equal(expected) {
+			t.Errorf("calculateNextReset(30d) = %v, want %v", result, expected)
 		}
 		if result.Before(now) {
 			t.Errorf("calculateNextReset(30d) = %v, should be in the future", result)
@@ -216,17 +247,16 @@ func TestCalculateNextReset(t *testing.T) {
 	t.Run("monthly alias", func(t *testing.T) {
 		result := calculateNextReset("monthly")
 		expected := now.Add(30 * 24 * time.Hour)
-		if diff := result.Sub(expected); diff < -tolerance || diff > tolerance {
-			t.Errorf("calculateNextReset(monthly) = %v, want approximately %v", result, expected)
+		if !result.Equal(expected) {
+			t.Errorf("calculateNextReset(monthly) = %v, want %v", result, expected)
 		}
 	})
 
 	t.Run("custom hours duration", func(t *testing.T) {
 		result := calculateNextReset("48h")
 		expected := now.Add(48 * time.Hour)
-		// Allow 1 second tolerance
-		if result.Sub(expected).Abs() > time.Second {
-			t.Errorf("calculateNextReset(48h) = %v, want approximately %v", result, expected)
+		if !result.Equal(expected) {
+			t.Errorf("calculateNextReset(48h) = %v, want %v", result, expected)
 		}
 	})
 
@@ -315,7 +345,30 @@ func TestParseISOTime(t *testing.T) {
 	}
 }
 
+func TestParseISOTimeHTTPDates(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Time
+	}{
+		{"Mon, 15 Jan 2024 10:30:00 GMT", time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{"Mon, 15 Jan 2024 10:30:00 +0200", time.Date(2024, 1, 15, 8, 30, 0, 0, time.UTC)},
+		{"15 Jan 24 10:30 UTC", time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{"15 Jan 24 10:30 -0500", time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseISOTime(tt.input)
+		if err != nil {
+			t.Errorf("parseISOTime(%q) error = %v", tt.input, err)
+			continue
+		}
+		if !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("parseISOTime(%q) = %v, want %v in UTC", tt.input, got, tt.want)
+		}
+	}
+}
+
 func TestFormatStatusLine(t *testing.T) {
+	setNow(t, fixedNow)
 	// Default-off SHOW_COST is the new normal; make sure no ambient env leaks in.
 	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
 	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
@@ -395,7 +448,7 @@ func TestFormatStatusLine(t *testing.T) {
 			info: &KeyInfo{
 				TeamSpend:         &spend25,
 				TeamMaxBudget:     &budget100,
-				TeamBudgetResetAt: strPtr("2020-01-01T00:00:00Z"), // past time
+				TeamBudgetResetAt: strPtr("2025-06-15T11:55:00Z"), // just passed
 			},
 			expectColor:    ColorGreen,
 			expectContains: []string{"◔", "reset:", "resetting"},
@@ -466,6 +519,20 @@ func TestFormatError(t *testing.T) {
 	if !strings.HasSuffix(result, ColorReset) {
 		t.Errorf("expected error to end with color reset")
 	}
+
+	t.Run("custom label", func(t *testing.T) {
+		t.Setenv("LITELLM_LABEL", "AI Budget")
+		if got := formatError("Test error", StatusInput{}); !strings.Contains(got, "AI Budget: Test error") {
+			t.Errorf("expected custom label in error, got %q", got)
+		}
+	})
+
+	t.Run("empty label", func(t *testing.T) {
+		t.Setenv("LITELLM_LABEL", "")
+		if got := formatError("Test error", StatusInput{}); got != ColorRed+"Test error"+ColorReset {
+			t.Errorf("expected bare error without prefix, got %q", got)
+		}
+	})
 }
 
 func TestGetEnvWithFallback(t *testing.T) {
@@ -574,6 +641,46 @@ func TestCircleGlyph(t *testing.T) {
 	}
 }
 
+func TestFormatStatusLinePercentGlyph(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	t.Setenv("LITELLM_PERCENT_GLYPH", "1")
+
+	budget := 100.0
+	tests := []struct {
+		spend float64
+		want  string
+		color string
+	}{
+		{0, "○", ColorGreen},
+		{20, "◔", ColorGreen},
+		{45, "◑", ColorGreen},
+		{80, "◕", ColorYellow},
+		{95, "●", ColorRed},
+	}
+	for _, tt := range tests {
+		got := formatStatusLine(&KeyInfo{TeamSpend: &tt.spend, TeamMaxBudget: &budget}, "", StatusInput{})
+		if plain := stripANSI(got); plain != tt.want {
+			t.Errorf("spend %v: expected only %q, got %q", tt.spend, tt.want, plain)
+		}
+		if !strings.HasPrefix(got, tt.color+tt.want) {
+			t.Errorf("spend %v: expected the glyph colored %q, got %q", tt.spend, tt.color, got)
+		}
+	}
+
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "1")
+	spend := 45.0
+	if got := stripANSI(formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})); got != "◑ $45.00/$100.00" {
+		t.Errorf("expected the percent dropped from the cost figures, got %q", got)
+	}
+
+	if got := stripANSI(formatStatusLine(&KeyInfo{}, "", StatusInput{})); strings.ContainsAny(got, "○◔◑◕●") {
+		t.Errorf("expected no glyph without a budget, got %q", got)
+	}
+}
+
 func TestContextColor(t *testing.T) {
 	tests := []struct {
 		pct  float64
@@ -760,6 +867,168 @@ func TestGetKeyInfoAuthError(t *testing.T) {
 	}
 }
 
+func TestFetchTrace(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	ft := newFetchTrace()
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), ft.clientTrace()))
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if ft.connectStart.IsZero() || ft.connectDone.IsZero() || ft.tlsStart.IsZero() || ft.tlsDone.IsZero() || ft.firstByte.IsZero() {
+		t.Fatalf("expected connect, TLS and first-byte callbacks to fire: %+v", ft)
+	}
+	got := ft.String()
+	for _, phase := range []string{"connect=", "tls=", "first_byte=", "total="} {
+		if !strings.Contains(got, phase) {
+			t.Errorf("expected %q in %q", phase, got)
+		}
+	}
+	// The test server is an IP literal, so there is no DNS lookup to report.
+	if strings.Contains(got, "dns=") {
+		t.Errorf("expected no dns phase for an IP address, got %q", got)
+	}
+}
+
+func TestGetKeyInfoDebugTiming(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"info":{"spend":1,"max_budget":10}}`))
+	}))
+	defer server.Close()
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	var logs strings.Builder
+	origDebug := debugOut
+	debugOut = &logs
+	defer func() { debugOut = origDebug }()
+
+	t.Setenv("LITELLM_DEBUG", "")
+	if _, err := fetchKeyInfoOnce(server.URL, "test-token"); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected no tracing without debug, got %q", logs.String())
+	}
+
+	t.Setenv("LITELLM_DEBUG", "1")
+	if _, err := fetchKeyInfoOnce(server.URL, "test-token"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "timing: ") || !strings.Contains(logs.String(), "first_byte=") {
+		t.Errorf("expected request timing in the debug log, got %q", logs.String())
+	}
+}
+
+func TestGetKeyInfoQueryKey(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_DEBUG", "1")
+	var logs strings.Builder
+	origDebug := debugOut
+	debugOut = &logs
+	defer func() { debugOut = origDebug }()
+
+	var gotKey, gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.URL.Query().Get("key")
+		gotAuth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"info": {"spend": 1, "max_budget": 10}}`))
+	}))
+	defer server.Close()
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-admin")
+
+	t.Setenv("LITELLM_QUERY_KEY", "")
+	ownCache := budgetCacheFile()
+
+	t.Setenv("LITELLM_QUERY_KEY", "sk-monitored")
+	if _, err := fetchKeyInfo("sk-admin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotKey != "sk-monitored" {
+		t.Errorf("expected key=sk-monitored query param, got %q", gotKey)
+	}
+	if gotAuth != "Bearer sk-admin" {
+		t.Errorf("expected the admin token for auth, got %q", gotAuth)
+	}
+	if strings.Contains(logs.String(), "sk-monitored") {
+		t.Errorf("expected the queried key kept out of debug logs, got %q", logs.String())
+	}
+	if budgetCacheFile() == ownCache {
+		t.Error("expected the queried key to get its own cache file")
+	}
+
+	t.Setenv("LITELLM_QUERY_KEY", "")
+	gotKey = "unset"
+	if _, err := fetchKeyInfo("sk-admin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotKey != "" {
+		t.Errorf("expected no key query param by default, got %q", gotKey)
+	}
+}
+
+func TestGetKeyInfoFallbackProxy(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "http://127.0.0.1:1")
+	t.Setenv("LITELLM_DEBUG", "1")
+	var logs strings.Builder
+	origDebug := debugOut
+	debugOut = &logs
+	defer func() { debugOut = origDebug }()
+
+	var paths []string
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/team/info" {
+			_, _ = w.Write([]byte(`{"team_info": {"spend": 5, "max_budget": 50}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"info": {"team_id": "t1"}}`))
+	}))
+	defer backup.Close()
+
+	t.Run("without a fallback the error stands", func(t *testing.T) {
+		t.Setenv("LITELLM_PROXY_URL_FALLBACK", "")
+		if _, err := getKeyInfo("test-token"); !isConnectionError(err) {
+			t.Errorf("expected a connection error, got %v", err)
+		}
+		clearBudgetFailCache()
+	})
+
+	t.Run("fallback serves the budget", func(t *testing.T) {
+		t.Setenv("LITELLM_PROXY_URL_FALLBACK", backup.URL+"/")
+		info, err := getKeyInfo("test-token")
+		if err != nil {
+			t.Fatalf("expected the fallback to succeed, got %v", err)
+		}
+		if info.TeamMaxBudget == nil || *info.TeamMaxBudget != 50 {
+			t.Errorf("expected the team budget from the fallback, got %+v", info)
+		}
+		if strings.Join(paths, ",") != "/key/info,/team/info" {
+			t.Errorf("expected key and team lookups on the fallback, got %v", paths)
+		}
+		if !strings.Contains(logs.String(), "budget served by fallback proxy "+backup.URL) {
+			t.Errorf("expected the debug log to name the fallback, got %q", logs.String())
+		}
+		if _, ok := readBudgetFailEntry(); ok {
+			t.Error("expected no cooldown after the fallback succeeded")
+		}
+	})
+}
+
 func TestGetKeyInfoForbiddenError(t *testing.T) {
 	t.Setenv("XDG_CACHE_HOME", t.TempDir())
 
@@ -773,14 +1042,103 @@ func TestGetKeyInfoForbiddenError(t *testing.T) {
 
 	_, err := getKeyInfo("bad-token")
 	if err == nil {
-		t.Fatal("expected auth error for 403, got nil")
+		t.Fatal("expected forbidden error for 403, got nil")
 	}
 
-	if !errors.Is(err, ErrAuth) {
-		t.Errorf("expected ErrAuth for 403, got %v", err)
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected ErrForbidden for 403, got %v", err)
+	}
+	if errors.Is(err, ErrAuth) {
+		t.Errorf("403 should not be classified as ErrAuth, got %v", err)
+	}
+}
+
+func TestAuthVersusForbiddenRendering(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "LiteLLM:")
+	for _, tt := range []struct {
+		status int
+		want   string
+	}{
+		{http.StatusUnauthorized, "Auth error"},
+		{http.StatusForbidden, "No permission"},
+	} {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			t.Setenv("LITELLM_PROXY_URL", "")
+			t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+			_, err := getKeyInfo("some-token")
+			got := stripANSI(renderLine(nil, "", StatusInput{}, err))
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("status %d: expected %q, got %q", tt.status, tt.want, got)
+			}
+
+			// The negative cache replays the same classification without a request.
+			_, err = getKeyInfo("some-token")
+			if got := stripANSI(renderLine(nil, "", StatusInput{}, err)); !strings.Contains(got, tt.want) {
+				t.Errorf("status %d (cached): expected %q, got %q", tt.status, tt.want, got)
+			}
+		})
 	}
 }
 
+func TestGetKeyInfoForbiddenUserInfoFallback(t *testing.T) {
+	userInfo := `{"user_id":"u1","user_info":{"spend":12.5,"max_budget":50,"budget_duration":"30d"}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/key/info":
+			w.WriteHeader(http.StatusForbidden)
+		case "/user/info":
+			_, _ = w.Write([]byte(userInfo))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_USER_INFO_FALLBACK", "")
+		if _, err := getKeyInfo("some-token"); !errors.Is(err, ErrForbidden) {
+			t.Errorf("expected ErrForbidden without fallback, got %v", err)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_USER_INFO_FALLBACK", "1")
+		info, err := getKeyInfo("some-token")
+		if err != nil {
+			t.Fatalf("expected fallback to succeed, got %v", err)
+		}
+		if info.TeamSpend == nil || *info.TeamSpend != 12.5 || info.TeamMaxBudget == nil || *info.TeamMaxBudget != 50 {
+			t.Errorf("expected user budget 12.5/50, got %+v", info)
+		}
+		if derefString(info.TeamBudgetDuration) != "30d" {
+			t.Errorf("expected duration 30d, got %q", derefString(info.TeamBudgetDuration))
+		}
+	})
+
+	t.Run("stringified money", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_USER_INFO_FALLBACK", "1")
+		userInfo = `{"user_id":"u1","user_info":{"spend":"1.5","max_budget":"50.00"}}`
+		info, err := getKeyInfo("some-token")
+		if err != nil {
+			t.Fatalf("expected fallback to succeed, got %v", err)
+		}
+		if info.TeamSpend == nil || *info.TeamSpend != 1.5 || info.TeamMaxBudget == nil || *info.TeamMaxBudget != 50 {
+			t.Errorf("expected user budget 1.5/50, got %+v", info)
+		}
+	})
+}
+
 func TestGetKeyInfoBudgetExceeded(t *testing.T) {
 	t.Setenv("XDG_CACHE_HOME", t.TempDir())
 
@@ -969,6 +1327,33 @@ func TestGetPrefix(t *testing.T) {
 			t.Errorf("expected 'Budget ', got %q", got)
 		}
 	})
+	t.Run("custom label replaces LiteLLM", func(t *testing.T) {
+		if err := os.Unsetenv("LITELLM_PLUGIN_PREFIX"); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("LITELLM_LABEL", "AI Budget")
+		if got := getPrefix(StatusInput{}); got != "AI Budget: " {
+			t.Errorf("expected 'AI Budget: ', got %q", got)
+		}
+	})
+	t.Run("empty label drops prefix", func(t *testing.T) {
+		if err := os.Unsetenv("LITELLM_PLUGIN_PREFIX"); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("LITELLM_LABEL", "")
+		if got := getPrefix(StatusInput{}); got != "" {
+			t.Errorf("expected empty prefix, got %q", got)
+		}
+	})
+	t.Run("model name beats label", func(t *testing.T) {
+		if err := os.Unsetenv("LITELLM_PLUGIN_PREFIX"); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("LITELLM_LABEL", "AI Budget")
+		if got := getPrefix(modelInput("Opus 4.7")); got != "Opus 4.7: " {
+			t.Errorf("expected 'Opus 4.7: ', got %q", got)
+		}
+	})
 }
 
 func TestFormatStatusLineShowCost(t *testing.T) {
@@ -1034,7 +1419,7 @@ func TestUpdateCacheExpiry(t *testing.T) {
 
 	// Write a stale cache entry (timestamp 2 hours in the past, beyond the 1h TTL)
 	staleEntry := UpdateCacheEntry{
-		Timestamp:     time.Now().Add(-2 * time.Hour).UnixMilli(),
+		Timestamp:     nowFunc().Add(-2 * time.Hour).UnixMilli(),
 		LatestVersion: "v1.0.0",
 	}
 	staleData, err := json.Marshal(staleEntry)
@@ -1082,6 +1467,121 @@ func TestBudgetCacheReadWrite(t *testing.T) {
 	}
 }
 
+func TestMetadataLabel(t *testing.T) {
+	var info KeyInfo
+	body := `{"spend":1,"metadata":{"cost_center":"marketing","tier":2,"billable":true,"owner":null,"tags":{"a":"b"},"blank":" "}}`
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"cost_center", "marketing", true},
+		{"tier", "2", true},
+		{"billable", "true", true},
+		{"owner", "", false},
+		{"tags", "", false},
+		{"blank", "", false},
+		{"missing", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			t.Setenv("LITELLM_SHOW_METADATA_KEY", tt.key)
+			got, ok := metadataLabel(&info)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("metadataLabel() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	t.Run("no metadata", func(t *testing.T) {
+		t.Setenv("LITELLM_SHOW_METADATA_KEY", "cost_center")
+		if got, ok := metadataLabel(&KeyInfo{}); ok {
+			t.Errorf("expected no label without metadata, got %q", got)
+		}
+	})
+}
+
+func TestFormatStatusLineMetadataSegment(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "LiteLLM:")
+	t.Setenv("LITELLM_SHOW_METADATA_KEY", "cost_center")
+	spend, budget := 10.0, 100.0
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, Metadata: map[string]any{"cost_center": "marketing"}}
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); !strings.HasPrefix(got, "LiteLLM: [marketing] ◔ 10%") {
+		t.Errorf("expected the label after the prefix, got %q", got)
+	}
+
+	info.Metadata = nil
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); !strings.HasPrefix(got, "LiteLLM: ◔ 10%") {
+		t.Errorf("expected no label without the field, got %q", got)
+	}
+}
+
+func TestCacheDirOverride(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", "/tmp/xdg")
+	t.Setenv("LITELLM_CACHE_DIR", dir)
+	if got := cacheDir(); got != dir {
+		t.Errorf("cacheDir() = %q, want %q", got, dir)
+	}
+
+	spend, budget := 42.0, 100.0
+	writeBudgetCache(&KeyInfo{Spend: &spend, MaxBudget: &budget})
+	if _, err := os.Stat(filepath.Join(dir, "budget-"+cacheKey()+".json")); err != nil {
+		t.Errorf("expected the budget cache in LITELLM_CACHE_DIR: %v", err)
+	}
+
+	t.Setenv("LITELLM_CACHE_DIR", "")
+	if got := cacheDir(); got != "/tmp/xdg/claude-code-litellm" {
+		t.Errorf("cacheDir() = %q, want the XDG location when unset", got)
+	}
+}
+
+func TestBudgetCacheUnwritableDir(t *testing.T) {
+	// A directory under a regular file can't be created, even as root.
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LITELLM_CACHE_DIR", filepath.Join(file, "cache"))
+	t.Setenv("LITELLM_DEBUG", "1")
+	var logs bytes.Buffer
+	origDebug := debugOut
+	debugOut = &logs
+	origMem := memCache
+	memCache = nil
+	t.Cleanup(func() {
+		debugOut = origDebug
+		memCache = origMem
+	})
+
+	spend, budget := 42.0, 100.0
+	writeBudgetCache(&KeyInfo{Spend: &spend, MaxBudget: &budget})
+	got, ok := readBudgetCache()
+	if !ok || got.Spend == nil || *got.Spend != 42.0 {
+		t.Fatalf("expected the in-memory cache to serve the write, got %v, %v", got, ok)
+	}
+	if !strings.Contains(logs.String(), "caching in memory") {
+		t.Errorf("expected a debug warning about the fallback, got %q", logs.String())
+	}
+
+	writeBudgetFailCache(errors.New("connection refused"))
+	if _, ok := readBudgetFailEntry(); !ok {
+		t.Error("expected the failure record in memory")
+	}
+	clearBudgetFailCache()
+	if _, ok := readBudgetFailEntry(); ok {
+		t.Error("expected clearing to drop the in-memory failure record")
+	}
+	if n := strings.Count(logs.String(), "caching in memory"); n != 1 {
+		t.Errorf("expected the warning once, got %d", n)
+	}
+}
+
 func TestResolveEffectiveBudget(t *testing.T) {
 	keySpend := 10.0
 	keyBudget := 50.0
@@ -1227,7 +1727,7 @@ func TestFetchTeamInfo(t *testing.T) {
 	t.Setenv("LITELLM_PROXY_URL", "")
 	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
 
-	data, err := fetchTeamInfo("test-token", "team-123")
+	data, err := fetchTeamInfo(getBaseURL(), "test-token", "team-123")
 	if err != nil {
 		t.Fatalf("fetchTeamInfo() error = %v", err)
 	}
@@ -1572,64 +2072,218 @@ func TestWriteBudgetCacheConcurrent(t *testing.T) {
 	}
 }
 
-// TestGetKeyInfoNegativeCache verifies a failed fetch is negative-cached so the next
-// refresh within the window does not re-hit the network (H1).
-func TestGetKeyInfoNegativeCache(t *testing.T) {
+// TestGetKeyInfoSingleflight verifies overlapping refreshes for the same key share
+// one in-flight request.
+func TestGetKeyInfoSingleflight(t *testing.T) {
 	t.Setenv("XDG_CACHE_HOME", t.TempDir())
 
-	callCount := 0
+	var callCount atomic.Int32
+	release := make(chan struct{})
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		callCount++
-		w.WriteHeader(http.StatusInternalServerError)
+		callCount.Add(1)
+		<-release
+		_, _ = w.Write([]byte(`{"info":{"spend":12.5,"max_budget":100}}`))
 	}))
 	defer server.Close()
 
 	t.Setenv("LITELLM_PROXY_URL", "")
 	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
 
-	if _, err := getKeyInfo("test-token"); err == nil {
-		t.Fatal("expected error on first call")
+	const callers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := getKeyInfo("test-token")
+			if err == nil && (info.Spend == nil || *info.Spend != 12.5) {
+				err = fmt.Errorf("unexpected info %+v", info)
+			}
+			errs <- err
+		}()
 	}
-	if _, err := getKeyInfo("test-token"); err == nil {
-		t.Fatal("expected error on second call")
+	// Hold the response until the first request has arrived, so the callers overlap.
+	for callCount.Load() == 0 {
+		time.Sleep(time.Millisecond)
 	}
-	if callCount != 1 {
-		t.Errorf("expected 1 API call (negative cache suppresses the retry), got %d", callCount)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := callCount.Load(); n != 1 {
+		t.Errorf("expected 1 API call shared by %d callers, got %d", callers, n)
 	}
 }
 
-// TestGetKeyInfoNegativeCachePreservesAuthError verifies the replayed error still
-// satisfies errors.Is(ErrAuth) after being reconstructed from the negative cache (H1).
-func TestGetKeyInfoNegativeCachePreservesAuthError(t *testing.T) {
+func TestOrgKeyInfo(t *testing.T) {
+	t.Setenv("LITELLM_ORG_BUDGET", "$1000")
+	var report []OrgSpendReportEntry
+	body := `[
+		{"group_by_day": "2025-06-01", "teams": [{"team_name": "ml", "total_spend": 100.5}, {"team_name": "web", "total_spend": 20}]},
+		{"group_by_day": "2025-06-02", "total_spend": 29.5}
+	]`
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatal(err)
+	}
+	info := orgKeyInfo(report, fixedNow)
+	if info.TeamSpend == nil || *info.TeamSpend != 150 {
+		t.Errorf("expected the days and teams summed to 150, got %v", info.TeamSpend)
+	}
+	if info.TeamMaxBudget == nil || *info.TeamMaxBudget != 1000 {
+		t.Errorf("expected LITELLM_ORG_BUDGET as the budget, got %v", info.TeamMaxBudget)
+	}
+	if got := derefString(info.TeamBudgetResetAt); got != "2025-07-01T00:00:00Z" {
+		t.Errorf("expected the reset at the start of next month, got %q", got)
+	}
+
+	t.Setenv("LITELLM_ORG_BUDGET", "")
+	if info := orgKeyInfo(report, fixedNow); info.TeamMaxBudget != nil {
+		t.Errorf("expected no budget without LITELLM_ORG_BUDGET, got %v", *info.TeamMaxBudget)
+	}
+}
+
+func TestGetBudgetInfoOrgScope(t *testing.T) {
+	setNow(t, fixedNow)
 	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_SCOPE", "org")
+	t.Setenv("LITELLM_ORG_BUDGET", "1000")
 
 	callCount := 0
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		callCount++
-		w.WriteHeader(http.StatusUnauthorized)
+		if r.URL.Path != "/global/spend/report" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.URL.Query(); got.Get("start_date") != "2025-06-01" || got.Get("end_date") != "2025-06-16" {
+			t.Errorf("expected the current month, got %s", r.URL.RawQuery)
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`[{"group_by_day": "2025-06-14", "teams": [{"team_name": "ml", "total_spend": 800}, {"team_name": "web", "total_spend": 120}]}]`))
 	}))
 	defer server.Close()
-
 	t.Setenv("LITELLM_PROXY_URL", "")
 	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
 
-	_, err1 := getKeyInfo("bad-token")
-	if !errors.Is(err1, ErrAuth) {
-		t.Fatalf("expected ErrAuth on first call, got %v", err1)
+	info, err := getBudgetInfo("sk-admin")
+	if err != nil {
+		t.Fatal(err)
 	}
-	_, err2 := getKeyInfo("bad-token")
-	if !errors.Is(err2, ErrAuth) {
-		t.Errorf("expected ErrAuth replayed from negative cache, got %v", err2)
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); !strings.Contains(got, "● 92%") {
+		t.Errorf("expected the org spend against the org budget, got %q", got)
 	}
-	if callCount != 1 {
-		t.Errorf("expected 1 API call (auth failure negative-cached), got %d", callCount)
+	if _, err := getBudgetInfo("sk-admin"); err != nil || callCount != 1 {
+		t.Errorf("expected the second lookup from cache, got %d calls, %v", callCount, err)
 	}
-}
-
-// TestUpdateCacheNegativeBackoff verifies an empty (failed/rate-limited) update check
-// is still cached so the next refresh backs off instead of re-calling GitHub (H1).
-func TestUpdateCacheNegativeBackoff(t *testing.T) {
-	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	t.Run("cache age and quiet fallback read the org cache", func(t *testing.T) {
+		t.Setenv("LITELLM_SHOW_AGE", "1")
+		t.Setenv("LITELLM_QUIET_ERRORS", "1")
+		keySpend, keyBudget := 5.0, 10.0
+		writeAgedBudgetCache(t, KeyInfo{TeamSpend: &keySpend, TeamMaxBudget: &keyBudget}, 3*time.Hour)
+		setNow(t, fixedNow.Add(2*time.Minute))
+		if got := stripANSI(formatAgeSegment()); got != " | 2m ago" {
+			t.Errorf("expected the org report's age, got %q", got)
+		}
+		cached, ok := quietFallback(fmt.Errorf("connection error: dial tcp: connection refused"))
+		if !ok || cached.TeamSpend == nil || *cached.TeamSpend != 920 {
+			t.Errorf("expected the cached org spend 920, got %+v", cached)
+		}
+	})
+
+	t.Run("no org budget shows the spend", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_ORG_BUDGET", "")
+		t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+		info, err := getBudgetInfo("sk-admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stripANSI(formatStatusLine(info, "", StatusInput{})); got != "$920.00 this month monthly reset: 15d12h" {
+			t.Errorf("expected the org spend without a budget, got %q", got)
+		}
+		if out := buildStatusJSON(info, "", StatusInput{}, nil); out.Error != "" || out.Spend != 920 || out.HasBudget {
+			t.Errorf("expected the spend without an error, got %+v", out)
+		}
+		if code := budgetExitCode(info, nil); code != ExitOK {
+			t.Errorf("expected ExitOK, got %d", code)
+		}
+	})
+
+	t.Run("non-admin key", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		status = http.StatusForbidden
+		if _, err := getBudgetInfo("sk-user"); !errors.Is(err, ErrForbidden) {
+			t.Errorf("expected ErrForbidden, got %v", err)
+		}
+	})
+}
+
+// TestGetKeyInfoNegativeCache verifies a failed fetch is negative-cached so the next
+// refresh within the window does not re-hit the network (H1).
+func TestGetKeyInfoNegativeCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		callCount++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	if _, err := getKeyInfo("test-token"); err == nil {
+		t.Fatal("expected error on first call")
+	}
+	if _, err := getKeyInfo("test-token"); err == nil {
+		t.Fatal("expected error on second call")
+	}
+	if callCount != 1 {
+		t.Errorf("expected 1 API call (negative cache suppresses the retry), got %d", callCount)
+	}
+}
+
+// TestGetKeyInfoNegativeCachePreservesAuthError verifies the replayed error still
+// satisfies errors.Is(ErrAuth) after being reconstructed from the negative cache (H1).
+func TestGetKeyInfoNegativeCachePreservesAuthError(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		callCount++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	_, err1 := getKeyInfo("bad-token")
+	if !errors.Is(err1, ErrAuth) {
+		t.Fatalf("expected ErrAuth on first call, got %v", err1)
+	}
+	_, err2 := getKeyInfo("bad-token")
+	if !errors.Is(err2, ErrAuth) {
+		t.Errorf("expected ErrAuth replayed from negative cache, got %v", err2)
+	}
+	if callCount != 1 {
+		t.Errorf("expected 1 API call (auth failure negative-cached), got %d", callCount)
+	}
+}
+
+// TestUpdateCacheNegativeBackoff verifies an empty (failed/rate-limited) update check
+// is still cached so the next refresh backs off instead of re-calling GitHub (H1).
+func TestUpdateCacheNegativeBackoff(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
 
 	writeUpdateCache("")
 	v, ok := readUpdateCache()
@@ -1708,6 +2362,13 @@ func TestBuildStatusJSON(t *testing.T) {
 		}
 	})
 
+	t.Run("forbidden", func(t *testing.T) {
+		out := buildStatusJSON(nil, "", StatusInput{}, fmt.Errorf("status=403: %w", ErrForbidden))
+		if out.Error != "no permission" {
+			t.Errorf("expected 'no permission', got %q", out.Error)
+		}
+	})
+
 	t.Run("connection error", func(t *testing.T) {
 		out := buildStatusJSON(nil, "", StatusInput{}, fmt.Errorf("dial tcp: connection refused"))
 		if out.Error != "connection error" {
@@ -1806,6 +2467,27 @@ func TestBuildStatusJSONNoAPIKey(t *testing.T) {
 	}
 }
 
+func TestStatusJSONSchemaVersion(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	spend, budget := 20.0, 100.0
+	for name, out := range map[string]StatusJSON{
+		"success": buildStatusJSON(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{}, nil),
+		"error":   buildStatusJSON(nil, "", StatusInput{}, ErrAuth),
+	} {
+		var raw map[string]any
+		if err := json.Unmarshal([]byte(marshalStatusJSON(out)), &raw); err != nil {
+			t.Fatal(err)
+		}
+		v, ok := raw["schema_version"].(float64)
+		if !ok || v != math.Trunc(v) || v < 1 {
+			t.Errorf("%s: expected an integer schema_version, got %v", name, raw["schema_version"])
+		}
+		if int(v) != StatusJSONSchemaVersion {
+			t.Errorf("%s: schema_version = %v, want %d", name, v, StatusJSONSchemaVersion)
+		}
+	}
+}
+
 // TestOutputModeParity asserts that the --json text field and the stdout terminal
 // output render the same content (modulo ANSI color codes) across every render
 // state. This is the guard that prevents the two output modes from drifting.
@@ -1820,7 +2502,8 @@ func TestOutputModeParity(t *testing.T) {
 	spend95 := 95.0
 	budget50 := 50.0
 	budget100 := 100.0
-	resetAt := time.Now().UTC().Add(48 * time.Hour).Format(time.RFC3339)
+	setNow(t, fixedNow)
+	resetAt := fixedNow.Add(48 * time.Hour).Format(time.RFC3339)
 	weekly := "7d"
 
 	ctxPct := 45.0
@@ -1968,3 +2651,4813 @@ func TestOutputModeParity(t *testing.T) {
 		})
 	}
 }
+
+// writeAgedBudgetCache writes a budget cache entry whose timestamp is age in the past,
+// for exercising the stale/expired cache paths.
+func writeAgedBudgetCache(t *testing.T, info KeyInfo, age time.Duration) {
+	t.Helper()
+	entry := BudgetCacheEntry{Timestamp: nowFunc().Add(-age).UnixMilli(), Info: info}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(cacheDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(budgetCacheFile(), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuietFallback(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "https://quiet.example")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-q")
+
+	connErr := fmt.Errorf("connection error: dial tcp: connection refused")
+
+	t.Run("error when nothing cached", func(t *testing.T) {
+		t.Setenv("LITELLM_QUIET_ERRORS", "1")
+		if _, ok := quietFallback(connErr); ok {
+			t.Error("expected no fallback with an empty cache")
+		}
+	})
+
+	spend := 40.0
+	budget := 100.0
+	writeAgedBudgetCache(t, KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, time.Hour)
+
+	t.Run("stale cache served on transient error", func(t *testing.T) {
+		t.Setenv("LITELLM_QUIET_ERRORS", "1")
+		got, ok := quietFallback(connErr)
+		if !ok {
+			t.Fatal("expected stale fallback on connection error")
+		}
+		if got.TeamSpend == nil || *got.TeamSpend != 40.0 {
+			t.Errorf("expected cached spend 40, got %v", got.TeamSpend)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Setenv("LITELLM_QUIET_ERRORS", "")
+		if _, ok := quietFallback(connErr); ok {
+			t.Error("expected no fallback when quiet mode is off")
+		}
+	})
+
+	t.Run("auth errors are never masked", func(t *testing.T) {
+		t.Setenv("LITELLM_QUIET_ERRORS", "1")
+		if _, ok := quietFallback(fmt.Errorf("status=401: %w", ErrAuth)); ok {
+			t.Error("expected auth error to surface even in quiet mode")
+		}
+	})
+}
+
+func TestRunDuringCooldown(t *testing.T) {
+	setNow(t, fixedNow)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "http://127.0.0.1:1")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-cooldown")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_QUIET_ERRORS", "")
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+
+	render := func() string {
+		t.Helper()
+		run([]string{"-file-only"})
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatalf("expected status file, got %v", err)
+		}
+		return string(data)
+	}
+	openBreaker := func(kind string) {
+		writeBudgetFailEntry(&BudgetFailEntry{
+			Timestamp: nowFunc().UnixMilli(),
+			Failures:  1,
+			Kind:      kind,
+			Message:   "connection error: dial tcp: connection refused",
+		})
+	}
+
+	t.Run("nothing cached shows the error", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		openBreaker("transport")
+		if got := stripANSI(render()); !strings.Contains(got, "Connection error") {
+			t.Errorf("expected the replayed error, got %q", got)
+		}
+	})
+
+	t.Run("cached budget is shown dimmed", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		spend, budget := 40.0, 100.0
+		writeAgedBudgetCache(t, KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, time.Hour)
+		openBreaker("transport")
+		got := render()
+		if !strings.HasPrefix(got, ColorGray) || !strings.Contains(stripANSI(got), "40%") {
+			t.Errorf("expected the cached budget in gray, got %q", got)
+		}
+	})
+
+	t.Run("auth errors still surface", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		spend, budget := 40.0, 100.0
+		writeAgedBudgetCache(t, KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, time.Hour)
+		openBreaker("auth")
+		if got := stripANSI(render()); !strings.Contains(got, "Auth error") {
+			t.Errorf("expected the auth error during cooldown, got %q", got)
+		}
+	})
+}
+
+func TestRenderStaleLine(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+
+	spend := 95.0
+	budget := 100.0
+	got := renderStaleLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})
+
+	if !strings.HasPrefix(got, ColorGray) {
+		t.Errorf("expected stale line to be gray, got %q", got)
+	}
+	if strings.Contains(got, ColorRed) {
+		t.Errorf("stale line must not carry threshold colors, got %q", got)
+	}
+	if !strings.Contains(got, "95%") {
+		t.Errorf("expected cached percent in stale line, got %q", got)
+	}
+}
+
+// TestGetKeyInfoStaleWhileRevalidate verifies an expired-but-recent cache entry is
+// returned immediately while a background refresh updates the cache.
+func TestGetKeyInfoStaleWhileRevalidate(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	freshSpend := 50.0
+	budget := 100.0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_ = json.NewEncoder(w).Encode(KeyInfoResponse{Info: KeyInfo{Spend: &freshSpend, MaxBudget: &budget}})
+	}))
+	defer server.Close()
+
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	staleSpend := 40.0
+	writeAgedBudgetCache(t, KeyInfo{Spend: &staleSpend, MaxBudget: &budget}, time.Minute)
+
+	start := time.Now()
+	info, err := getKeyInfo("test-token")
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("getKeyInfo() error = %v", err)
+	}
+	if elapsed >= 300*time.Millisecond {
+		t.Errorf("expected stale entry without waiting on the refresh, took %v", elapsed)
+	}
+	if info.Spend == nil || *info.Spend != staleSpend {
+		t.Errorf("expected stale spend %v, got %v", staleSpend, info.Spend)
+	}
+
+	revalidations.Wait()
+	got, ok := readBudgetCache()
+	if !ok {
+		t.Fatal("expected background refresh to write a fresh cache entry")
+	}
+	if got.Spend == nil || *got.Spend != freshSpend {
+		t.Errorf("expected refreshed spend %v, got %v", freshSpend, got.Spend)
+	}
+}
+
+// TestRunDetachesRevalidation verifies a one-shot run hands the stale-while-revalidate
+// refresh to a child process instead of waiting for it before exiting, and that the
+// child (-revalidate) refreshes the cache.
+func TestRunDetachesRevalidation(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "test-token")
+	t.Setenv("LITELLM_OUTPUT_FILE", filepath.Join(t.TempDir(), "status.txt"))
+	origFileOnly := outputFileOnly
+	t.Cleanup(func() { outputFileOnly = origFileOnly })
+
+	freshSpend, budget := 50.0, 100.0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_ = json.NewEncoder(w).Encode(KeyInfoResponse{Info: KeyInfo{Spend: &freshSpend, MaxBudget: &budget}})
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	spawned := 0
+	orig := spawnRevalidation
+	t.Cleanup(func() { spawnRevalidation = orig })
+	spawnRevalidation = func() error {
+		spawned++
+		return nil
+	}
+
+	staleSpend := 40.0
+	writeAgedBudgetCache(t, KeyInfo{Spend: &staleSpend, MaxBudget: &budget}, time.Minute)
+	start := time.Now()
+	run([]string{"-file-only"})
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("expected run to exit without waiting on the refresh, took %v", elapsed)
+	}
+	if spawned != 1 {
+		t.Errorf("expected one background refresh process, got %d", spawned)
+	}
+	if detachRevalidation {
+		t.Error("expected detachRevalidation to be reset after run")
+	}
+
+	if code := run([]string{"-revalidate"}); code != ExitOK {
+		t.Errorf("expected ExitOK from -revalidate, got %d", code)
+	}
+	got, ok := readBudgetCache()
+	if !ok || got.Spend == nil || *got.Spend != freshSpend {
+		t.Errorf("expected -revalidate to cache the fresh spend %v, got %+v", freshSpend, got)
+	}
+}
+
+// TestRevalidationLease verifies stale reads from separate invocations start a single
+// -revalidate child between them, and that a lease left by a dead child is taken over.
+func TestRevalidationLease(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "https://lease.example")
+	t.Setenv("LITELLM_PROXY_API_KEY", "test-token")
+
+	spawned := 0
+	orig := spawnRevalidation
+	t.Cleanup(func() { spawnRevalidation = orig })
+	spawnRevalidation = func() error {
+		spawned++
+		return nil
+	}
+	detachRevalidation = true
+	t.Cleanup(func() { detachRevalidation = false })
+
+	spend, budget := 40.0, 100.0
+	writeAgedBudgetCache(t, KeyInfo{Spend: &spend, MaxBudget: &budget}, time.Minute)
+	for i := range 2 {
+		if _, err := getKeyInfo("test-token"); err != nil {
+			t.Fatalf("stale read %d: %v", i, err)
+		}
+	}
+	if spawned != 1 {
+		t.Errorf("expected one -revalidate child for two stale reads, got %d", spawned)
+	}
+
+	old := time.Now().Add(-2 * RevalidateLease)
+	if err := os.Chtimes(revalidateLeaseFile(), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getKeyInfo("test-token"); err != nil {
+		t.Fatal(err)
+	}
+	if spawned != 2 {
+		t.Errorf("expected an expired lease to be taken over, got %d children", spawned)
+	}
+
+	releaseRevalidation()
+	if _, err := os.Stat(revalidateLeaseFile()); !os.IsNotExist(err) {
+		t.Errorf("expected the lease removed on release, got %v", err)
+	}
+}
+
+// TestGetKeyInfoBeyondStaleWindowFetches verifies entries older than StaleTTLMs are
+// not served; the caller blocks on a fresh fetch instead.
+func TestGetKeyInfoBeyondStaleWindowFetches(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	freshSpend := 50.0
+	budget := 100.0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(KeyInfoResponse{Info: KeyInfo{Spend: &freshSpend, MaxBudget: &budget}})
+	}))
+	defer server.Close()
+
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	staleSpend := 40.0
+	writeAgedBudgetCache(t, KeyInfo{Spend: &staleSpend, MaxBudget: &budget}, time.Hour)
+
+	info, err := getKeyInfo("test-token")
+	if err != nil {
+		t.Fatalf("getKeyInfo() error = %v", err)
+	}
+	if info.Spend == nil || *info.Spend != freshSpend {
+		t.Errorf("expected fresh spend %v, got %v", freshSpend, info.Spend)
+	}
+}
+
+func TestGetKeyInfoMonitoredTeam(t *testing.T) {
+	teamSpend := 400.0
+	teamBudget := 1000.0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/key/info":
+			_ = json.NewEncoder(w).Encode(KeyInfoResponse{})
+		case "/team/info":
+			if r.URL.Query().Get("team_id") != "team-eng" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(TeamInfoAPIResponse{
+				TeamInfo: TeamInfoData{Spend: &teamSpend, MaxBudget: &teamBudget},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	t.Run("team totals populated", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_TEAM_ID", "team-eng")
+		info, err := getKeyInfo("test-token")
+		if err != nil {
+			t.Fatalf("getKeyInfo() error = %v", err)
+		}
+		if info.TeamTotalSpend == nil || *info.TeamTotalSpend != teamSpend {
+			t.Errorf("expected TeamTotalSpend=%v, got %v", teamSpend, info.TeamTotalSpend)
+		}
+		if info.TeamTotalMaxBudget == nil || *info.TeamTotalMaxBudget != teamBudget {
+			t.Errorf("expected TeamTotalMaxBudget=%v, got %v", teamBudget, info.TeamTotalMaxBudget)
+		}
+	})
+
+	t.Run("missing team is not an error", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_TEAM_ID", "team-gone")
+		info, err := getKeyInfo("test-token")
+		if err != nil {
+			t.Fatalf("expected missing team to degrade gracefully, got %v", err)
+		}
+		if info.TeamTotalMaxBudget != nil {
+			t.Errorf("expected no team totals, got %v", *info.TeamTotalMaxBudget)
+		}
+	})
+}
+
+func TestFormatTeamSegment(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+
+	spend := 25.0
+	budget := 100.0
+	teamSpend := 400.0
+	teamBudget := 1000.0
+	info := &KeyInfo{
+		TeamSpend:          &spend,
+		TeamMaxBudget:      &budget,
+		TeamTotalSpend:     &teamSpend,
+		TeamTotalMaxBudget: &teamBudget,
+	}
+
+	t.Run("dollar amounts with show cost", func(t *testing.T) {
+		t.Setenv("LITELLM_PLUGIN_SHOW_COST", "1")
+		got := stripANSI(formatStatusLine(info, "", StatusInput{}))
+		if !strings.Contains(got, "| team $400.00/$1000.00") {
+			t.Errorf("expected team segment, got %q", got)
+		}
+	})
+
+	t.Run("percent only by default", func(t *testing.T) {
+		t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+		got := stripANSI(formatStatusLine(info, "", StatusInput{}))
+		if !strings.Contains(got, "| team 40%") {
+			t.Errorf("expected team percent segment, got %q", got)
+		}
+	})
+
+	t.Run("omitted without team totals", func(t *testing.T) {
+		got := formatTeamSegment(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget})
+		if got != "" {
+			t.Errorf("expected no team segment, got %q", got)
+		}
+	})
+}
+
+func TestBuildLogfmt(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+
+	spend := 25.0
+	budget := 100.0
+	setNow(t, fixedNow)
+	resetAt := fixedNow.Add(time.Hour).Format(time.RFC3339)
+
+	t.Run("budget fields", func(t *testing.T) {
+		info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamBudgetResetAt: &resetAt, KeyAlias: strPtr("prod")}
+		got := buildLogfmt(info, "", StatusInput{}, nil)
+		for _, want := range []string{"spend=25.00", "max_budget=100.00", "percent=25", "reset_seconds=3600", "alias=prod"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("expected %q in %q", want, got)
+			}
+		}
+		if strings.Contains(got, "error=") {
+			t.Errorf("expected no error field, got %q", got)
+		}
+	})
+
+	t.Run("values with spaces are quoted", func(t *testing.T) {
+		info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, KeyAlias: strPtr("my prod key")}
+		got := buildLogfmt(info, "", StatusInput{}, nil)
+		if !strings.Contains(got, `alias="my prod key"`) {
+			t.Errorf("expected quoted alias, got %q", got)
+		}
+	})
+
+	t.Run("auth error", func(t *testing.T) {
+		got := buildLogfmt(nil, "", StatusInput{}, fmt.Errorf("status=401: %w", ErrAuth))
+		if got != "error=auth" {
+			t.Errorf("expected error=auth, got %q", got)
+		}
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		got := buildLogfmt(nil, "", StatusInput{}, fmt.Errorf("status=403: %w", ErrForbidden))
+		if got != "error=forbidden" {
+			t.Errorf("expected error=forbidden, got %q", got)
+		}
+	})
+
+	t.Run("no cached data", func(t *testing.T) {
+		got := buildLogfmt(nil, "", StatusInput{}, ErrNoCachedData)
+		if got != "error=no_cached_data" {
+			t.Errorf("expected error=no_cached_data, got %q", got)
+		}
+	})
+
+	t.Run("no budget configured", func(t *testing.T) {
+		got := buildLogfmt(&KeyInfo{Spend: &spend}, "", StatusInput{}, nil)
+		if !strings.Contains(got, "error=no_budget") {
+			t.Errorf("expected error=no_budget, got %q", got)
+		}
+	})
+}
+
+func TestGetOutputMode(t *testing.T) {
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{"", "text"},
+		{"logfmt", "logfmt"},
+		{"LOGFMT", "logfmt"},
+		{"json", "json"},
+		{"bogus", "text"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LITELLM_OUTPUT", tt.val)
+		if got := getOutputMode(); got != tt.want {
+			t.Errorf("getOutputMode() with %q = %q, want %q", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestKeyInfoUnmarshalFlexibleSpend(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		wantSpend     *float64
+		wantMaxBudget *float64
+		wantErr       bool
+	}{
+		{
+			name:          "numeric encoding",
+			body:          `{"spend":25.5,"max_budget":100}`,
+			wantSpend:     f64(25.5),
+			wantMaxBudget: f64(100),
+		},
+		{
+			name:          "string encoding",
+			body:          `{"spend":"25.00","max_budget":"100.00"}`,
+			wantSpend:     f64(25),
+			wantMaxBudget: f64(100),
+		},
+		{
+			name:          "null encoding",
+			body:          `{"spend":null,"max_budget":null}`,
+			wantSpend:     nil,
+			wantMaxBudget: nil,
+		},
+		{
+			name:      "absent fields",
+			body:      `{"key_alias":"prod"}`,
+			wantSpend: nil,
+		},
+		{
+			name:    "non-numeric string",
+			body:    `{"spend":"lots"}`,
+			wantErr: true,
+		},
+	}
+
+	eq := func(a, b *float64) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return *a == *b
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var info KeyInfo
+			err := json.Unmarshal([]byte(tt.body), &info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !eq(info.Spend, tt.wantSpend) {
+				t.Errorf("Spend = %v, want %v", info.Spend, tt.wantSpend)
+			}
+			if !eq(info.MaxBudget, tt.wantMaxBudget) {
+				t.Errorf("MaxBudget = %v, want %v", info.MaxBudget, tt.wantMaxBudget)
+			}
+		})
+	}
+
+	t.Run("other fields still decode", func(t *testing.T) {
+		var resp KeyInfoResponse
+		if err := json.Unmarshal([]byte(`{"info":{"spend":"1.5","team_id":"t1","key_alias":"prod"}}`), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Info.TeamID == nil || *resp.Info.TeamID != "t1" {
+			t.Errorf("expected team_id t1, got %v", resp.Info.TeamID)
+		}
+		if resp.Info.Spend == nil || *resp.Info.Spend != 1.5 {
+			t.Errorf("expected spend 1.5, got %v", resp.Info.Spend)
+		}
+	})
+}
+
+// TestTeamInfoUnmarshalFlexibleSpend covers proxies that stringify money in
+// /team/info and in key/info team_memberships.
+func TestTeamInfoUnmarshalFlexibleSpend(t *testing.T) {
+	var team TeamInfoAPIResponse
+	body := `{"team_info":{"spend":"9.50","max_budget":"100","team_member_budget_table":{"max_budget":"65.00","budget_duration":"7d"}}}`
+	if err := json.Unmarshal([]byte(body), &team); err != nil {
+		t.Fatalf("Unmarshal /team/info error = %v", err)
+	}
+	if team.TeamInfo.Spend == nil || *team.TeamInfo.Spend != 9.5 {
+		t.Errorf("Spend = %v, want 9.5", team.TeamInfo.Spend)
+	}
+	if team.TeamInfo.MaxBudget == nil || *team.TeamInfo.MaxBudget != 100 {
+		t.Errorf("MaxBudget = %v, want 100", team.TeamInfo.MaxBudget)
+	}
+	table := team.TeamInfo.TeamMemberBudgetTable
+	if table == nil || table.MaxBudget == nil || *table.MaxBudget != 65 {
+		t.Fatalf("TeamMemberBudgetTable = %+v, want max_budget 65", table)
+	}
+	if table.BudgetDuration == nil || *table.BudgetDuration != "7d" {
+		t.Errorf("BudgetDuration = %v, want 7d", table.BudgetDuration)
+	}
+
+	var m TeamMembership
+	if err := json.Unmarshal([]byte(`{"team_id":"t1","spend":"4.00","litellm_budget_table":{"max_budget":"65"}}`), &m); err != nil {
+		t.Fatalf("Unmarshal membership error = %v", err)
+	}
+	if m.TeamID != "t1" || m.Spend == nil || *m.Spend != 4 {
+		t.Errorf("membership = %+v, want team t1 with spend 4", m)
+	}
+	if m.LitellmBudgetTable == nil || m.LitellmBudgetTable.MaxBudget == nil || *m.LitellmBudgetTable.MaxBudget != 65 {
+		t.Errorf("LitellmBudgetTable = %+v, want max_budget 65", m.LitellmBudgetTable)
+	}
+
+	if err := json.Unmarshal([]byte(`{"team_info":{"spend":"lots"}}`), &team); err == nil {
+		t.Error("expected an error for a non-numeric spend")
+	}
+}
+
+func TestGetCacheTTLMs(t *testing.T) {
+	tests := []struct {
+		val  string
+		want int64
+	}{
+		{"", CacheTTLMs},
+		{"0", 0},
+		{"120000", 120_000},
+		{"-5", CacheTTLMs},
+		{"soon", CacheTTLMs},
+	}
+	for _, tt := range tests {
+		t.Setenv("LITELLM_CACHE_TTL_MS", tt.val)
+		if got := getCacheTTLMs(); got != tt.want {
+			t.Errorf("getCacheTTLMs() with %q = %d, want %d", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestGetKeyInfoConfigurableTTL(t *testing.T) {
+	callCount := 0
+	spend := 25.0
+	budget := 100.0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		callCount++
+		_ = json.NewEncoder(w).Encode(KeyInfoResponse{Info: KeyInfo{Spend: &spend, MaxBudget: &budget}})
+	}))
+	defer server.Close()
+
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	t.Run("zero TTL fetches every call", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_CACHE_TTL_MS", "0")
+		callCount = 0
+		for i := 0; i < 3; i++ {
+			if _, err := getKeyInfo("test-token"); err != nil {
+				t.Fatalf("getKeyInfo() error = %v", err)
+			}
+		}
+		if callCount != 3 {
+			t.Errorf("expected 3 API calls with caching disabled, got %d", callCount)
+		}
+	})
+
+	t.Run("large TTL serves cache", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_CACHE_TTL_MS", "3600000")
+		callCount = 0
+		writeAgedBudgetCache(t, KeyInfo{Spend: &spend, MaxBudget: &budget}, 10*time.Minute)
+		if _, err := getKeyInfo("test-token"); err != nil {
+			t.Fatalf("getKeyInfo() error = %v", err)
+		}
+		if callCount != 0 {
+			t.Errorf("expected 10-minute-old entry to be served under a 1h TTL, got %d calls", callCount)
+		}
+	})
+}
+
+func TestCrossedCritical(t *testing.T) {
+	tests := []struct {
+		name    string
+		prev    float64
+		hasPrev bool
+		cur     float64
+		want    bool
+	}{
+		{"below to above crosses", 85, true, 92, true},
+		{"exactly at threshold crosses", 89.9, true, 90, true},
+		{"still above does not re-fire", 92, true, 95, false},
+		{"stays below", 50, true, 80, false},
+		{"drops below", 95, true, 40, false},
+		{"first run above counts", 0, false, 95, true},
+		{"first run below", 0, false, 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := crossedCritical(tt.prev, tt.hasPrev, tt.cur); got != tt.want {
+				t.Errorf("crossedCritical(%v, %v, %v) = %v, want %v", tt.prev, tt.hasPrev, tt.cur, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBudgetNotification(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "https://notify.example")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-n")
+	t.Setenv("LITELLM_NOTIFY", "1")
+
+	var sent []string
+	orig := desktopNotifier
+	defer func() { desktopNotifier = orig }()
+	desktopNotifier = func(_, message string) error {
+		sent = append(sent, message)
+		return nil
+	}
+
+	budget := 100.0
+	at := func(spend float64) *KeyInfo {
+		return &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+	}
+
+	writeNotifyState(80) // previous invocation was below critical
+	checkBudgetNotification(at(91))
+	checkBudgetNotification(at(93)) // debounced: still above
+	if len(sent) != 1 {
+		t.Fatalf("expected exactly 1 notification on crossing, got %d: %v", len(sent), sent)
+	}
+	if !strings.Contains(sent[0], "91%") {
+		t.Errorf("expected percent in message, got %q", sent[0])
+	}
+
+	checkBudgetNotification(at(50)) // drop below (e.g. budget reset)
+	checkBudgetNotification(at(95)) // cross again
+	if len(sent) != 2 {
+		t.Errorf("expected a second notification after re-crossing, got %d", len(sent))
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Setenv("LITELLM_NOTIFY", "")
+		writeNotifyState(10)
+		checkBudgetNotification(at(99))
+		if len(sent) != 2 {
+			t.Errorf("expected no notification with LITELLM_NOTIFY unset, got %d", len(sent))
+		}
+	})
+}
+
+func TestOnCritHook(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "https://hook.example")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-hook")
+	t.Setenv("LITELLM_NOTIFY", "")
+	t.Setenv("LITELLM_ON_CRIT", "post-to-slack")
+
+	var calls [][]string
+	orig := critHook
+	defer func() { critHook = orig }()
+	critHook = func(command string, env []string, done func(int, error)) error {
+		calls = append(calls, append([]string{command}, env...))
+		done(1, errors.New("exit status 1"))
+		return nil
+	}
+
+	budget := 100.0
+	at := func(spend float64) *KeyInfo {
+		return &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+	}
+
+	writeNotifyState(80)
+	checkBudgetNotification(at(91))
+	checkBudgetNotification(at(95)) // still critical: no second run
+	if len(calls) != 1 {
+		t.Fatalf("expected the hook to run once per crossing, got %d: %v", len(calls), calls)
+	}
+	if calls[0][0] != "post-to-slack" || !slices.Contains(calls[0], "LITELLM_PERCENT=91.00") || !slices.Contains(calls[0], "LITELLM_MAX_BUDGET=100") {
+		t.Errorf("expected the command with budget env, got %v", calls[0])
+	}
+
+	checkBudgetNotification(at(40)) // budget reset
+	checkBudgetNotification(at(92))
+	if len(calls) != 2 {
+		t.Errorf("expected the hook again after re-crossing, got %d", len(calls))
+	}
+
+	t.Run("failing hook is only logged", func(t *testing.T) {
+		t.Setenv("LITELLM_DEBUG", "1")
+		var logs strings.Builder
+		origDebug := debugOut
+		debugOut = &logs
+		defer func() { debugOut = origDebug }()
+		writeNotifyState(10)
+		checkBudgetNotification(at(99))
+		if !strings.Contains(logs.String(), "LITELLM_ON_CRIT exited with status 1") {
+			t.Errorf("expected the exit status in the debug log, got %q", logs.String())
+		}
+	})
+}
+
+// TestOnCritHookOneShot verifies a one-shot run hands the hook to a -run-hook helper,
+// and that the helper waits for the command and logs its exit status.
+func TestOnCritHookOneShot(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "https://hook.example")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-hook")
+	t.Setenv("LITELLM_NOTIFY", "")
+	t.Setenv("LITELLM_ON_CRIT", "post-to-slack")
+
+	var hookCalls int
+	origHook := critHook
+	t.Cleanup(func() { critHook = origHook })
+	critHook = func(command string, env []string, done func(int, error)) error {
+		hookCalls++
+		go done(2, errors.New("exit status 2"))
+		return nil
+	}
+	var helperEnv []string
+	origSpawn := spawnHookRunner
+	t.Cleanup(func() { spawnHookRunner = origSpawn })
+	spawnHookRunner = func(env []string) error {
+		helperEnv = env
+		return nil
+	}
+
+	detachRevalidation = true
+	t.Cleanup(func() { detachRevalidation = false })
+	budget, spend := 100.0, 95.0
+	writeNotifyState(10)
+	checkBudgetNotification(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget})
+	if hookCalls != 0 || !slices.Contains(helperEnv, "LITELLM_PERCENT=95.00") {
+		t.Errorf("expected the hook handed to the helper with its env, got %d direct calls and env %v", hookCalls, helperEnv)
+	}
+	detachRevalidation = false
+
+	t.Setenv("LITELLM_DEBUG", "1")
+	var logs strings.Builder
+	origDebug := debugOut
+	t.Cleanup(func() { debugOut = origDebug })
+	debugOut = &logs
+	if code := run([]string{"-run-hook"}); code != ExitOK {
+		t.Errorf("expected ExitOK from -run-hook, got %d", code)
+	}
+	if hookCalls != 1 || !strings.Contains(logs.String(), "LITELLM_ON_CRIT exited with status 2") {
+		t.Errorf("expected the helper to run the hook and log its status, got %d calls and %q", hookCalls, logs.String())
+	}
+}
+
+func TestStartShellHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell command")
+	}
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	report := func(code int, err error) { done <- result{code, err} }
+
+	if err := startShellHook(`test "$LITELLM_PERCENT" = 91 && exit 3`, []string{"LITELLM_PERCENT=91"}, report); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-done; r.code != 3 || r.err == nil {
+		t.Errorf("expected exit status 3 with the env set, got %d (%v)", r.code, r.err)
+	}
+
+	// A hook that backgrounds a long-running child must not hold up the caller.
+	start := time.Now()
+	if err := startShellHook("sleep 8 & echo started", nil, report); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected startShellHook to return immediately, took %v", elapsed)
+	}
+	select {
+	case <-done:
+	case <-time.After(HookTimeout):
+		t.Errorf("expected the hook to be reaped without waiting for its background child")
+	}
+}
+
+func TestNotifyCommand(t *testing.T) {
+	tests := []struct {
+		goos string
+		want string
+	}{
+		{"linux", "notify-send"},
+		{"darwin", "osascript"},
+		{"windows", "powershell"},
+	}
+	for _, tt := range tests {
+		cmd := notifyCommand(tt.goos, "title", `say "hi"`)
+		if cmd == nil {
+			t.Fatalf("expected notifier for %s", tt.goos)
+		}
+		if !strings.HasSuffix(cmd.Path, tt.want) && cmd.Args[0] != tt.want {
+			t.Errorf("notifyCommand(%s) = %v, want %s", tt.goos, cmd.Args, tt.want)
+		}
+	}
+	if notifyCommand("plan9", "t", "m") != nil {
+		t.Error("expected nil notifier for unsupported platform")
+	}
+}
+
+func TestFormatTimeUntilResetClockSkew(t *testing.T) {
+	var logs strings.Builder
+	orig := debugOut
+	defer func() { debugOut = orig }()
+	debugOut = &logs
+
+	setNow(t, fixedNow)
+	farFuture := fixedNow.Add(400 * 24 * time.Hour).Format(time.RFC3339)
+	soon := fixedNow.Add(5 * time.Hour).Format(time.RFC3339)
+
+	t.Run("far-future reset with short duration", func(t *testing.T) {
+		t.Setenv("LITELLM_DEBUG", "1")
+		logs.Reset()
+		got, label := formatTimeUntilReset(&farFuture, strPtr("1d"))
+		if got != "?" {
+			t.Errorf("expected '?' for implausible reset, got %q", got)
+		}
+		if label != "daily" {
+			t.Errorf("expected label preserved, got %q", label)
+		}
+		if !strings.Contains(logs.String(), "clock skew") {
+			t.Errorf("expected clock-skew debug warning, got %q", logs.String())
+		}
+	})
+
+	t.Run("far-future reset without duration", func(t *testing.T) {
+		if got, _ := formatTimeUntilReset(&farFuture, nil); got != "?" {
+			t.Errorf("expected '?' beyond MaxPlausibleReset, got %q", got)
+		}
+	})
+
+	t.Run("plausible reset unaffected", func(t *testing.T) {
+		if got, _ := formatTimeUntilReset(&soon, strPtr("1d")); got == "?" || got == "" {
+			t.Errorf("expected normal countdown, got %q", got)
+		}
+	})
+
+	t.Run("no debug output when disabled", func(t *testing.T) {
+		t.Setenv("LITELLM_DEBUG", "")
+		logs.Reset()
+		formatTimeUntilReset(&farFuture, strPtr("1d"))
+		if logs.Len() != 0 {
+			t.Errorf("expected no debug output, got %q", logs.String())
+		}
+	})
+}
+
+func TestFormatStatusLineAlertBudget(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+
+	budget := 100.0
+
+	t.Run("spend below alert budget", func(t *testing.T) {
+		t.Setenv("LITELLM_ALERT_BUDGET", "20")
+		spend := 10.0
+		got := formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})
+		if !strings.Contains(got, ColorGreen) {
+			t.Errorf("expected green below alert budget, got %q", got)
+		}
+		if strings.Contains(got, "over alert") {
+			t.Errorf("expected no alert marker, got %q", got)
+		}
+	})
+
+	t.Run("spend above alert budget forces warning color", func(t *testing.T) {
+		t.Setenv("LITELLM_ALERT_BUDGET", "20")
+		spend := 25.0 // only 25% of the key budget
+		got := formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})
+		if strings.Contains(got, ColorGreen) {
+			t.Errorf("expected no green once over alert budget, got %q", got)
+		}
+		if !strings.Contains(got, ColorYellow) {
+			t.Errorf("expected yellow once over alert budget, got %q", got)
+		}
+		if !strings.Contains(got, "⚠ over alert") {
+			t.Errorf("expected alert marker, got %q", got)
+		}
+	})
+
+	t.Run("red stays red", func(t *testing.T) {
+		t.Setenv("LITELLM_ALERT_BUDGET", "20")
+		spend := 95.0
+		got := formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})
+		if !strings.Contains(got, ColorRed) {
+			t.Errorf("expected red to win over alert yellow, got %q", got)
+		}
+	})
+
+	t.Run("invalid alert budget ignored", func(t *testing.T) {
+		t.Setenv("LITELLM_ALERT_BUDGET", "lots")
+		if _, ok := getAlertBudget(); ok {
+			t.Error("expected invalid alert budget to be ignored")
+		}
+	})
+}
+
+func TestLoadLocation(t *testing.T) {
+	var logs strings.Builder
+	orig := debugOut
+	defer func() { debugOut = orig }()
+	debugOut = &logs
+	t.Setenv("LITELLM_DEBUG", "1")
+
+	t.Run("valid zone", func(t *testing.T) {
+		loc := loadLocation("Europe/Berlin")
+		if loc.String() != "Europe/Berlin" {
+			t.Errorf("expected Europe/Berlin, got %s", loc)
+		}
+	})
+
+	t.Run("empty uses local", func(t *testing.T) {
+		if loc := loadLocation(""); loc != time.Local {
+			t.Errorf("expected time.Local, got %s", loc)
+		}
+	})
+
+	t.Run("invalid zone falls back with warning", func(t *testing.T) {
+		logs.Reset()
+		loc := loadLocation("Not/AZone")
+		if loc != time.Local {
+			t.Errorf("expected fallback to time.Local, got %s", loc)
+		}
+		if !strings.Contains(logs.String(), "Not/AZone") {
+			t.Errorf("expected debug warning naming the zone, got %q", logs.String())
+		}
+	})
+}
+
+func TestSafeRatePerHour(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	in10h := now.Add(10 * time.Hour).Format(time.RFC3339)
+	past := now.Add(-time.Hour).Format(time.RFC3339)
+	spend := 85.0
+	over := 120.0
+	budget := 100.0
+
+	tests := []struct {
+		name   string
+		info   *KeyInfo
+		want   float64
+		wantOK bool
+	}{
+		{"remaining spread over hours", &KeyInfo{Spend: &spend, MaxBudget: &budget, BudgetResetAt: &in10h}, 1.5, true},
+		{"nil spend counts as zero", &KeyInfo{MaxBudget: &budget, BudgetResetAt: &in10h}, 10, true},
+		{"exhausted budget", &KeyInfo{Spend: &over, MaxBudget: &budget, BudgetResetAt: &in10h}, 0, true},
+		{"no budget", &KeyInfo{Spend: &spend, BudgetResetAt: &in10h}, 0, false},
+		{"no reset", &KeyInfo{Spend: &spend, MaxBudget: &budget}, 0, false},
+		{"reset in the past", &KeyInfo{Spend: &spend, MaxBudget: &budget, BudgetResetAt: &past}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := safeRatePerHour(tt.info, now)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (got < tt.want-1e-9 || got > tt.want+1e-9) {
+				t.Errorf("rate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatStatusLineSafeRate(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	spend := 85.0
+	budget := 100.0
+	setNow(t, fixedNow)
+	resetAt := fixedNow.Add(10 * time.Hour).Format(time.RFC3339)
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamBudgetResetAt: &resetAt}
+
+	t.Setenv("LITELLM_SHOW_SAFE_RATE", "1")
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); !strings.Contains(got, "| $1.50/h left") {
+		t.Errorf("expected safe rate segment, got %q", got)
+	}
+
+	t.Setenv("LITELLM_SHOW_SAFE_RATE", "")
+	if got := formatStatusLine(info, "", StatusInput{}); strings.Contains(got, "/h left") {
+		t.Errorf("expected no safe rate segment by default, got %q", got)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/config.json"
+	sample := `{"env":{"LITELLM_PLUGIN_SHOW_COST":"1","LITELLM_CACHE_TTL_MS":"60000","LITELLM_LABEL":"AI Budget"}}`
+	if err := os.WriteFile(path, []byte(sample), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("loads sample config", func(t *testing.T) {
+		cfg, err := loadConfig(path, true)
+		if err != nil {
+			t.Fatalf("loadConfig() error = %v", err)
+		}
+		if cfg.Env["LITELLM_CACHE_TTL_MS"] != "60000" {
+			t.Errorf("expected TTL from config, got %+v", cfg.Env)
+		}
+	})
+
+	t.Run("env takes precedence over file", func(t *testing.T) {
+		// t.Setenv registers a restore, so applyConfig's os.Setenv doesn't leak.
+		for _, key := range []string{"LITELLM_PLUGIN_SHOW_COST", "LITELLM_CACHE_TTL_MS"} {
+			t.Setenv(key, "")
+			if err := os.Unsetenv(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Setenv("LITELLM_LABEL", "From Env")
+		cfg, err := loadConfig(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		applyConfig(cfg)
+		if got := os.Getenv("LITELLM_LABEL"); got != "From Env" {
+			t.Errorf("expected env to win, got %q", got)
+		}
+		if got := getCacheTTLMs(); got != 60_000 {
+			t.Errorf("expected file default for unset var, got %d", got)
+		}
+	})
+
+	t.Run("missing default file is fine", func(t *testing.T) {
+		cfg, err := loadConfig(dir+"/nope.json", false)
+		if err != nil || cfg == nil {
+			t.Errorf("expected empty config for missing default file, got %v, %v", cfg, err)
+		}
+	})
+
+	t.Run("missing explicit file is an error", func(t *testing.T) {
+		if _, err := loadConfig(dir+"/nope.json", true); err == nil {
+			t.Error("expected error for missing -config file")
+		}
+	})
+
+	t.Run("malformed file is an error", func(t *testing.T) {
+		bad := dir + "/bad.json"
+		if err := os.WriteFile(bad, []byte("{not json"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(bad, false); err == nil {
+			t.Error("expected parse error")
+		}
+	})
+}
+
+func TestLoadConfigTyped(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	sample := `{"output": "logfmt", "show_cost": true, "alert_budget": 25.5, "cache_ttl_ms": 0,
+		"retries": 1, "meta_color": "cyan", "env": {"LITELLM_OUTPUT": "json", "LITELLM_SHOW_RPM": "1"}}`
+	if err := os.WriteFile(path, []byte(sample), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	want := map[string]string{
+		"LITELLM_OUTPUT":           "logfmt",
+		"LITELLM_PLUGIN_SHOW_COST": "1",
+		"LITELLM_ALERT_BUDGET":     "25.5",
+		"LITELLM_CACHE_TTL_MS":     "0",
+		"LITELLM_RETRIES":          "1",
+		"LITELLM_META_COLOR":       "cyan",
+	}
+	if got := cfg.vars(); !maps.Equal(got, want) {
+		t.Errorf("vars() = %v, want %v", got, want)
+	}
+
+	for _, key := range []string{"LITELLM_OUTPUT", "LITELLM_SHOW_RPM", "LITELLM_PLUGIN_SHOW_COST", "LITELLM_ALERT_BUDGET", "LITELLM_CACHE_TTL_MS", "LITELLM_RETRIES", "LITELLM_META_COLOR"} {
+		t.Setenv(key, "")
+		if err := os.Unsetenv(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("LITELLM_RETRIES", "3")
+	applyConfig(cfg)
+	if got := getOutputMode(); got != "logfmt" {
+		t.Errorf("expected the typed field to win over the env block, got %q", got)
+	}
+	if !isShowRPMEnabled() || getCacheTTLMs() != 0 {
+		t.Errorf("expected the env block and a zero TTL to apply, got rpm=%v ttl=%d", isShowRPMEnabled(), getCacheTTLMs())
+	}
+	if got := os.Getenv("LITELLM_RETRIES"); got != "3" {
+		t.Errorf("expected the environment to win over the file, got %q", got)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"cache_ttl_ms": "1m"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(bad, true); err == nil {
+		t.Error("expected a wrongly typed field to be a parse error")
+	}
+}
+
+// TestRunConfigErrorOutputMode verifies a config error is reported in the selected
+// output format rather than as ANSI text.
+func TestRunConfigErrorOutputMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+
+	tests := []struct {
+		mode string
+		args []string
+		want string
+	}{
+		{"", []string{"-json"}, `"error":"config error"`},
+		{"logfmt", nil, "error=config"},
+		{"tmux", nil, "Config error#[default]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			t.Setenv("LITELLM_OUTPUT", tt.mode)
+			if code := run(append([]string{"-file-only", "-color=always", "-config", path}, tt.args...)); code != ExitOK {
+				t.Errorf("expected ExitOK, got %d", code)
+			}
+			data, _ := os.ReadFile(out)
+			if !strings.Contains(string(data), tt.want) || strings.Contains(string(data), "\x1b[") {
+				t.Errorf("expected %q without ANSI, got %q", tt.want, data)
+			}
+		})
+	}
+}
+
+func TestRunConfigNoColor(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-test")
+	t.Setenv("NO_COLOR", "")
+	if err := os.Unsetenv("NO_COLOR"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"no_color": true}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+	orig, origPlain := outputFileOnly, plainOutput
+	defer func() { outputFileOnly, plainOutput = orig, origPlain }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"info": {"spend": 1, "max_budget": 10}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	run([]string{"-file-only", "-config", path})
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "\x1b[") {
+		t.Errorf("expected no_color from the config file to disable color, got %q", data)
+	}
+}
+
+func TestConfigFilePath(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "/tmp/xdg")
+	if got := configFile(); got != "/tmp/xdg/litellm-statusline/config.json" {
+		t.Errorf("configFile() = %q", got)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want cliOptions
+	}{
+		{nil, cliOptions{color: "auto"}},
+		{[]string{"--json"}, cliOptions{json: true, color: "auto"}},
+		{[]string{"-v"}, cliOptions{version: true, color: "auto"}},
+		{[]string{"--version"}, cliOptions{version: true, color: "auto"}},
+		{[]string{"-config", "/etc/x.json", "--json"}, cliOptions{json: true, configPath: "/etc/x.json", color: "auto"}},
+		{[]string{"--color=never"}, cliOptions{color: "never"}},
+	}
+	for _, tt := range tests {
+		got, err := parseArgs(tt.args)
+		if err != nil {
+			t.Fatalf("parseArgs(%v) error = %v", tt.args, err)
+		}
+		if got != tt.want {
+			t.Errorf("parseArgs(%v) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+	if _, err := parseArgs([]string{"-color", "sometimes"}); err == nil {
+		t.Error("expected an error for an invalid -color value")
+	}
+}
+
+func TestWriteVerbose(t *testing.T) {
+	spend, budget := 12.3456789, 100.0
+	teamSpend, teamBudget := 400.125, 1000.0
+	var buf strings.Builder
+	writeVerbose(&buf, &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamTotalSpend: &teamSpend, TeamTotalMaxBudget: &teamBudget})
+	want := "litellm verbose: spend=12.3456789 max_budget=100 percent=12.345679\n" +
+		"litellm verbose: team_spend=400.125 team_max_budget=1000\n"
+	if buf.String() != want {
+		t.Errorf("writeVerbose() = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	writeVerbose(&buf, &KeyInfo{TeamMaxBudget: &budget})
+	if buf.String() != "litellm verbose: spend=null max_budget=100 percent=0.000000\n" {
+		t.Errorf("expected a null spend to be reported as such, got %q", buf.String())
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	t.Setenv("LITELLM_CACHE_TTL_MS", "")
+	var buf bytes.Buffer
+	writeManifest(&buf)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("expected valid JSON, got %v: %q", err, buf.String())
+	}
+	for _, key := range []string{"name", "version", "type", "command", "refresh_interval_ms"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("manifest is missing %q: %v", key, got)
+		}
+	}
+	if got["name"] != "claude-code-litellm-plugin" || got["version"] != Version || got["type"] != "command" {
+		t.Errorf("unexpected manifest identity: %v", got)
+	}
+	if cmd, _ := got["command"].(string); cmd == "" {
+		t.Errorf("expected a command, got %v", got["command"])
+	}
+	if got["refresh_interval_ms"] != float64(CacheTTLMs) {
+		t.Errorf("expected the refresh interval to match the cache TTL, got %v", got["refresh_interval_ms"])
+	}
+}
+
+func TestUseColor(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		noColor string
+		vtErr   error
+		want    bool
+	}{
+		{"default", "auto", "", nil, true},
+		{"NO_COLOR set", "auto", "1", nil, false},
+		{"virtual terminal unavailable", "auto", "", errors.New("access denied"), false},
+		{"both", "auto", "1", errors.New("access denied"), false},
+		{"always beats NO_COLOR", "always", "1", nil, true},
+		{"always beats virtual terminal", "always", "", errors.New("access denied"), true},
+		{"never", "never", "", nil, false},
+	}
+	for _, tt := range tests {
+		if got := useColor(tt.mode, tt.noColor, tt.vtErr); got != tt.want {
+			t.Errorf("%s: useColor(%q, %q, %v) = %v, want %v", tt.name, tt.mode, tt.noColor, tt.vtErr, got, tt.want)
+		}
+	}
+	if err := enableVirtualTerminal(); err != nil {
+		t.Errorf("enableVirtualTerminal() on a non-console stdout should succeed, got %v", err)
+	}
+}
+
+func TestFailBackoffMs(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     int64
+	}{
+		{0, 10_000},
+		{1, 10_000},
+		{2, 20_000},
+		{3, 40_000},
+		{5, 160_000},
+		{6, BudgetFailMaxTTLMs},
+		{50, BudgetFailMaxTTLMs},
+	}
+	for _, tt := range tests {
+		if got := failBackoffMs(tt.failures); got != tt.want {
+			t.Errorf("failBackoffMs(%d) = %d, want %d", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// expireBudgetFailCache backdates the negative-cache record just past its window,
+// simulating the next statusline refresh after the backoff has elapsed.
+func expireBudgetFailCache(t *testing.T) {
+	t.Helper()
+	entry, ok := readBudgetFailEntry()
+	if !ok {
+		t.Fatal("expected a negative-cache record")
+	}
+	entry.Timestamp -= failBackoffMs(entry.Failures)
+	data, _ := json.Marshal(entry)
+	if err := os.WriteFile(budgetFailCacheFile(), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGetKeyInfoProgressiveBackoff verifies consecutive failures across invocations
+// widen the negative-cache window instead of restarting it, and that a success resets it.
+func TestGetKeyInfoProgressiveBackoff(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_CACHE_TTL_MS", "0")
+
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"info": {"spend": 1, "max_budget": 10}}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	var prevWait int64
+	for i := 1; i <= 4; i++ {
+		if _, err := getKeyInfo("test-token"); err == nil {
+			t.Fatalf("iteration %d: expected error", i)
+		}
+		entry, ok := readBudgetFailEntry()
+		if !ok {
+			t.Fatalf("iteration %d: expected a negative-cache record", i)
+		}
+		if entry.Failures != i {
+			t.Errorf("iteration %d: Failures = %d, want %d", i, entry.Failures, i)
+		}
+		wait := failBackoffMs(entry.Failures)
+		if wait <= prevWait {
+			t.Errorf("iteration %d: backoff %dms did not increase from %dms", i, wait, prevWait)
+		}
+		prevWait = wait
+		expireBudgetFailCache(t)
+	}
+
+	failing = false
+	if _, err := getKeyInfo("test-token"); err != nil {
+		t.Fatalf("expected success once the proxy recovers, got %v", err)
+	}
+	if _, ok := readBudgetFailEntry(); ok {
+		t.Error("expected a successful fetch to clear the failure streak")
+	}
+}
+
+// TestWriteBudgetFailCacheStreakExpires verifies a failure long after the previous
+// streak ended starts over at the base window.
+func TestWriteBudgetFailCacheStreakExpires(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	old := BudgetFailEntry{
+		Timestamp: nowFunc().Add(-time.Hour).UnixMilli(),
+		Failures:  6,
+		Kind:      "transport",
+	}
+	data, _ := json.Marshal(old)
+	if err := os.MkdirAll(cacheDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(budgetFailCacheFile(), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	writeBudgetFailCache(errors.New("connection refused"))
+	entry, ok := readBudgetFailEntry()
+	if !ok {
+		t.Fatal("expected a negative-cache record")
+	}
+	if entry.Failures != 1 {
+		t.Errorf("Failures = %d, want 1 (stale streak should reset)", entry.Failures)
+	}
+}
+
+func TestBindingConstraint(t *testing.T) {
+	member := func(spend, budget float64) *KeyInfo {
+		return &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+	}
+	withTeam := func(info *KeyInfo, spend, budget float64) *KeyInfo {
+		info.TeamTotalSpend = &spend
+		info.TeamTotalMaxBudget = &budget
+		return info
+	}
+
+	tests := []struct {
+		name        string
+		info        *KeyInfo
+		wantTag     string
+		wantPercent float64
+		wantOK      bool
+	}{
+		{"member only", member(25, 100), "", 25, true},
+		{"member binds", withTeam(member(80, 100), 400, 1000), "", 80, true},
+		{"team binds", withTeam(member(25, 100), 950, 1000), "team", 95, true},
+		{"tie goes to member", withTeam(member(50, 100), 500, 1000), "", 50, true},
+		{"team without budget ignored", withTeam(member(25, 100), 10, 0), "", 25, true},
+		{"no member budget", withTeam(&KeyInfo{}, 950, 1000), "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := bindingConstraint(tt.info)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got.Tag != tt.wantTag || got.percent() != tt.wantPercent {
+				t.Errorf("got %q at %.0f%%, want %q at %.0f%%", got.Tag, got.percent(), tt.wantTag, tt.wantPercent)
+			}
+		})
+	}
+}
+
+func TestFormatStatusLineBindingConstraint(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+
+	spend, budget := 25.0, 100.0
+
+	t.Run("team total drives color and percent", func(t *testing.T) {
+		teamSpend, teamBudget := 950.0, 1000.0
+		info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamTotalSpend: &teamSpend, TeamTotalMaxBudget: &teamBudget}
+		got := formatStatusLine(info, "", StatusInput{})
+		if !strings.HasPrefix(got, ColorRed) {
+			t.Errorf("expected red from the team total, got %q", got)
+		}
+		if plain := stripANSI(got); !strings.HasPrefix(plain, "● 95% (team)") {
+			t.Errorf("expected team-tagged percent, got %q", plain)
+		}
+		if out := buildStatusJSON(info, "", StatusInput{}, nil); out.Binding != "team" || out.Percent != 95 {
+			t.Errorf("expected JSON binding=team at 95%%, got %q at %v%%", out.Binding, out.Percent)
+		}
+	})
+
+	t.Run("member budget untagged", func(t *testing.T) {
+		teamSpend, teamBudget := 100.0, 1000.0
+		info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamTotalSpend: &teamSpend, TeamTotalMaxBudget: &teamBudget}
+		got := stripANSI(formatStatusLine(info, "", StatusInput{}))
+		if !strings.HasPrefix(got, "◔ 25% |") {
+			t.Errorf("expected untagged member percent, got %q", got)
+		}
+	})
+
+	t.Run("show cost follows binding limit", func(t *testing.T) {
+		t.Setenv("LITELLM_PLUGIN_SHOW_COST", "1")
+		teamSpend, teamBudget := 950.0, 1000.0
+		info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamTotalSpend: &teamSpend, TeamTotalMaxBudget: &teamBudget}
+		got := stripANSI(formatStatusLine(info, "", StatusInput{}))
+		if !strings.Contains(got, "$950.00/$1000.00 (95%) (team)") {
+			t.Errorf("expected team dollar figures, got %q", got)
+		}
+	})
+}
+
+func TestWriteExplanation(t *testing.T) {
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	budget := 100.0
+
+	explain := func(info *KeyInfo, err error) string {
+		var stderr strings.Builder
+		writeExplanation(&stderr, info, err)
+		return stderr.String()
+	}
+
+	t.Run("warn threshold", func(t *testing.T) {
+		spend := 80.0
+		got := explain(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, nil)
+		if !strings.Contains(got, "yellow because 80% ≥ warn 75%") {
+			t.Errorf("expected warn threshold named, got %q", got)
+		}
+		if !strings.Contains(got, "member budget binds: $80.00 of $100.00") {
+			t.Errorf("expected binding budget named, got %q", got)
+		}
+	})
+
+	t.Run("crit threshold from team", func(t *testing.T) {
+		spend, teamSpend, teamBudget := 10.0, 950.0, 1000.0
+		got := explain(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamTotalSpend: &teamSpend, TeamTotalMaxBudget: &teamBudget}, nil)
+		if !strings.Contains(got, "team budget binds") || !strings.Contains(got, "red because 95% ≥ crit 90%") {
+			t.Errorf("expected team crit explanation, got %q", got)
+		}
+	})
+
+	t.Run("alert budget override", func(t *testing.T) {
+		t.Setenv("LITELLM_ALERT_BUDGET", "20")
+		spend := 25.0
+		got := explain(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, nil)
+		if !strings.Contains(got, "yellow instead because spend $25.00 > alert budget $20.00") {
+			t.Errorf("expected alert override explained, got %q", got)
+		}
+	})
+
+	t.Run("fetch error", func(t *testing.T) {
+		got := explain(nil, ErrAuth)
+		if !strings.Contains(got, "red because the fetch failed") {
+			t.Errorf("expected error explanation, got %q", got)
+		}
+	})
+}
+
+func TestFetchKeyInfoCompressedResponse(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+
+	payload := []byte(`{"info": {"spend": 12.5, "max_budget": 100}}`)
+	gzipped := func() []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(payload)
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	deflated := func() []byte {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		_, _ = zw.Write(payload)
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", gzipped()},
+		{"deflate", deflated()},
+		{"", payload},
+	}
+	for _, tt := range tests {
+		t.Run("encoding="+tt.encoding, func(t *testing.T) {
+			var acceptEncoding string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", "application/json")
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				_, _ = w.Write(tt.body)
+			}))
+			defer server.Close()
+			t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+			info, err := fetchKeyInfo("test-token")
+			if err != nil {
+				t.Fatalf("expected compressed body to decode, got %v", err)
+			}
+			if info.Spend == nil || *info.Spend != 12.5 {
+				t.Errorf("expected spend 12.5, got %v", info.Spend)
+			}
+			if !strings.Contains(acceptEncoding, "gzip") {
+				t.Errorf("expected Accept-Encoding to advertise gzip, got %q", acceptEncoding)
+			}
+		})
+	}
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			_, _ = w.Write([]byte("not json"))
+		}))
+		defer server.Close()
+		t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+		if _, err := fetchKeyInfo("test-token"); err == nil || !strings.Contains(err.Error(), "Content-Encoding") {
+			t.Errorf("expected unsupported encoding error, got %v", err)
+		}
+	})
+}
+
+func TestFetchKeyInfoRetriesResetConnection(t *testing.T) {
+	t.Setenv("LITELLM_RETRIES", "")
+	var (
+		mu      sync.Mutex
+		remotes []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remotes = append(remotes, r.RemoteAddr)
+		first := len(remotes) == 1
+		mu.Unlock()
+		if first {
+			// Reset the first connection: SO_LINGER 0 makes Close send an RST.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.(*net.TCPConn).SetLinger(0)
+			_ = conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte(`{"info": {"spend": 3}}`))
+	}))
+	defer server.Close()
+	seen := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(remotes)
+	}
+
+	info, err := fetchKeyInfoFrom(server.URL, "test-token")
+	if err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if info.Spend == nil || *info.Spend != 3 {
+		t.Errorf("expected spend from the retry, got %+v", info)
+	}
+	if got := seen(); len(got) != 2 || got[0] == got[1] {
+		t.Errorf("expected the retry on a new connection, got requests from %v", got)
+	}
+
+	t.Run("retries disabled", func(t *testing.T) {
+		t.Setenv("LITELLM_RETRIES", "0")
+		mu.Lock()
+		remotes = nil
+		mu.Unlock()
+		// Start on a new connection: net/http itself retries a request that fails on a
+		// reused keep-alive connection.
+		newAPIClient().CloseIdleConnections()
+		if _, err := fetchKeyInfoFrom(server.URL, "test-token"); err == nil || !isConnReset(err) {
+			t.Errorf("expected the reset to be returned, got %v", err)
+		}
+		if got := seen(); len(got) != 1 {
+			t.Errorf("expected a single attempt, got %d", len(got))
+		}
+	})
+}
+
+func TestIsConnReset(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{fmt.Errorf("connection error: %w", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{fmt.Errorf("connection error: %w", io.EOF), true},
+		{errors.New("wsarecv: An existing connection was forcibly closed by the remote host."), true},
+		{fmt.Errorf("connection error: %w", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), false},
+		{errors.New("connection error: context deadline exceeded (Client.Timeout exceeded)"), false},
+	}
+	for _, tt := range tests {
+		if got := isConnReset(tt.err); got != tt.want {
+			t.Errorf("isConnReset(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFetchKeyInfoJSONErrorResponse(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+	orig := retrySleep
+	defer func() { retrySleep = orig }()
+	retrySleep = func(time.Duration) {}
+
+	const transient = `{"error":{"message":"temporarily unavailable"}}`
+	const permanent = `{"error":{"message":"invalid request","type":"invalid_request_error"}}`
+	const ok = `{"info": {"spend": 1}}`
+
+	tests := []struct {
+		name      string
+		retries   string
+		bodies    []string // one per call; the last repeats
+		wantCalls int
+		check     func(*testing.T, *KeyInfo, error)
+	}{
+		{"transient then success", "", []string{transient, ok}, 2, func(t *testing.T, info *KeyInfo, err error) {
+			if err != nil || info.Spend == nil || *info.Spend != 1 {
+				t.Errorf("expected the retry to succeed, got %+v, %v", info, err)
+			}
+		}},
+		{"transient every time", "2", []string{transient}, 3, func(t *testing.T, _ *KeyInfo, err error) {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || !apiErr.Transient() {
+				t.Errorf("expected the transient APIError, got %v", err)
+			}
+			if errors.Is(err, ErrBadResponse) {
+				t.Errorf("transient errors should not be ErrBadResponse, got %v", err)
+			}
+		}},
+		{"retries disabled", "0", []string{transient, ok}, 1, func(t *testing.T, _ *KeyInfo, err error) {
+			if err == nil {
+				t.Error("expected the error without retries")
+			}
+		}},
+		{"permanent", "", []string{permanent, ok}, 1, func(t *testing.T, _ *KeyInfo, err error) {
+			if !errors.Is(err, ErrBadResponse) || !strings.Contains(err.Error(), "invalid request") {
+				t.Errorf("expected ErrBadResponse carrying the message, got %v", err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LITELLM_RETRIES", tt.retries)
+			callCount := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.bodies[min(callCount, len(tt.bodies)-1)]))
+				callCount++
+			}))
+			defer server.Close()
+			t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+			info, err := fetchKeyInfo("test-token")
+			if callCount != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, callCount)
+			}
+			tt.check(t, info, err)
+		})
+	}
+}
+
+func TestFetchKeyInfoOversizedBody(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+
+	huge := bytes.Repeat([]byte(" "), MaxBodyBytes+1)
+	bomb := func() []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(huge)
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"raw", "", huge},
+		{"decompressed", "gzip", bomb()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				_, _ = w.Write(tt.body)
+			}))
+			defer server.Close()
+			t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+			if _, err := fetchKeyInfo("test-token"); !errors.Is(err, ErrBadResponse) {
+				t.Errorf("expected ErrBadResponse for a body over the cap, got %v", err)
+			}
+		})
+	}
+
+	t.Run("at the cap", func(t *testing.T) {
+		body, err := readLimited(bytes.NewReader(huge[:MaxBodyBytes]))
+		if err != nil || len(body) != MaxBodyBytes {
+			t.Errorf("expected a body of exactly MaxBodyBytes to be read, got %d bytes (%v)", len(body), err)
+		}
+	})
+}
+
+func TestSparkline(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		want    string
+	}{
+		{"full range", []float64{0, 1, 2, 3, 4, 5, 6, 7}, "▁▂▃▄▅▆▇█"},
+		{"scaled", []float64{10, 20, 30}, "▁▅█"},
+		{"rounds to nearest height", []float64{0, 0.5, 9.5, 10}, "▁▁██"},
+		{"reset drop", []float64{40, 80, 0}, "▅█▁"},
+		{"flat", []float64{5, 5, 5}, "▁▁▁"},
+		{"single sample omitted", []float64{5}, ""},
+		{"no samples omitted", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := sparkline(tt.samples); got != tt.want {
+			t.Errorf("%s: sparkline(%v) = %q, want %q", tt.name, tt.samples, got, tt.want)
+		}
+	}
+}
+
+func TestSparklineSegment(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_SHOW_SPARKLINE", "1")
+	t.Setenv("LITELLM_SPARKLINE_SAMPLES", "3")
+
+	appendSpendHistory(100) // outside the 3-sample window
+	if got := formatSparklineSegment(); got != "" {
+		t.Errorf("expected no sparkline with one sample, got %q", got)
+	}
+	for _, spend := range []float64{1, 2, 3} {
+		appendSpendHistory(spend)
+	}
+	if got := stripANSI(formatSparklineSegment()); got != " | ▁▅█" {
+		t.Errorf("expected last three samples, got %q", got)
+	}
+
+	t.Setenv("LITELLM_SHOW_SPARKLINE", "")
+	if got := formatSparklineSegment(); got != "" {
+		t.Errorf("expected no sparkline when disabled, got %q", got)
+	}
+}
+
+func TestAppendSpendHistoryCapped(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	for i := range MaxHistorySamples + 5 {
+		appendSpendHistory(float64(i))
+	}
+	history := readSpendHistory()
+	if len(history) != MaxHistorySamples {
+		t.Fatalf("expected %d samples, got %d", MaxHistorySamples, len(history))
+	}
+	if history[0].Spend != 5 {
+		t.Errorf("expected oldest samples dropped, first = %v", history[0].Spend)
+	}
+}
+
+func TestTopModel(t *testing.T) {
+	var logs []SpendLogEntry
+	if err := json.Unmarshal([]byte(`[
+		{"model": "gpt-4", "spend": 5.5},
+		{"model": "claude-sonnet", "spend": 3},
+		{"model": "gpt-4", "spend": 6.5},
+		{"model": "claude-sonnet", "spend": 4},
+		{"model": "", "spend": 100}
+	]`), &logs); err != nil {
+		t.Fatal(err)
+	}
+	model, spend, ok := topModel(logs)
+	if !ok || model != "gpt-4" || spend != 12 {
+		t.Errorf("topModel() = %q, %v, %v; want gpt-4, 12, true", model, spend, ok)
+	}
+
+	t.Run("daily aggregate shape", func(t *testing.T) {
+		var daily []SpendLogEntry
+		_ = json.Unmarshal([]byte(`[{"spend": 9, "models": {"gpt-4": 2, "claude-opus": 7}}]`), &daily)
+		model, spend, ok := topModel(daily)
+		if !ok || model != "claude-opus" || spend != 7 {
+			t.Errorf("topModel() = %q, %v, %v; want claude-opus, 7, true", model, spend, ok)
+		}
+	})
+
+	t.Run("tie is stable", func(t *testing.T) {
+		model, _, _ := topModel([]SpendLogEntry{{Model: "b", Spend: 1}, {Model: "a", Spend: 1}})
+		if model != "a" {
+			t.Errorf("expected alphabetical tie-break, got %q", model)
+		}
+	})
+
+	t.Run("no spend", func(t *testing.T) {
+		if _, _, ok := topModel([]SpendLogEntry{{Model: "gpt-4", Spend: 0}}); ok {
+			t.Error("expected no top model without spend")
+		}
+	})
+}
+
+func TestRefreshTopModel(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_SHOW_TOP_MODEL", "1")
+
+	callCount := 0
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		if r.URL.Path != "/spend/logs" || r.URL.Query().Get("start_date") == "" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if failing {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"model": "gpt-4", "spend": 12}, {"model": "gpt-3.5", "spend": 1}]`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	refreshTopModel("test-token")
+	refreshTopModel("test-token")
+	if callCount != 1 {
+		t.Errorf("expected the second refresh to hit the cache, got %d calls", callCount)
+	}
+	if got := stripANSI(formatTopModelSegment()); got != " | top: gpt-4 $12.00" {
+		t.Errorf("unexpected segment %q", got)
+	}
+
+	t.Run("query key filters the logs", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		var gotKey string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotKey = r.URL.Query().Get("api_key")
+			_, _ = w.Write([]byte(`[{"model": "claude-sonnet-4", "spend": 3}]`))
+		}))
+		defer server.Close()
+		t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+		ownCache := topModelCacheFile()
+		t.Setenv("LITELLM_QUERY_KEY", "sk-other")
+		if topModelCacheFile() == ownCache {
+			t.Error("expected the queried key's top model cached separately")
+		}
+		refreshTopModel("admin-token")
+		if gotKey != "sk-other" {
+			t.Errorf("api_key = %q, want the queried key", gotKey)
+		}
+		if got := stripANSI(formatTopModelSegment()); got != " | top: claude-sonnet-4 $3.00" {
+			t.Errorf("unexpected segment %q", got)
+		}
+	})
+
+	t.Run("failure degrades silently", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		failing = true
+		refreshTopModel("test-token")
+		if got := formatTopModelSegment(); got != "" {
+			t.Errorf("expected no segment after a failed lookup, got %q", got)
+		}
+	})
+}
+
+// TestRunDefersTopModelRefresh verifies the statusline only reads the top-model cache:
+// an expired one is refreshed by the -revalidate child, which leaves a fresh budget
+// alone.
+func TestRunDefersTopModelRefresh(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "test-token")
+	t.Setenv("LITELLM_SHOW_TOP_MODEL", "1")
+	t.Setenv("LITELLM_OUTPUT_FILE", filepath.Join(t.TempDir(), "status.txt"))
+	origFileOnly := outputFileOnly
+	t.Cleanup(func() { outputFileOnly = origFileOnly })
+
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		_, _ = w.Write([]byte(`[{"model": "gpt-4", "spend": 12}]`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	spawned := 0
+	orig := spawnRevalidation
+	t.Cleanup(func() { spawnRevalidation = orig })
+	spawnRevalidation = func() error {
+		spawned++
+		return nil
+	}
+
+	spend, budget := 40.0, 100.0
+	writeAgedBudgetCache(t, KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, 0)
+	run([]string{"-file-only"})
+	if len(paths) != 0 {
+		t.Errorf("expected no requests on the statusline path, got %v", paths)
+	}
+	if spawned != 1 {
+		t.Errorf("expected the top-model refresh handed to a child, got %d spawns", spawned)
+	}
+
+	run([]string{"-revalidate"})
+	if strings.Join(paths, ",") != "/spend/logs" {
+		t.Errorf("expected the child to fetch only /spend/logs, got %v", paths)
+	}
+	if got := stripANSI(formatTopModelSegment()); got != " | top: gpt-4 $12.00" {
+		t.Errorf("expected the refreshed segment, got %q", got)
+	}
+}
+
+func TestBreakerStateTransitions(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_CACHE_TTL_MS", "0")
+	t.Setenv("LITELLM_BREAKER_THRESHOLD", "2")
+
+	failing := true
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		callCount++
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"info": {"spend": 1, "max_budget": 10}}`))
+	}))
+	defer server.Close()
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	b := newBreaker()
+	currentState := func() breakerState {
+		e, ok := readBudgetFailEntry()
+		if !ok {
+			e = nil
+		}
+		return b.state(e, nowFunc().UnixMilli())
+	}
+
+	// Closed: failures below the threshold still reach the network.
+	_, _ = getKeyInfo("test-token")
+	if got := currentState(); got != breakerClosed {
+		t.Fatalf("after 1 failure: state = %v, want closed", got)
+	}
+	_, _ = getKeyInfo("test-token")
+	if callCount != 2 {
+		t.Fatalf("expected 2 calls while closed, got %d", callCount)
+	}
+
+	// Open: the threshold was reached, so the next call replays the error offline.
+	if got := currentState(); got != breakerOpen {
+		t.Fatalf("after 2 failures: state = %v, want open", got)
+	}
+	if _, err := getKeyInfo("test-token"); err == nil {
+		t.Fatal("expected the replayed error while open")
+	}
+	if callCount != 2 {
+		t.Fatalf("expected no call while open, got %d", callCount)
+	}
+
+	// Half-open: the cooldown elapsed; exactly one probe is allowed.
+	expireBudgetFailCache(t)
+	if got := currentState(); got != breakerHalfOpen {
+		t.Fatalf("after cooldown: state = %v, want half-open", got)
+	}
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected the probe to be allowed, got %v", err)
+	}
+	if err := b.allow(); err == nil {
+		t.Fatal("expected a second concurrent probe to be refused")
+	}
+
+	// A failed probe re-opens with a longer cooldown.
+	before, _ := readBudgetFailEntry()
+	b.failure(errors.New("still down"))
+	after, _ := readBudgetFailEntry()
+	if currentState() != breakerOpen || b.cooldownMs(after) <= b.cooldownMs(before) {
+		t.Fatalf("expected failed probe to re-open for longer: %dms → %dms", b.cooldownMs(before), b.cooldownMs(after))
+	}
+
+	// A successful probe closes it.
+	expireBudgetFailCache(t)
+	failing = false
+	if _, err := getKeyInfo("test-token"); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if got := currentState(); got != breakerClosed {
+		t.Errorf("after successful probe: state = %v, want closed", got)
+	}
+}
+
+func TestBreakerHonorsRetryAfter(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_BREAKER_THRESHOLD", "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	_, err := getKeyInfo("test-token")
+	var raErr *RetryAfterError
+	if !errors.As(err, &raErr) || raErr.After != 2*time.Minute {
+		t.Fatalf("expected RetryAfterError of 2m, got %v", err)
+	}
+	entry, _ := readBudgetFailEntry()
+	if got := newBreaker().cooldownMs(entry); got != 120_000 {
+		t.Errorf("expected cooldown stretched to Retry-After, got %dms", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"30", 30 * time.Second, true},
+		{"0", 0, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestWriteOutputToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status", "line.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", path)
+
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+	outputFileOnly = true
+
+	writeOutput("● 25%")
+	writeOutput("● 30%")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected status file, got %v", err)
+	}
+	if string(data) != "● 30%\n" {
+		t.Errorf("expected the latest line to replace the file, got %q", data)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected no leftover temp files, got %d entries", len(entries))
+	}
+}
+
+func TestWriteOutputNewline(t *testing.T) {
+	t.Setenv("LITELLM_OUTPUT_FILE", "")
+	var out strings.Builder
+	orig := statusOut
+	statusOut = &out
+	defer func() { statusOut = orig }()
+
+	for _, tt := range []struct {
+		val  string
+		want string
+	}{
+		{"", "● 25%\n"},
+		{"0", "● 25%\n"},
+		{"1", "● 25%"},
+		{"true", "● 25%"},
+	} {
+		out.Reset()
+		t.Setenv("LITELLM_NO_NEWLINE", tt.val)
+		writeOutput("● 25%")
+		if out.String() != tt.want {
+			t.Errorf("LITELLM_NO_NEWLINE=%q: expected %q, got %q", tt.val, tt.want, out.String())
+		}
+	}
+}
+
+func TestFormatOutputModes(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	spend, budget := 25.0, 100.0
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+
+	if got := formatOutput("logfmt", info, "", StatusInput{}, nil, true); !strings.HasSuffix(got, " stale=true") {
+		t.Errorf("expected stale logfmt marker, got %q", got)
+	}
+	var out StatusJSON
+	if err := json.Unmarshal([]byte(formatOutput("json", info, "", StatusInput{}, nil, false)), &out); err != nil || out.Percent != 25 {
+		t.Errorf("expected JSON with percent 25, got %+v (%v)", out, err)
+	}
+	if got := stripANSI(formatOutput("text", info, "", StatusInput{}, nil, false)); !strings.HasPrefix(got, "◔ 25%") {
+		t.Errorf("unexpected text output %q", got)
+	}
+}
+
+func TestBudgetExitCode(t *testing.T) {
+	budget := 100.0
+	at := func(spend float64) *KeyInfo {
+		return &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+	}
+	tests := []struct {
+		name string
+		info *KeyInfo
+		err  error
+		want int
+	}{
+		{"under warn", at(50), nil, ExitOK},
+		{"just under warn", at(74.9), nil, ExitOK},
+		{"warn band", at(75), nil, ExitWarn},
+		{"just under crit", at(89.9), nil, ExitWarn},
+		{"crit band", at(90), nil, ExitCrit},
+		{"over budget", at(120), nil, ExitCrit},
+		{"budget exceeded error", nil, &BudgetExceededError{Spend: 110, MaxBudget: 100}, ExitCrit},
+		{"fetch error", nil, ErrAuth, ExitError},
+		{"no budget configured", &KeyInfo{}, nil, ExitError},
+	}
+	for _, tt := range tests {
+		if got := budgetExitCode(tt.info, tt.err); got != tt.want {
+			t.Errorf("%s: budgetExitCode() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "")
+	t.Setenv("ANTHROPIC_AUTH_TOKEN", "")
+	t.Setenv("LITELLM_OUTPUT_FILE", filepath.Join(t.TempDir(), "out.txt"))
+
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+
+	if got := run([]string{"-file-only"}); got != ExitOK {
+		t.Errorf("expected ExitOK without -exit-code, got %d", got)
+	}
+	if got := run([]string{"-file-only", "-exit-code"}); got != ExitError {
+		t.Errorf("expected ExitError with no API key, got %d", got)
+	}
+	if got := run([]string{"-no-such-flag"}); got != ExitUsage {
+		t.Errorf("expected ExitUsage for a bad flag, got %d", got)
+	}
+}
+
+func TestFormatDurationUnits(t *testing.T) {
+	d := 24 * time.Hour
+	tests := []struct {
+		diff  time.Duration
+		units int
+		want  string
+	}{
+		{2*d + 3*time.Hour + 15*time.Minute, 1, "2d"},
+		{2*d + 3*time.Hour + 15*time.Minute, 2, "2d3h"},
+		{2*d + 3*time.Hour + 15*time.Minute, 3, "2d3h15m"},
+		{2*d + 5*time.Minute, 2, "2d"},
+		{2*d + 5*time.Minute, 3, "2d5m"},
+		{2 * d, 3, "2d"},
+		{3*time.Hour + 15*time.Minute, 1, "3h"},
+		{3*time.Hour + 15*time.Minute, 2, "3h15m"},
+		{3 * time.Hour, 2, "3h"},
+		{45 * time.Minute, 3, "45m"},
+		// units 0: the classic countdown, unchanged when LITELLM_RESET_UNITS is unset.
+		{2*d + 3*time.Hour + 15*time.Minute, 0, "2d3h"},
+		{2*d + 5*time.Minute, 0, "2d0h"},
+		{5*time.Hour + 20*time.Minute, 0, "5h"},
+		{45 * time.Minute, 0, "45m"},
+		{30 * time.Second, 0, "resetting"},
+		{30 * time.Second, 2, "resetting"},
+		{-time.Minute, 2, "resetting"},
+	}
+	for _, tt := range tests {
+		if got := formatDuration(tt.diff, tt.units); got != tt.want {
+			t.Errorf("formatDuration(%v, %d) = %q, want %q", tt.diff, tt.units, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDurationRound(t *testing.T) {
+	d := 24 * time.Hour
+	tests := []struct {
+		diff  time.Duration
+		units int
+		round string
+		want  string
+	}{
+		{time.Hour + 59*time.Minute, 1, "", "1h"},
+		{time.Hour + 59*time.Minute, 1, "down", "1h"},
+		{time.Hour + 59*time.Minute, 1, "up", "2h"},
+		{time.Hour + 59*time.Minute, 1, "nearest", "2h"},
+		{time.Hour + 29*time.Minute, 1, "nearest", "1h"},
+		{time.Hour + 30*time.Minute, 1, "nearest", "2h"},
+		{time.Hour + time.Minute, 1, "up", "2h"},
+		{2 * time.Hour, 1, "up", "2h"},
+		{2*time.Hour + 30*time.Second, 2, "up", "2h1m"},
+		{2*time.Hour + 30*time.Second, 2, "nearest", "2h1m"},
+		{2*time.Hour + 29*time.Second, 2, "nearest", "2h"},
+		{23*time.Hour + 59*time.Minute, 1, "up", "1d"},
+		{d + 23*time.Hour + 30*time.Minute, 2, "up", "2d"},
+		{d + 11*time.Hour, 1, "nearest", "1d"},
+		{d + 12*time.Hour, 1, "nearest", "2d"},
+		{time.Hour + 59*time.Minute, 1, "bogus", "1h"},
+		{time.Hour + 59*time.Minute, 0, "up", "2h"},
+		{d + 23*time.Hour + 30*time.Minute, 0, "nearest", "2d0h"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LITELLM_RESET_ROUND", tt.round)
+		if got := formatDuration(tt.diff, tt.units); got != tt.want {
+			t.Errorf("LITELLM_RESET_ROUND=%q: formatDuration(%v, %d) = %q, want %q", tt.round, tt.diff, tt.units, got, tt.want)
+		}
+	}
+}
+
+func TestGetResetUnits(t *testing.T) {
+	for val, want := range map[string]int{"": 0, "1": 1, "2": 2, "3": 3, "0": 0, "4": 0, "two": 0} {
+		t.Setenv("LITELLM_RESET_UNITS", val)
+		if got := getResetUnits(); got != want {
+			t.Errorf("LITELLM_RESET_UNITS=%q: got %d, want %d", val, got, want)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount     float64
+		microCents bool
+		want       string
+	}{
+		{0.003, false, "$0.00"},
+		{0.003, true, "$0.003"},
+		{0.00346, true, "$0.0035"},
+		{0.0000001, true, "<$0.01"},
+		{0, true, "$0.00"},
+		{0.01, true, "$0.01"},
+		{12.345, true, "$12.35"},
+		{12.345, false, "$12.35"},
+	}
+	for _, tt := range tests {
+		if tt.microCents {
+			t.Setenv("LITELLM_MICRO_CENTS", "1")
+		} else {
+			t.Setenv("LITELLM_MICRO_CENTS", "")
+		}
+		if got := formatMoney(tt.amount); got != tt.want {
+			t.Errorf("formatMoney(%v) micro=%v = %q, want %q", tt.amount, tt.microCents, got, tt.want)
+		}
+	}
+}
+
+func TestFormatStatusLineMicroCents(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "1")
+	t.Setenv("LITELLM_MICRO_CENTS", "1")
+
+	spend, budget := 0.003, 10.0
+	got := stripANSI(formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{}))
+	if !strings.Contains(got, "$0.003/$10.00") {
+		t.Errorf("expected sub-cent spend, got %q", got)
+	}
+}
+
+func TestFormatMoneyRounding(t *testing.T) {
+	t.Setenv("LITELLM_MICRO_CENTS", "")
+	t.Setenv("LITELLM_CONVERT_TO", "")
+	tests := []struct {
+		mode   string
+		amount float64
+		want   string
+	}{
+		{"", 25.005, "$25.01"},
+		{"round", 25.005, "$25.01"},
+		{"floor", 25.005, "$25.00"},
+		{"ceil", 25.005, "$25.01"},
+		{"floor", 25.009, "$25.00"},
+		{"ceil", 25.001, "$25.01"},
+		{"ceil", 25, "$25.00"},
+		{"floor", 0.29, "$0.29"},
+		{"bogus", 25.005, "$25.01"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LITELLM_ROUNDING", tt.mode)
+		if got := formatMoney(tt.amount); got != tt.want {
+			t.Errorf("formatMoney(%v) rounding=%q = %q, want %q", tt.amount, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestFormatMoneyLocale(t *testing.T) {
+	t.Setenv("LITELLM_CONVERT_TO", "")
+	t.Setenv("LITELLM_ROUNDING", "")
+	tests := []struct {
+		locale     string
+		microCents bool
+		amount     float64
+		want       string
+	}{
+		{"", false, 1234.5, "$1234.50"},
+		{"en", false, 1234.5, "$1234.50"},
+		{"en-US", false, 1234.5, "$1234.50"},
+		{"en-GB", false, 1234.5, "$1234.50"},
+		{"de", false, 1234567.5, "$1.234.567,50"},
+		{"de", false, 25, "$25,00"},
+		{"fr", false, 1234.5, "$1\u00a0234,50"},
+		{"de-CH", false, 1234.5, "$1’234.50"},
+		{"de", true, 0.003, "$0,003"},
+		{"de", true, 0.0000001, "<$0,01"},
+		{"xx", false, 1234.5, "$1234.50"},
+		{"not a locale!", false, 1234.5, "$1234.50"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LITELLM_LOCALE", tt.locale)
+		if tt.microCents {
+			t.Setenv("LITELLM_MICRO_CENTS", "1")
+		} else {
+			t.Setenv("LITELLM_MICRO_CENTS", "")
+		}
+		if got := formatMoney(tt.amount); got != tt.want {
+			t.Errorf("formatMoney(%v) locale=%q = %q, want %q", tt.amount, tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestFormatMonthDayLocale(t *testing.T) {
+	march := time.Date(2025, time.March, 5, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		locale, want string
+	}{
+		{"", "Mar 5 09:30"},
+		{"en-US", "Mar 5 09:30"},
+		{"de", "Mär 5 09:30"},
+		{"de-AT", "Mär 5 09:30"},
+		{"fr", "mars 5 09:30"},
+		{"pt-BR", "mar 5 09:30"},
+		{"ja", "Mar 5 09:30"}, // no month table: English names
+		{"not a locale!", "Mar 5 09:30"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LITELLM_LOCALE", tt.locale)
+		if got := formatMonthDay(march, "Jan 2 15:04"); got != tt.want {
+			t.Errorf("formatMonthDay locale=%q = %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+
+	t.Setenv("LITELLM_LOCALE", "nl")
+	if got := formatMonthDay(march, "Jan 2"); got != "mrt 5" {
+		t.Errorf("formatMonthDay(Jan 2) locale=nl = %q, want %q", got, "mrt 5")
+	}
+}
+
+func TestFormatMoneyConversion(t *testing.T) {
+	t.Setenv("LITELLM_MICRO_CENTS", "")
+	tests := []struct {
+		name, convertTo, rate, showOriginal string
+		amount                              float64
+		want                                string
+	}{
+		{"default USD", "", "", "", 25, "$25.00"},
+		{"EUR", "EUR", "0.924", "", 25, "€23.10"},
+		{"lowercase code", "eur", "0.924", "", 25, "€23.10"},
+		{"show original", "EUR", "0.924", "1", 25, "€23.10 (USD $25.00)"},
+		{"unknown symbol", "CHF", "0.88", "", 25, "CHF 22.00"},
+		{"USD is a no-op", "USD", "2", "", 25, "$25.00"},
+		{"missing rate", "EUR", "", "", 25, "$25.00"},
+		{"invalid rate", "EUR", "abc", "", 25, "$25.00"},
+		{"negative rate", "EUR", "-1", "", 25, "$25.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LITELLM_CONVERT_TO", tt.convertTo)
+			t.Setenv("LITELLM_FX_RATE", tt.rate)
+			t.Setenv("LITELLM_SHOW_ORIGINAL", tt.showOriginal)
+			if got := formatMoney(tt.amount); got != tt.want {
+				t.Errorf("formatMoney(%v) = %q, want %q", tt.amount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatStatusLineConverted(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "1")
+	t.Setenv("LITELLM_CONVERT_TO", "EUR")
+	t.Setenv("LITELLM_FX_RATE", "0.5")
+
+	spend, budget := 20.0, 100.0
+	got := stripANSI(formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{}))
+	if !strings.Contains(got, "€10.00/€50.00 (20%)") {
+		t.Errorf("expected converted amounts with an unchanged percent, got %q", got)
+	}
+}
+
+func TestNewAPIRequestAuth(t *testing.T) {
+	t.Run("bearer by default", func(t *testing.T) {
+		t.Setenv("LITELLM_AUTH_TYPE", "")
+		req, err := newAPIRequest("http://proxy/key/info", "sk-123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer sk-123" {
+			t.Errorf("Authorization = %q, want bearer token", got)
+		}
+	})
+
+	t.Run("basic with key as password", func(t *testing.T) {
+		t.Setenv("LITELLM_AUTH_TYPE", "basic")
+		t.Setenv("LITELLM_AUTH_USER", "alice")
+		req, err := newAPIRequest("http://proxy/key/info", "sk-123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// base64("alice:sk-123")
+		if got := req.Header.Get("Authorization"); got != "Basic YWxpY2U6c2stMTIz" {
+			t.Errorf("Authorization = %q, want basic credentials", got)
+		}
+	})
+
+	t.Run("unknown type falls back to bearer", func(t *testing.T) {
+		t.Setenv("LITELLM_AUTH_TYPE", "digest")
+		req, _ := newAPIRequest("http://proxy/key/info", "sk-123")
+		if got := req.Header.Get("Authorization"); got != "Bearer sk-123" {
+			t.Errorf("Authorization = %q, want bearer token", got)
+		}
+	})
+}
+
+func TestParseResetTimeMemoized(t *testing.T) {
+	resetTimeMemo.parsed = nil // drop whatever an earlier test left behind
+	parses := 0
+	parseISOTimeHook = func(string) { parses++ }
+	defer func() { parseISOTimeHook = nil }()
+	setNow(t, fixedNow)
+
+	resetAt := fixedNow.Add(5 * time.Hour).Format(time.RFC3339)
+	for range 3 {
+		if got, _ := formatTimeUntilReset(&resetAt, nil); got != "5h" {
+			t.Fatalf("expected 5h, got %q", got)
+		}
+	}
+	if _, ok := resetDeadline(&resetAt, nil); !ok {
+		t.Fatal("expected a deadline")
+	}
+	if parses != 1 {
+		t.Errorf("expected one parse for a repeated reset time, got %d", parses)
+	}
+
+	changed := fixedNow.Add(2 * time.Hour).Format(time.RFC3339)
+	if got, _ := formatTimeUntilReset(&changed, nil); got != "2h" {
+		t.Errorf("expected 2h after the value changed, got %q", got)
+	}
+	if parses != 2 {
+		t.Errorf("expected a re-parse when the value changes, got %d parses", parses)
+	}
+
+	// A primary and a secondary window read in turn don't evict each other.
+	for range 3 {
+		_, _ = parseResetTime(resetAt)
+		_, _ = parseResetTime(changed)
+	}
+	if parses != 2 {
+		t.Errorf("expected alternating reset times to stay memoized, got %d parses", parses)
+	}
+}
+
+// setDisplayLocation pins the display timezone for the rest of the test.
+func setDisplayLocation(t *testing.T, loc *time.Location) {
+	t.Helper()
+	orig := displayLocation() // resolves the sync.Once so it can't overwrite loc later
+	resolvedLocation = loc
+	t.Cleanup(func() { resolvedLocation = orig })
+}
+
+func TestFormatTimeUntilResetFormats(t *testing.T) {
+	setNow(t, fixedNow)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("tzdata unavailable: %v", err)
+	}
+	setDisplayLocation(t, berlin)
+
+	resetAt := fixedNow.Add(3 * 24 * time.Hour).Format(time.RFC3339) // Jun 18 12:00 UTC = 14:00 CEST
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"", "3d0h"},
+		{"relative", "3d0h"},
+		{"absolute", "Jun 18 14:00"},
+		{"both", "3d0h (Jun 18 14:00)"},
+		{"bogus", "3d0h"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LITELLM_RESET_FORMAT", tt.format)
+		if got, _ := formatTimeUntilReset(&resetAt, nil); got != tt.want {
+			t.Errorf("LITELLM_RESET_FORMAT=%q: got %q, want %q", tt.format, got, tt.want)
+		}
+	}
+
+	t.Run("due reset stays resetting", func(t *testing.T) {
+		t.Setenv("LITELLM_RESET_FORMAT", "both")
+		past := fixedNow.Add(-5 * time.Minute).Format(time.RFC3339)
+		if got, _ := formatTimeUntilReset(&past, nil); got != "resetting" {
+			t.Errorf("expected resetting, got %q", got)
+		}
+	})
+}
+
+func TestFormatTimeUntilResetHuman(t *testing.T) {
+	setNow(t, fixedNow) // Sunday Jun 15 12:00 UTC
+	// 22:00 local: a reset a few hours away already falls on the next day.
+	setDisplayLocation(t, time.FixedZone("UTC+10", 10*60*60))
+	t.Setenv("LITELLM_RESET_FORMAT", "human")
+
+	tests := []struct {
+		offset time.Duration
+		want   string
+	}{
+		{time.Hour, "today"},
+		{3 * time.Hour, "tomorrow"},
+		{25 * time.Hour, "tomorrow"},
+		{2 * 24 * time.Hour, "Tuesday"},
+		{6 * 24 * time.Hour, "Saturday"},
+		{7 * 24 * time.Hour, "Jun 22"},
+		{30 * 24 * time.Hour, "Jul 15"},
+		{-5 * time.Minute, "resetting"},
+	}
+	for _, tt := range tests {
+		resetAt := fixedNow.Add(tt.offset).Format(time.RFC3339)
+		if got, _ := formatTimeUntilReset(&resetAt, nil); got != tt.want {
+			t.Errorf("reset in %s: got %q, want %q", tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestGetBaseURLPrecedence(t *testing.T) {
+	vars := []string{"LITELLM_PROXY_URL", "ANTHROPIC_BASE_URL", "LITELLM_BASE_URL", "OPENAI_BASE_URL"}
+	for _, v := range vars {
+		t.Setenv(v, "")
+	}
+	if got := getBaseURL(); got != "" {
+		t.Fatalf("expected no base URL, got %q", got)
+	}
+
+	// Set every variable, then peel them off from the highest precedence down.
+	for _, v := range vars {
+		t.Setenv(v, "https://"+strings.ToLower(v)+".example//")
+	}
+	for _, v := range vars {
+		want := "https://" + strings.ToLower(v) + ".example"
+		if got := getBaseURL(); got != want {
+			t.Errorf("with %s highest set: got %q, want %q", v, got, want)
+		}
+		t.Setenv(v, "")
+	}
+}
+
+func TestFormatStatusLineExhausted(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	budget := 100.0
+
+	for _, spend := range []float64{100, 130} {
+		t.Run(fmt.Sprintf("spend %.0f", spend), func(t *testing.T) {
+			info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+
+			t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+			got := formatStatusLine(info, "", StatusInput{})
+			if !strings.HasPrefix(got, ColorBrightRed) {
+				t.Errorf("expected bright red, got %q", got)
+			}
+			if plain := stripANSI(got); !strings.HasPrefix(plain, "● EXHAUSTED") || strings.Contains(plain, "%") {
+				t.Errorf("expected EXHAUSTED in place of the percent, got %q", plain)
+			}
+
+			t.Setenv("LITELLM_PLUGIN_SHOW_COST", "1")
+			want := fmt.Sprintf("%s/$100.00 EXHAUSTED", formatMoney(spend))
+			if plain := stripANSI(formatStatusLine(info, "", StatusInput{})); !strings.Contains(plain, want) {
+				t.Errorf("expected %q with dollar figures, got %q", want, plain)
+			}
+		})
+	}
+
+	t.Run("just under the limit", func(t *testing.T) {
+		t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+		spend := 99.5
+		got := formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})
+		if strings.Contains(got, "EXHAUSTED") || !strings.HasPrefix(got, ColorRed) {
+			t.Errorf("expected the normal critical display, got %q", got)
+		}
+	})
+}
+
+func TestFormatStatusLineAllBudgets(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	t.Setenv("LITELLM_HIDE_RESET", "1")
+	t.Setenv("LITELLM_SHOW_ALL_BUDGETS", "1")
+	memberSpend, memberBudget := 40.0, 100.0
+	teamSpend, teamBudget := 920.0, 1000.0
+	daily := "1d"
+	info := &KeyInfo{
+		TeamSpend: &memberSpend, TeamMaxBudget: &memberBudget, TeamBudgetDuration: &daily,
+		TeamTotalSpend: &teamSpend, TeamTotalMaxBudget: &teamBudget,
+	}
+
+	got := formatStatusLine(info, "", StatusInput{})
+	if plain := stripANSI(got); plain != "● daily 40% / team 92%" {
+		t.Errorf("expected both budgets, got %q", plain)
+	}
+	for _, part := range []string{ColorGreen + "daily 40%" + ColorReset, ColorRed + "team 92%" + ColorReset} {
+		if !strings.Contains(got, part) {
+			t.Errorf("expected %q colored on its own in %q", part, got)
+		}
+	}
+
+	t.Run("member budget without a known window", func(t *testing.T) {
+		info := *info
+		info.TeamBudgetDuration = nil
+		if plain := stripANSI(formatStatusLine(&info, "", StatusInput{})); !strings.Contains(plain, "member 40% / team 92%") {
+			t.Errorf("expected the member label, got %q", plain)
+		}
+	})
+
+	t.Run("single budget keeps the normal figure", func(t *testing.T) {
+		info := *info
+		info.TeamTotalMaxBudget = nil
+		if plain := stripANSI(formatStatusLine(&info, "", StatusInput{})); plain != "◑ 40%" {
+			t.Errorf("expected the plain percent, got %q", plain)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("LITELLM_SHOW_ALL_BUDGETS", "")
+		if plain := stripANSI(formatStatusLine(info, "", StatusInput{})); plain != "● 92% (team) | team 92%" {
+			t.Errorf("expected the binding budget and team segment, got %q", plain)
+		}
+	})
+}
+
+func TestFormatStatusLinePercentRemaining(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_PERCENT_MODE", "remaining")
+	budget := 100.0
+
+	tests := []struct {
+		spend     float64
+		showCost  string
+		want      string
+		wantColor string
+	}{
+		{25, "", "◔ 75% left", ColorGreen},
+		{80, "", "◕ 20% left", ColorYellow},
+		{95, "", "● 5% left", ColorRed},
+		{25, "1", "◔ $25.00/$100.00 (75% left)", ColorGreen},
+		{95, "1", "● $95.00/$100.00 (5% left)", ColorRed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			t.Setenv("LITELLM_PLUGIN_SHOW_COST", tt.showCost)
+			spend := tt.spend
+			got := formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})
+			if plain := stripANSI(got); !strings.HasPrefix(plain, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, plain)
+			}
+			if !strings.HasPrefix(got, tt.wantColor) {
+				t.Errorf("expected color %q (low remaining is red), got %q", tt.wantColor, got)
+			}
+		})
+	}
+
+	t.Run("used is the default", func(t *testing.T) {
+		t.Setenv("LITELLM_PERCENT_MODE", "")
+		t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+		spend := 25.0
+		if got := stripANSI(formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})); !strings.HasPrefix(got, "◔ 25%") || strings.Contains(got, "left") {
+			t.Errorf("expected the percent used, got %q", got)
+		}
+	})
+}
+
+func TestFormatStatusLineTextualState(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	t.Setenv("LITELLM_DEBOUNCE_MS", "")
+	origPlain := plainOutput
+	t.Cleanup(func() { plainOutput = origPlain })
+	budget := 100.0
+
+	tests := []struct {
+		spend float64
+		plain string
+	}{
+		{40, "◑ 40% OK"},
+		{80, "◕ 80% WARN"},
+		{95, "● 95% CRIT"},
+		{120, "● EXHAUSTED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.plain, func(t *testing.T) {
+			spend := tt.spend
+			info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+
+			plainOutput = true
+			if got := renderText(formatStatusLine(info, "", StatusInput{})); got != tt.plain {
+				t.Errorf("without color: got %q, want %q", got, tt.plain)
+			}
+
+			plainOutput = false
+			got := stripANSI(renderText(formatStatusLine(info, "", StatusInput{})))
+			for _, state := range []string{"OK", "WARN", "CRIT"} {
+				if strings.Contains(got, state) {
+					t.Errorf("with color: expected no textual state, got %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatStatusLineBlockedMarker(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	spend, budget := 120.0, 100.0
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+
+	tests := []struct {
+		marker    string
+		want      string
+		wantBlink bool
+	}{
+		{"", "EXHAUSTED", false},
+		{"bracket", "[BLOCKED]", false},
+		{"blink", "[BLOCKED]", true},
+		{"BLINK", "[BLOCKED]", true},
+		{"strobe", "EXHAUSTED", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.marker, func(t *testing.T) {
+			t.Setenv("LITELLM_BLOCKED_MARKER", tt.marker)
+			got := formatStatusLine(info, "", StatusInput{})
+			if plain := stripANSI(got); plain != "● "+tt.want {
+				t.Errorf("expected %q, got %q", "● "+tt.want, plain)
+			}
+			if blink := strings.Contains(got, ColorBlink+"[BLOCKED]"+ColorReset); blink != tt.wantBlink {
+				t.Errorf("blink = %v, want %v in %q", blink, tt.wantBlink, got)
+			}
+		})
+	}
+
+	t.Run("blink dropped for plain output", func(t *testing.T) {
+		t.Setenv("LITELLM_BLOCKED_MARKER", "blink")
+		saved := plainOutput
+		plainOutput = true
+		t.Cleanup(func() { plainOutput = saved })
+		if got := renderText(formatStatusLine(info, "", StatusInput{})); got != "● [BLOCKED]" {
+			t.Errorf("expected the marker without escapes, got %q", got)
+		}
+	})
+
+	t.Run("under the budget", func(t *testing.T) {
+		t.Setenv("LITELLM_BLOCKED_MARKER", "blink")
+		spend := 50.0
+		if got := formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{}); strings.Contains(got, "BLOCKED") || strings.Contains(got, ColorBlink) {
+			t.Errorf("expected no marker below the budget, got %q", got)
+		}
+	})
+}
+
+// TestFormatStatusLineBudgetLoweredBelowSpend covers an admin cutting max_budget
+// mid-cycle to less than what was already spent: percent goes past 100 and the
+// remainder negative.
+func TestFormatStatusLineBudgetLoweredBelowSpend(t *testing.T) {
+	setNow(t, fixedNow)
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_HIDE_RESET", "1")
+	t.Setenv("LITELLM_BLOCKED_MARKER", "")
+	spend, budget := 105.0, 100.0
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+
+	tests := []struct {
+		name, showCost, percentMode string
+		want                        string
+	}{
+		{"percent", "", "", "● EXHAUSTED"},
+		{"percent remaining", "", "remaining", "● EXHAUSTED"},
+		{"cost", "1", "", "● $105.00/$100.00 EXHAUSTED (-$5.00 over)"},
+		{"cost remaining", "1", "remaining", "● $105.00/$100.00 EXHAUSTED (-$5.00 over)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LITELLM_PLUGIN_SHOW_COST", tt.showCost)
+			t.Setenv("LITELLM_PERCENT_MODE", tt.percentMode)
+			if got := stripANSI(formatStatusLine(info, "", StatusInput{})); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("safe rate doesn't go negative", func(t *testing.T) {
+		resetAt := fixedNow.Add(10 * time.Hour).Format(time.RFC3339)
+		rate, ok := safeRatePerHour(&KeyInfo{Spend: &spend, MaxBudget: &budget, BudgetResetAt: &resetAt}, fixedNow)
+		if !ok || rate != 0 {
+			t.Errorf("expected a zero safe rate, got %v, %v", rate, ok)
+		}
+	})
+
+	t.Run("all budgets", func(t *testing.T) {
+		t.Setenv("LITELLM_SHOW_ALL_BUDGETS", "1")
+		t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+		teamSpend, teamBudget := 10.0, 1000.0
+		info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamTotalSpend: &teamSpend, TeamTotalMaxBudget: &teamBudget}
+		if got := stripANSI(formatAllBudgets(info)); got != "member 105% / team 1%" {
+			t.Errorf("got %q", got)
+		}
+	})
+}
+
+func TestFormatMoneyNegative(t *testing.T) {
+	t.Setenv("LITELLM_CURRENCY", "")
+	t.Setenv("LITELLM_LOCALE", "")
+	t.Setenv("LITELLM_ROUNDING", "")
+	if got := formatMoney(-5); got != "-$5.00" {
+		t.Errorf("formatMoney(-5) = %q, want -$5.00", got)
+	}
+	if got := formatMoney(-1234.5); got != "-$1234.50" {
+		t.Errorf("formatMoney(-1234.5) = %q, want -$1234.50", got)
+	}
+}
+
+func TestFormatOutputTmux(t *testing.T) {
+	setNow(t, fixedNow)
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "#1:")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	t.Setenv("LITELLM_OUTPUT", "tmux")
+	origPlain := plainOutput
+	t.Cleanup(func() { plainOutput = origPlain })
+	plainOutput = false
+
+	budget := 100.0
+	resetAt := fixedNow.Add(3 * time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		spend float64
+		want  string
+	}{
+		{40, "##1: #[fg=green]◑#[default] #[fg=green]40%#[default] #[fg=brightblack]reset: 3h#[default]"},
+		{80, "##1: #[fg=yellow]◕#[default] #[fg=yellow]80%#[default] #[fg=brightblack]reset: 3h#[default]"},
+		{95, "##1: #[fg=red]●#[default] #[fg=red]95%#[default] #[fg=brightblack]reset: 3h#[default]"},
+	}
+	for _, tt := range tests {
+		spend := tt.spend
+		info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamBudgetResetAt: &resetAt}
+		got := formatOutput(getOutputMode(), info, "", StatusInput{}, nil, false)
+		if got != tt.want {
+			t.Errorf("spend %.0f: got %q, want %q", tt.spend, got, tt.want)
+		}
+		if strings.Contains(got, "\x1b") {
+			t.Errorf("expected no ANSI escapes, got %q", got)
+		}
+	}
+
+	plainOutput = true
+	spend := 40.0
+	if got := formatOutput("tmux", &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{}, nil, false); strings.Contains(got, "#[") {
+		t.Errorf("expected no styles without color, got %q", got)
+	}
+}
+
+func TestCustomStateLabels(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+
+	tests := []struct {
+		name, env string
+		err       error
+		def       string
+	}{
+		{"unlimited", "LITELLM_UNLIMITED_LABEL", nil, "no budget configured"},
+		{"no data", "LITELLM_NODATA_LABEL", ErrNoCachedData, "No cached data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.env, "")
+			if got := stripANSI(renderLine(&KeyInfo{}, "", StatusInput{}, tt.err)); got != tt.def {
+				t.Errorf("default: got %q, want %q", got, tt.def)
+			}
+			t.Setenv(tt.env, " unmetered ")
+			if got := stripANSI(renderLine(&KeyInfo{}, "", StatusInput{}, tt.err)); got != "unmetered" {
+				t.Errorf("custom: got %q, want %q", got, "unmetered")
+			}
+		})
+	}
+}
+
+func TestFormatStatusLineCustomSeparator(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	t.Setenv("LITELLM_SHOW_SAFE_RATE", "1")
+	t.Setenv("LITELLM_SEPARATOR", " • ")
+	setNow(t, fixedNow)
+
+	spend, budget, teamSpend, teamBudget := 25.0, 100.0, 100.0, 1000.0
+	resetAt := fixedNow.Add(10 * time.Hour).Format(time.RFC3339)
+	weekly := "7d"
+	ctxPct := 45.0
+	input := StatusInput{}
+	input.ContextWindow = &struct {
+		UsedPercentage *float64 `json:"used_percentage"`
+	}{UsedPercentage: &ctxPct}
+	info := &KeyInfo{
+		TeamSpend: &spend, TeamMaxBudget: &budget, TeamBudgetResetAt: &resetAt, TeamBudgetDuration: &weekly,
+		TeamTotalSpend: &teamSpend, TeamTotalMaxBudget: &teamBudget,
+	}
+
+	got := formatStatusLine(info, "", input)
+	plain := stripANSI(got)
+	want := "◔ 25% • weekly reset: 10h • $7.50/h left • team 10% • 📖 ◑ 45%"
+	if plain != want {
+		t.Errorf("got %q, want %q", plain, want)
+	}
+	if strings.Count(got, "•") != strings.Count(got, ColorGray+"•"+ColorReset) {
+		t.Errorf("expected every separator wrapped in its own color and reset, got %q", got)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		t.Setenv("LITELLM_SEPARATOR", "")
+		if got := stripANSI(formatStatusLine(info, "", input)); !strings.Contains(got, "◔ 25% weekly reset: 10h | $7.50/h left | team 10% | 📖") {
+			t.Errorf("expected default pipe separator, got %q", got)
+		}
+	})
+
+	t.Run("reset without a duration label", func(t *testing.T) {
+		noLabel := *info
+		noLabel.TeamBudgetDuration = nil
+		t.Setenv("LITELLM_SHOW_SAFE_RATE", "")
+		t.Setenv("LITELLM_ICONS", "")
+		if got := stripANSI(formatStatusLine(&noLabel, "", StatusInput{})); !strings.Contains(got, "25% • reset: 10h") {
+			t.Errorf("expected the separator and a single space before reset, got %q", got)
+		}
+	})
+}
+
+func TestColorModes(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	spend, budget := 80.0, 100.0
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+
+	tests := []struct {
+		mode    string
+		want    string // escape for the yellow (warn) budget
+		notWant string
+	}{
+		{"", ColorYellow, "\x1b[38;"},
+		{"basic", ColorYellow, "\x1b[38;"},
+		{"256", "\x1b[38;5;220m", ColorYellow},
+		{"truecolor", "\x1b[38;2;234;179;8m", ColorYellow},
+		{"bogus", ColorYellow, "\x1b[38;"},
+	}
+	for _, tt := range tests {
+		t.Run("mode="+tt.mode, func(t *testing.T) {
+			t.Setenv("LITELLM_COLOR_MODE", tt.mode)
+			got := formatOutput("text", info, "", StatusInput{}, nil, false)
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("expected %q in %q", tt.want, got)
+			}
+			if strings.Contains(got, tt.notWant) {
+				t.Errorf("expected no %q in %q", tt.notWant, got)
+			}
+			if !strings.Contains(got, ColorReset) {
+				t.Errorf("expected resets kept, got %q", got)
+			}
+		})
+	}
+
+	t.Run("every status color has a translation", func(t *testing.T) {
+		for mode := range colorModeReplacers {
+			for _, c := range []string{ColorGreen, ColorYellow, ColorRed, ColorBrightRed, ColorGray} {
+				if translateColors(c, mode) == c {
+					t.Errorf("mode %s leaves %q untranslated", mode, c)
+				}
+			}
+		}
+	})
+}
+
+func TestMetaColor(t *testing.T) {
+	setNow(t, fixedNow)
+	spend, budget := 10.0, 100.0
+	resetAt := fixedNow.Add(3 * time.Hour).Format(time.RFC3339)
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamBudgetResetAt: &resetAt}
+	t.Setenv("LITELLM_COLOR_MODE", "")
+
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{"", ColorGray},
+		{"blue", "\x1b[34m"},
+		{"Cyan", "\x1b[36m"},
+		{"38;5;25", "\x1b[38;5;25m"},
+		{"\x1b[35m", "\x1b[35m"},
+		{"#6b7280", "\x1b[38;2;107;114;128m"},
+		{"not-a-color", ColorGray},
+		{";;", ColorGray},
+	}
+	for _, tt := range tests {
+		t.Run("value="+tt.val, func(t *testing.T) {
+			t.Setenv("LITELLM_META_COLOR", tt.val)
+			got := formatOutput("text", info, "", StatusInput{}, nil, false)
+			if !strings.Contains(got, tt.want+"reset: 3h") {
+				t.Errorf("expected reset segment in %q, got %q", tt.want, got)
+			}
+			if tt.want != ColorGray && strings.Contains(got, ColorGray) {
+				t.Errorf("expected no default gray left, got %q", got)
+			}
+		})
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{"yellow", ColorYellow},
+		{" Blue ", "\x1b[34m"},
+		{"33", "\x1b[33m"},
+		{"38;5;25", "\x1b[38;5;25m"},
+		{"\x1b[1;31m", "\x1b[1;31m"},
+		{"#ff8800", "\x1b[38;2;255;136;0m"},
+		{"#00A0Ff", "\x1b[38;2;0;160;255m"},
+	}
+	for _, tt := range tests {
+		got, err := parseColor(tt.val)
+		if err != nil || got != tt.want {
+			t.Errorf("parseColor(%q) = %q, %v, want %q", tt.val, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "purpel", "#fff", "#gg0000", "#+12345", ";;", "\x1b[31"} {
+		if got, err := parseColor(bad); err == nil {
+			t.Errorf("parseColor(%q) = %q, expected an error", bad, got)
+		}
+	}
+}
+
+func TestRunInvalidColor(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-test")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_META_COLOR", "purpel")
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		t.Error("expected no fetch with an invalid color")
+	}))
+	defer server.Close()
+	t.Setenv("LITELLM_PROXY_URL", server.URL)
+
+	run([]string{"-file-only"})
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("expected status file, got %v", err)
+	}
+	if got := stripANSI(string(data)); !strings.Contains(got, `LITELLM_META_COLOR: invalid color "purpel"`) {
+		t.Errorf("expected the invalid color to be reported, got %q", got)
+	}
+
+	for mode, want := range map[string]string{"json": `"error":"invalid color"`, "logfmt": "error=invalid_color"} {
+		t.Setenv("LITELLM_OUTPUT", mode)
+		run([]string{"-file-only"})
+		if data, _ := os.ReadFile(out); !strings.Contains(string(data), want) {
+			t.Errorf("LITELLM_OUTPUT=%s: expected %q, got %q", mode, want, data)
+		}
+	}
+}
+
+func TestProxyDataLooksStale(t *testing.T) {
+	budget := 100.0
+	info := func(spend float64, resetAgo time.Duration) *KeyInfo {
+		resetAt := fixedNow.Add(-resetAgo).Format(time.RFC3339)
+		return &KeyInfo{Spend: &spend, MaxBudget: &budget, BudgetResetAt: &resetAt}
+	}
+	tests := []struct {
+		name string
+		info *KeyInfo
+		want bool
+	}{
+		{"past reset with spend left over", info(40, time.Hour), true},
+		{"past reset, spend reset to zero", info(0, time.Hour), false},
+		{"past reset, near-zero spend", info(0.5, time.Hour), false},
+		{"within the proxy's grace period", info(40, 5*time.Minute), false},
+		{"reset still ahead", info(40, -time.Hour), false},
+		{"no reset time", &KeyInfo{Spend: &budget, MaxBudget: &budget}, false},
+	}
+	for _, tt := range tests {
+		if got := proxyDataLooksStale(tt.info, fixedNow); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFormatStatusLineProxyStaleMarker(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	setNow(t, fixedNow)
+	spend, budget := 40.0, 100.0
+	resetAt := fixedNow.Add(-2 * time.Hour).Format(time.RFC3339)
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamBudgetResetAt: &resetAt}
+
+	t.Setenv("LITELLM_DEBUG", "1")
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); !strings.Contains(got, "reset: overdue by 2h (stale?)") {
+		t.Errorf("expected stale marker in debug mode, got %q", got)
+	}
+	t.Setenv("LITELLM_DEBUG", "")
+	if got := formatStatusLine(info, "", StatusInput{}); strings.Contains(got, "stale?") {
+		t.Errorf("expected no marker outside debug mode, got %q", got)
+	}
+}
+
+func TestFetchKeyInfoRequestID(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_DEBUG", "1")
+
+	origID := newRequestID
+	defer func() { newRequestID = origID }()
+	newRequestID = func() string { return "req-0001" }
+
+	var logs strings.Builder
+	origOut := debugOut
+	defer func() { debugOut = origOut }()
+	debugOut = &logs
+
+	var gotID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID = r.Header.Get("X-Request-ID")
+		_, _ = w.Write([]byte(`{"info": {"spend": 1}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	if _, err := fetchKeyInfo("test-token"); err != nil {
+		t.Fatal(err)
+	}
+	if gotID != "req-0001" {
+		t.Errorf("expected X-Request-ID header, got %q", gotID)
+	}
+	if !strings.Contains(logs.String(), "request_id=req-0001 status=200") {
+		t.Errorf("expected request ID and status in debug log, got %q", logs.String())
+	}
+}
+
+func TestNewRequestIDFormat(t *testing.T) {
+	id := newRequestID()
+	if len(id) != 36 || id[14] != '4' || strings.Count(id, "-") != 4 {
+		t.Errorf("expected a UUIDv4, got %q", id)
+	}
+	if id == newRequestID() {
+		t.Error("expected unique IDs")
+	}
+}
+
+func TestGetKeyInfoOffline(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-offline")
+	t.Setenv("LITELLM_OFFLINE", "1")
+
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		_, _ = w.Write([]byte(`{"info": {"spend": 1}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	_, err := getKeyInfo("key-offline")
+	if !errors.Is(err, ErrNoCachedData) {
+		t.Fatalf("expected ErrNoCachedData with an empty cache, got %v", err)
+	}
+	if got := stripANSI(renderLine(nil, "", StatusInput{}, err)); !strings.Contains(got, "No cached data") {
+		t.Errorf("expected 'No cached data', got %q", got)
+	}
+
+	spend := 40.0
+	budget := 100.0
+	writeAgedBudgetCache(t, KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, 24*time.Hour)
+
+	info, err := getKeyInfo("key-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.TeamSpend == nil || *info.TeamSpend != 40.0 {
+		t.Errorf("expected the stale cached spend 40, got %v", info.TeamSpend)
+	}
+	revalidations.Wait()
+	if callCount != 0 {
+		t.Errorf("expected no HTTP calls in offline mode, got %d", callCount)
+	}
+}
+
+func TestRunRecoversFromPanic(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-panic")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "LiteLLM:")
+	t.Setenv("LITELLM_DEBUG", "1")
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+
+	var logs strings.Builder
+	origOut := debugOut
+	defer func() { debugOut = origOut }()
+	debugOut = &logs
+
+	origNow := nowFunc
+	defer func() { nowFunc = origNow }()
+	nowFunc = func() time.Time { panic("injected") }
+
+	if got := run([]string{"-file-only", "-exit-code"}); got != ExitOK {
+		t.Errorf("expected ExitOK after a panic, got %d", got)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stripANSI(string(data)); !strings.Contains(got, "LiteLLM: internal error") {
+		t.Errorf("expected internal error status, got %q", got)
+	}
+	if !strings.Contains(logs.String(), "panic: injected") || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("expected panic and stack in debug log, got %q", logs.String())
+	}
+
+	t.Run("json mode", func(t *testing.T) {
+		run([]string{"-file-only", "-json"})
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status StatusJSON
+		if err := json.Unmarshal(data, &status); err != nil || status.Error != "internal error" {
+			t.Errorf("expected a JSON internal error, got %q (%v)", data, err)
+		}
+	})
+
+	t.Run("logfmt mode", func(t *testing.T) {
+		t.Setenv("LITELLM_OUTPUT", "logfmt")
+		run([]string{"-file-only"})
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "error=internal") {
+			t.Errorf("expected error=internal, got %q", data)
+		}
+	})
+}
+
+func TestHandleDaemonConnRecoversFromPanic(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-panic")
+	t.Setenv("ANTHROPIC_BASE_URL", "http://127.0.0.1:1")
+
+	origNow := nowFunc
+	defer func() { nowFunc = origNow }()
+	nowFunc = func() time.Time { panic("injected") }
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleDaemonConn(server, "text")
+	}()
+	// The handler restores the process-wide output settings on return.
+	defer func() { <-done }()
+
+	if err := json.NewEncoder(client).Encode(daemonRequest{Mode: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	var reply daemonReply
+	if err := json.NewDecoder(client).Decode(&reply); err != nil {
+		t.Fatalf("decode reply: %v", err)
+	}
+	var status StatusJSON
+	if err := json.Unmarshal([]byte(reply.Line), &status); err != nil || status.Error != "internal error" {
+		t.Errorf("expected a JSON internal error in the client's mode, got %q (%v)", reply.Line, err)
+	}
+}
+
+func TestFormatCompact(t *testing.T) {
+	tests := []struct {
+		n    float64
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{999.6, "1k"},
+		{1000, "1k"},
+		{1234, "1.2k"},
+		{1234567, "1.2M"},
+		{999960, "1M"},
+		{2500000000, "2.5B"},
+	}
+	for _, tt := range tests {
+		if got := formatCompact(tt.n); got != tt.want {
+			t.Errorf("formatCompact(%v) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestTokensSegment(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"info": {"spend": 10, "max_budget": 100, "total_tokens": 1234567}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	info, err := fetchKeyInfo("test-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.TotalTokens == nil || *info.TotalTokens != 1234567 {
+		t.Fatalf("expected total_tokens 1234567, got %v", info.TotalTokens)
+	}
+
+	t.Setenv("LITELLM_SHOW_TOKENS", "")
+	if got := formatTokensSegment(info); got != "" {
+		t.Errorf("expected no segment when disabled, got %q", got)
+	}
+
+	t.Setenv("LITELLM_SHOW_TOKENS", "1")
+	if got := stripANSI(formatTokensSegment(info)); got != " | 1.2M tok" {
+		t.Errorf("expected ' | 1.2M tok', got %q", got)
+	}
+	if got := formatTokensSegment(&KeyInfo{}); got != "" {
+		t.Errorf("expected no segment without token data, got %q", got)
+	}
+
+	spend, budget := 10.0, 100.0
+	info.TeamSpend, info.TeamMaxBudget = &spend, &budget
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); got != "◔ 10% | 1.2M tok" {
+		t.Errorf("expected the tokens segment on the statusline, got %q", got)
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_BASE_URL", "")
+	t.Setenv("OPENAI_BASE_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "")
+
+	newServer := func(status int, body string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/team/info" {
+			_, _ = w.Write([]byte(`{"team_info": {"spend": 10, "max_budget": 100}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"info": {"spend": 10, "team_id": "t1"}}`))
+	}))
+	t.Cleanup(good.Close)
+	noBudget := newServer(http.StatusOK, `{"info": {"spend": 10}}`)
+	// The statusline ignores a key-level max_budget, so the check must too.
+	keyOnlyBudget := newServer(http.StatusOK, `{"info": {"spend": 10, "max_budget": 100}}`)
+	unauthorized := newServer(http.StatusUnauthorized, `{"error": "invalid key"}`)
+
+	tests := []struct {
+		name     string
+		token    string
+		baseURL  string
+		wantCode int
+		want     []string
+	}{
+		{"all good", "sk-1", good.URL, ExitOK, []string{"✓ API key is set", "✓ proxy URL is valid", "✓ /key/info is reachable", "✓ response has budget fields"}},
+		{"no token", "", good.URL, ExitError, []string{"✗ API key is set", "LITELLM_PROXY_API_KEY"}},
+		{"no URL", "sk-1", "", ExitError, []string{"✓ API key is set", "✗ proxy URL is valid", "set LITELLM_PROXY_URL"}},
+		{"bad URL", "sk-1", "litellm.example.com", ExitError, []string{"✗ proxy URL is valid", "not an http(s) URL"}},
+		{"auth rejected", "sk-1", unauthorized.URL, ExitError, []string{"✗ /key/info is reachable", "rejected the API key"}},
+		{"unreachable", "sk-1", "http://127.0.0.1:1", ExitError, []string{"✗ /key/info is reachable", "could not connect"}},
+		{"no budget is a warning", "sk-1", noBudget.URL, ExitOK, []string{"✓ /key/info is reachable", "! response has budget fields", "proxy admin"}},
+		{"key-only budget is a warning", "sk-1", keyOnlyBudget.URL, ExitOK, []string{"✓ /key/info is reachable", "! response has budget fields", "key-level max_budget"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			t.Setenv("ANTHROPIC_AUTH_TOKEN", tt.token)
+			t.Setenv("ANTHROPIC_BASE_URL", tt.baseURL)
+
+			var out strings.Builder
+			if code := writeSelfTest(&out, runSelfTest()); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("expected %q in checklist, got:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	tests := []struct {
+		name, base, path string
+		query            url.Values
+		want             string
+	}{
+		{"plain", "https://proxy.example", "/key/info", nil, "https://proxy.example/key/info"},
+		{"IPv6 loopback", "http://[::1]:4000", "/key/info", nil, "http://[::1]:4000/key/info"},
+		{"IPv6 unique local", "http://[fd00::12:34]", "/key/info", nil, "http://[fd00::12:34]/key/info"},
+		{"custom port", "http://localhost:65000", "/key/info", nil, "http://localhost:65000/key/info"},
+		{"path prefix", "https://gw.example/litellm", "/key/info", nil, "https://gw.example/litellm/key/info"},
+		{"path prefix with slash", "https://gw.example/litellm/", "/key/info", nil, "https://gw.example/litellm/key/info"},
+		{"query escaped", "http://[::1]:4000", "/team/info", url.Values{"team_id": {"a b&c"}}, "http://[::1]:4000/team/info?team_id=a+b%26c"},
+		{"base query kept", "https://proxy.example?tenant=x", "/key/info", url.Values{"k": {"v"}}, "https://proxy.example/key/info?k=v&tenant=x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := apiURL(tt.base, tt.path, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("apiURL(%q, %q) = %q, want %q", tt.base, tt.path, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := apiURL("http://[::1", "/key/info", nil); err == nil {
+		t.Error("expected an error for an unterminated IPv6 host")
+	}
+}
+
+func TestFetchKeyInfoPathPrefixedBase(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, _ = w.Write([]byte(`{"info": {"spend": 1}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL+"/litellm/")
+
+	if _, err := fetchKeyInfo("test-token"); err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/litellm/key/info" {
+		t.Errorf("expected /litellm/key/info, got %q", gotPath)
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	tests := []struct {
+		age  time.Duration
+		want string
+	}{
+		{0, "just now"},
+		{59 * time.Second, "just now"},
+		{2 * time.Minute, "2m ago"},
+		{59*time.Minute + 59*time.Second, "59m ago"},
+		{3 * time.Hour, "3h ago"},
+		{50 * time.Hour, "2d ago"},
+	}
+	for _, tt := range tests {
+		if got := formatAge(tt.age); got != tt.want {
+			t.Errorf("formatAge(%v) = %q, want %q", tt.age, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAgeSegment(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "https://age.example")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-age")
+	t.Setenv("LITELLM_CACHE_TTL_MS", "")
+	setNow(t, fixedNow)
+
+	t.Setenv("LITELLM_SHOW_AGE", "1")
+	if got := formatAgeSegment(); got != "" {
+		t.Errorf("expected no segment without a cache, got %q", got)
+	}
+
+	writeAgedBudgetCache(t, KeyInfo{}, 10*time.Second)
+	if got := formatAgeSegment(); got != separator(ColorGray)+ColorGray+"just now"+ColorReset {
+		t.Errorf("expected gray 'just now' within the TTL, got %q", got)
+	}
+
+	writeAgedBudgetCache(t, KeyInfo{}, 2*time.Minute)
+	if got := formatAgeSegment(); got != separator(ColorGray)+ColorYellow+"2m ago"+ColorReset {
+		t.Errorf("expected yellow '2m ago' past the TTL, got %q", got)
+	}
+
+	t.Setenv("LITELLM_SHOW_AGE", "")
+	if got := formatAgeSegment(); got != "" {
+		t.Errorf("expected no segment when disabled, got %q", got)
+	}
+}
+
+func TestFormatStatusLineHideReset(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	setNow(t, fixedNow)
+
+	spend, budget := 25.0, 100.0
+	info := &KeyInfo{
+		TeamSpend:          &spend,
+		TeamMaxBudget:      &budget,
+		TeamBudgetDuration: strPtr("7d"),
+		TeamBudgetResetAt:  strPtr(fixedNow.Add(10 * time.Hour).Format(time.RFC3339)),
+	}
+
+	t.Setenv("LITELLM_HIDE_RESET", "")
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); !strings.Contains(got, "reset: 10h") {
+		t.Fatalf("expected the reset segment by default, got %q", got)
+	}
+
+	t.Setenv("LITELLM_HIDE_RESET", "1")
+	got := stripANSI(formatStatusLine(info, "", StatusInput{}))
+	if strings.Contains(got, "reset") || strings.Contains(got, "weekly") {
+		t.Errorf("expected no reset segment with LITELLM_HIDE_RESET, got %q", got)
+	}
+	if !strings.Contains(got, "25%") {
+		t.Errorf("expected the budget to remain, got %q", got)
+	}
+}
+
+func TestLogEnvFingerprint(t *testing.T) {
+	var logs strings.Builder
+	origOut := debugOut
+	defer func() { debugOut = origOut }()
+	debugOut = &logs
+
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-secret-value")
+	t.Setenv("ANTHROPIC_BASE_URL", "https://proxy.internal.example")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_CACHE_TTL_MS", "45000")
+	t.Setenv("LITELLM_RETRIES", "3")
+	t.Setenv("UNRELATED_TOKEN", "not-ours")
+
+	t.Setenv("LITELLM_DEBUG", "")
+	logEnvFingerprint()
+	if logs.Len() != 0 {
+		t.Fatalf("expected nothing outside debug mode, got %q", logs.String())
+	}
+
+	t.Setenv("LITELLM_DEBUG", "1")
+	logEnvFingerprint()
+	got := logs.String()
+	if strings.Count(got, "\n") != 1 {
+		t.Errorf("expected a single line, got %q", got)
+	}
+	for _, want := range []string{"LITELLM_PROXY_API_KEY", "ANTHROPIC_BASE_URL", "LITELLM_PLUGIN_PREFIX", "LITELLM_DEBUG", "cache_ttl_ms=45000", "retries=3"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in %q", want, got)
+		}
+	}
+	for _, leak := range []string{"sk-secret-value", "proxy.internal.example", "UNRELATED_TOKEN", "not-ours"} {
+		if strings.Contains(got, leak) {
+			t.Errorf("fingerprint must not contain %q: %q", leak, got)
+		}
+	}
+}
+
+func TestWarnEnvConflicts(t *testing.T) {
+	t.Setenv("LITELLM_DEBUG", "1")
+	t.Setenv("LITELLM_BASE_URL", "")
+	t.Setenv("OPENAI_BASE_URL", "")
+
+	var logs strings.Builder
+	origOut := debugOut
+	defer func() { debugOut = origOut }()
+	debugOut = &logs
+
+	tests := []struct {
+		name                 string
+		proxyURL, anthropURL string
+		proxyKey, authToken  string
+		want                 []string
+	}{
+		{"single URL", "https://a.example", "", "sk-1", "", nil},
+		{"same URL twice", "https://a.example/", "https://a.example", "sk-1", "sk-1", nil},
+		{"conflicting URLs", "https://a.example", "https://b.example", "", "", []string{"ANTHROPIC_BASE_URL=https://b.example is set but ignored: LITELLM_PROXY_URL=https://a.example takes priority"}},
+		{"conflicting keys", "", "", "sk-1", "sk-2", []string{"ANTHROPIC_AUTH_TOKEN is set but ignored: LITELLM_PROXY_API_KEY takes priority"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			t.Setenv("LITELLM_PROXY_URL", tt.proxyURL)
+			t.Setenv("ANTHROPIC_BASE_URL", tt.anthropURL)
+			t.Setenv("LITELLM_PROXY_API_KEY", tt.proxyKey)
+			t.Setenv("ANTHROPIC_AUTH_TOKEN", tt.authToken)
+
+			warnEnvConflicts()
+			got := logs.String()
+			if len(tt.want) == 0 && got != "" {
+				t.Errorf("expected no warning, got %q", got)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected %q in log, got %q", want, got)
+				}
+			}
+			if strings.Contains(got, "sk-") {
+				t.Errorf("API key leaked into the log: %q", got)
+			}
+		})
+	}
+}
+
+func TestFetchKeyInfoUserAgent(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+
+	var gotUA string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA = r.Header.Get("User-Agent")
+		_, _ = w.Write([]byte(`{"info": {"spend": 1}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	t.Setenv("LITELLM_USER_AGENT", "")
+	if _, err := fetchKeyInfo("test-token"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "claude-code-litellm-plugin/" + Version; gotUA != want {
+		t.Errorf("User-Agent = %q, want %q", gotUA, want)
+	}
+
+	t.Setenv("LITELLM_USER_AGENT", "acme-statusline/1.0")
+	if _, err := fetchKeyInfo("test-token"); err != nil {
+		t.Fatal(err)
+	}
+	if gotUA != "acme-statusline/1.0" {
+		t.Errorf("User-Agent = %q, want the override", gotUA)
+	}
+}
+
+// TestGetKeyInfoSecondaryResetWindow covers a daily member cap inside a monthly team
+// budget: the team's own window is kept as the secondary reset.
+func TestGetKeyInfoSecondaryResetWindow(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	setNow(t, fixedNow)
+
+	memberSpend, memberBudget := 4.0, 10.0
+	teamSpend, teamBudget := 300.0, 1000.0
+	daily, monthly := "1d", "30d"
+	dailyReset := fixedNow.Add(3 * time.Hour).Format(time.RFC3339)
+	monthlyReset := fixedNow.Add(12 * 24 * time.Hour).Format(time.RFC3339)
+	teamID, userID := "team-1", "jane@example.com"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/key/info":
+			_ = json.NewEncoder(w).Encode(KeyInfoResponse{Info: KeyInfo{TeamID: &teamID, UserID: &userID}})
+		case "/team/info":
+			_ = json.NewEncoder(w).Encode(TeamInfoAPIResponse{
+				TeamInfo: TeamInfoData{Spend: &teamSpend, MaxBudget: &teamBudget, BudgetDuration: &monthly, BudgetResetAt: &monthlyReset},
+				TeamMemberships: []TeamMembership{{
+					UserID: userID,
+					TeamID: teamID,
+					Spend:  &memberSpend,
+					LitellmBudgetTable: &TeamMemberBudgetTable{
+						MaxBudget: &memberBudget, BudgetDuration: &daily, BudgetResetAt: &dailyReset,
+					},
+				}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	info, err := getKeyInfo("test-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derefString(info.SecondaryBudgetDuration) != monthly || derefString(info.SecondaryBudgetResetAt) != monthlyReset {
+		t.Errorf("expected the monthly team window as secondary, got %v / %v", info.SecondaryBudgetDuration, info.SecondaryBudgetResetAt)
+	}
+}
+
+func TestResetColor(t *testing.T) {
+	setNow(t, fixedNow)
+	near := fixedNow.Add(2 * time.Hour).Format(time.RFC3339)
+	far := fixedNow.Add(3 * 24 * time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name    string
+		hours   string
+		resetAt string
+		percent float64
+		want    string
+	}{
+		{"unset", "", far, 95, ColorGray},
+		{"invalid", "soon", far, 95, ColorGray},
+		{"low usage, distant reset", "24", far, 50, ColorGray},
+		{"warn band, distant reset", "24", far, 80, ColorYellow},
+		{"critical band, distant reset", "24", far, 95, ColorRed},
+		{"exhausted, distant reset", "24", far, 120, ColorRed},
+		{"critical band, reset close", "24", near, 95, ColorGray},
+		{"zero hours colors any wait", "0", near, 95, ColorRed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LITELLM_RESET_WARN_HOURS", tt.hours)
+			info := &KeyInfo{BudgetResetAt: &tt.resetAt}
+			if got := resetColor(info, tt.percent, fixedNow); got != tt.want {
+				t.Errorf("resetColor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("nearer secondary window decides", func(t *testing.T) {
+		t.Setenv("LITELLM_RESET_WARN_HOURS", "24")
+		info := &KeyInfo{BudgetResetAt: &far, SecondaryBudgetResetAt: &near}
+		if got := resetColor(info, 95, fixedNow); got != ColorGray {
+			t.Errorf("expected gray when the nearer reset is close, got %q", got)
+		}
+	})
+
+	t.Run("status line", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+		t.Setenv("LITELLM_ALERT_BUDGET", "")
+		t.Setenv("LITELLM_RESET_WARN_HOURS", "24")
+		spend, budget := 95.0, 100.0
+		got := formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget, TeamBudgetResetAt: &far}, "", StatusInput{})
+		if !strings.Contains(got, ColorRed+"reset: 3d") {
+			t.Errorf("expected a red reset countdown, got %q", got)
+		}
+	})
+}
+
+func TestFormatResetSegmentMultipleWindows(t *testing.T) {
+	setNow(t, fixedNow)
+	t.Setenv("LITELLM_RESET_FORMAT", "")
+	t.Setenv("LITELLM_RESET_UNITS", "")
+
+	soon := fixedNow.Add(3 * time.Hour).Format(time.RFC3339)
+	later := fixedNow.Add(12 * 24 * time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name    string
+		info    KeyInfo
+		showAll string
+		want    string
+	}{
+		{"primary only", KeyInfo{BudgetResetAt: &soon, BudgetDuration: strPtr("1d")}, "", " daily reset: 3h"},
+		{"primary nearer", KeyInfo{BudgetResetAt: &soon, BudgetDuration: strPtr("1d"), SecondaryBudgetResetAt: &later, SecondaryBudgetDuration: strPtr("30d")}, "", " daily reset: 3h"},
+		{"secondary nearer", KeyInfo{BudgetResetAt: &later, BudgetDuration: strPtr("30d"), SecondaryBudgetResetAt: &soon, SecondaryBudgetDuration: strPtr("1d")}, "", " daily reset: 3h"},
+		{"primary unknown", KeyInfo{SecondaryBudgetResetAt: &later, SecondaryBudgetDuration: strPtr("30d")}, "", " monthly reset: 12d0h"},
+		{"show both", KeyInfo{BudgetResetAt: &soon, BudgetDuration: strPtr("1d"), SecondaryBudgetResetAt: &later, SecondaryBudgetDuration: strPtr("30d")}, "1", " reset: 3h (daily) / 12d0h (monthly)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LITELLM_SHOW_ALL_RESETS", tt.showAll)
+			if got := stripANSI(formatResetSegment(&tt.info, ColorGray)); got != tt.want {
+				t.Errorf("formatResetSegment() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func benchmarkStatusInfo() *KeyInfo {
+	spend, budget := 25.0, 100.0
+	return &KeyInfo{
+		TeamSpend:          &spend,
+		TeamMaxBudget:      &budget,
+		TeamBudgetDuration: strPtr("7d"),
+		TeamBudgetResetAt:  strPtr(fixedNow.Add(10 * time.Hour).Format(time.RFC3339)),
+	}
+}
+
+func BenchmarkFormatStatusLine(b *testing.B) {
+	b.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	setNow(b, fixedNow)
+	info := benchmarkStatusInfo()
+	b.ReportAllocs()
+	for b.Loop() {
+		formatStatusLine(info, "", StatusInput{})
+	}
+}
+
+func TestFormatStatusLineAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector adds allocations")
+	}
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	setNow(t, fixedNow)
+	info := benchmarkStatusInfo()
+
+	want := ColorGreen + "◔" + ColorReset + " " + ColorGreen + "25%" + ColorReset + " " + ColorGray + "weekly reset: 10h" + ColorReset
+	if got := formatStatusLine(info, "", StatusInput{}); got != want {
+		t.Fatalf("formatStatusLine() = %q, want %q", got, want)
+	}
+	// Down from 19 with chained Sprintf; catches regressions on the per-refresh path.
+	if allocs := testing.AllocsPerRun(100, func() { formatStatusLine(info, "", StatusInput{}) }); allocs > 11 {
+		t.Errorf("formatStatusLine allocated %v times per call, want ≤ 11", allocs)
+	}
+}
+
+func TestAPITransport(t *testing.T) {
+	if got := apiTransport(false); got != http.DefaultTransport {
+		t.Errorf("expected the default transport without LITELLM_FORCE_HTTP2, got %T", got)
+	}
+	tr, ok := apiTransport(true).(*http.Transport)
+	if !ok || tr.Protocols == nil {
+		t.Fatalf("expected a transport with explicit protocols, got %#v", tr)
+	}
+	if tr.Protocols.HTTP1() || !tr.Protocols.HTTP2() || !tr.Protocols.UnencryptedHTTP2() {
+		t.Errorf("expected HTTP/2 only (TLS and prior knowledge), got %v", tr.Protocols)
+	}
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	t.Setenv("LITELLM_CONNECT_TIMEOUT_MS", "")
+	t.Setenv("LITELLM_READ_TIMEOUT_MS", "")
+	if c := newAPIClient(); c.Timeout != HTTPTimeout || c.Transport != http.DefaultTransport {
+		t.Errorf("expected the single HTTPTimeout by default, got %v with %T", c.Timeout, c.Transport)
+	}
+
+	t.Setenv("LITELLM_CONNECT_TIMEOUT_MS", "500")
+	t.Setenv("LITELLM_READ_TIMEOUT_MS", "10000")
+	c := newAPIClient()
+	if c.Timeout != 10500*time.Millisecond {
+		t.Errorf("expected the overall timeout to be connect+read, got %v", c.Timeout)
+	}
+	tr, ok := c.Transport.(*http.Transport)
+	if !ok || tr.ResponseHeaderTimeout != 10*time.Second || tr.TLSHandshakeTimeout != 500*time.Millisecond {
+		t.Errorf("expected phase timeouts on the transport, got %#v", c.Transport)
+	}
+
+	t.Setenv("LITELLM_CONNECT_TIMEOUT_MS", "bogus")
+	if connect, read, split := getPhaseTimeouts(); !split || connect != HTTPTimeout || read != 10*time.Second {
+		t.Errorf("expected an invalid phase to default to HTTPTimeout, got %v/%v/%v", connect, read, split)
+	}
+}
+
+func TestFetchKeyInfoConnectTimeout(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+	// 10.255.255.1 is unroutable: the dial hangs until the connect timeout (or fails
+	// at once where there's no route at all).
+	t.Setenv("ANTHROPIC_BASE_URL", "http://10.255.255.1")
+	t.Setenv("LITELLM_CONNECT_TIMEOUT_MS", "100")
+	t.Setenv("LITELLM_READ_TIMEOUT_MS", "10000")
+
+	start := time.Now()
+	_, err := fetchKeyInfo("test-token")
+	if err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the connect timeout to fail fast, took %v", elapsed)
+	}
+	if !isConnectionError(err) {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+}
+
+func TestFetchKeyInfoReadTimeout(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_CONNECT_TIMEOUT_MS", "1000")
+	t.Setenv("LITELLM_READ_TIMEOUT_MS", "50")
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte(`{"info": {"spend": 1}}`))
+	}))
+	defer server.Close()
+	defer close(release)
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	if _, err := fetchKeyInfo("test-token"); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected a response header timeout, got %v", err)
+	}
+}
+
+func TestFetchKeyInfoForceHTTP2(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_FORCE_HTTP2", "1")
+
+	var gotProto string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotProto = r.Proto
+		_, _ = w.Write([]byte(`{"info": {"spend": 1}}`))
+	}))
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server.Config.Protocols = &protocols
+	server.Start()
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	if _, err := fetchKeyInfo("test-token"); err != nil {
+		t.Fatal(err)
+	}
+	if gotProto != "HTTP/2.0" {
+		t.Errorf("expected an h2c request with prior knowledge, got %s", gotProto)
+	}
+}
+
+func TestFetchKeyInfoHTMLResponse(t *testing.T) {
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_DEBUG", "1")
+
+	var logs strings.Builder
+	origOut := debugOut
+	defer func() { debugOut = origOut }()
+	debugOut = &logs
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<!DOCTYPE html>\n<html><body>Sign in — token sk-secret-123 expired" + strings.Repeat(" padding", 50) + "</body></html>"))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	_, err := fetchKeyInfo("sk-secret-123")
+	if !errors.Is(err, ErrBadResponse) {
+		t.Fatalf("expected ErrBadResponse, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected no retry on a parse failure, got %d calls", calls)
+	}
+	if got := stripANSI(renderLine(nil, "", StatusInput{}, err)); !strings.Contains(got, "Unexpected response") {
+		t.Errorf("expected 'Unexpected response', got %q", got)
+	}
+
+	log := logs.String()
+	if !strings.Contains(log, "[body=<!DOCTYPE html> <html><body>Sign in") {
+		t.Errorf("expected a one-line body snippet in the debug log, got %q", log)
+	}
+	if strings.Contains(log, "secret-123") {
+		t.Errorf("expected the key to be redacted, got %q", log)
+	}
+	if strings.Contains(log, "</html>") {
+		t.Errorf("expected the snippet to be truncated to 100 bytes, got %q", log)
+	}
+}
+
+func TestRPMSegment(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"info": {"spend": 10, "rpm_limit": 500, "rpm_usage": 120}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	info, err := fetchKeyInfo("test-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RPMLimit == nil || *info.RPMLimit != 500 || info.RPMUsage == nil || *info.RPMUsage != 120 {
+		t.Fatalf("expected rpm_limit 500 and rpm_usage 120, got %v / %v", info.RPMLimit, info.RPMUsage)
+	}
+
+	t.Setenv("LITELLM_SHOW_RPM", "")
+	if got := formatRPMSegment(info); got != "" {
+		t.Errorf("expected no segment when disabled, got %q", got)
+	}
+
+	t.Setenv("LITELLM_SHOW_RPM", "1")
+	limit := int64(500)
+	tests := []struct {
+		name      string
+		usage     *int64
+		want      string
+		wantColor string
+	}{
+		{"usage known", info.RPMUsage, " | 120/500 rpm", ColorGreen},
+		{"near limit", func() *int64 { n := int64(460); return &n }(), " | 460/500 rpm", ColorRed},
+		{"limit only", nil, " | 500 rpm", ColorGray},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatRPMSegment(&KeyInfo{RPMLimit: &limit, RPMUsage: tt.usage})
+			if stripANSI(got) != tt.want {
+				t.Errorf("formatRPMSegment() = %q, want %q", stripANSI(got), tt.want)
+			}
+			if !strings.Contains(got, tt.wantColor+strings.TrimPrefix(tt.want, " | ")) {
+				t.Errorf("expected %q colored segment, got %q", colorName(tt.wantColor), got)
+			}
+		})
+	}
+
+	if got := formatRPMSegment(&KeyInfo{}); got != "" {
+		t.Errorf("expected no segment without rpm_limit, got %q", got)
+	}
+
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	spend, budget := 10.0, 100.0
+	info.TeamSpend, info.TeamMaxBudget = &spend, &budget
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); got != "◔ 10% | 120/500 rpm" {
+		t.Errorf("expected the rpm segment on the statusline, got %q", got)
+	}
+}
+
+func TestFormatStatusLineHideWhenZero(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_HIDE_WHEN_ZERO", "1")
+
+	zero, some, budget := 0.0, 0.01, 100.0
+	if got := formatStatusLine(&KeyInfo{TeamSpend: &zero, TeamMaxBudget: &budget}, "", StatusInput{}); got != "" {
+		t.Errorf("expected an empty line at zero spend, got %q", got)
+	}
+	if got := stripANSI(formatStatusLine(&KeyInfo{TeamSpend: &some, TeamMaxBudget: &budget}, "", StatusInput{})); !strings.Contains(got, "0%") {
+		t.Errorf("expected the status to reappear once spend is nonzero, got %q", got)
+	}
+
+	t.Setenv("LITELLM_HIDE_WHEN_ZERO", "")
+	if got := stripANSI(formatStatusLine(&KeyInfo{TeamSpend: &zero, TeamMaxBudget: &budget}, "", StatusInput{})); got != "○ 0%" {
+		t.Errorf("expected zero spend to be shown by default, got %q", got)
+	}
+}
+
+func TestFormatStatusLineMinSpend(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_HIDE_WHEN_ZERO", "")
+	t.Setenv("LITELLM_MIN_SPEND", "$1")
+
+	line := func(spend, budget float64) string {
+		return stripANSI(formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{}))
+	}
+	if got := line(0.50, 100); got != "" {
+		t.Errorf("expected an empty line below the floor, got %q", got)
+	}
+	if got := line(1, 100); got != "◔ 1%" {
+		t.Errorf("expected the status once spend reaches the floor, got %q", got)
+	}
+	// $0.90 of a $1.00 budget is below the floor but nearly exhausted.
+	if got := line(0.90, 1); got != "● 90%" {
+		t.Errorf("expected a near-cap budget to be shown below the floor, got %q", got)
+	}
+
+	for _, val := range []string{"", "abc", "0", "-1"} {
+		t.Setenv("LITELLM_MIN_SPEND", val)
+		if got := line(0.50, 100); got == "" {
+			t.Errorf("LITELLM_MIN_SPEND=%q: expected no floor, got an empty line", val)
+		}
+	}
+}
+
+func TestFormatStatusLineNullSpend(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_HIDE_RESET", "1")
+	t.Setenv("LITELLM_DEBUG", "1")
+	var logs strings.Builder
+	origDebug := debugOut
+	debugOut = &logs
+	defer func() { debugOut = origDebug }()
+
+	budget := 100.0
+	info := &KeyInfo{TeamMaxBudget: &budget}
+
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "1")
+	t.Setenv("LITELLM_MARK_NULL_SPEND", "")
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); got != "○ $0.00/$100.00 (0%)" {
+		t.Errorf("expected null spend shown as zero by default, got %q", got)
+	}
+	if !strings.Contains(logs.String(), "null spend") {
+		t.Errorf("expected a debug warning about the null spend, got %q", logs.String())
+	}
+
+	t.Setenv("LITELLM_MARK_NULL_SPEND", "1")
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); got != "○ $?/$100.00" {
+		t.Errorf("expected $?/$100.00, got %q", got)
+	}
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "")
+	if got := stripANSI(formatStatusLine(info, "", StatusInput{})); got != "○ ?%" {
+		t.Errorf("expected ?%%, got %q", got)
+	}
+
+	logs.Reset()
+	spend := 0.0
+	formatStatusLine(&KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}, "", StatusInput{})
+	if strings.Contains(logs.String(), "null spend") {
+		t.Errorf("expected no warning for a reported zero spend, got %q", logs.String())
+	}
+}
+
+func TestRunBaseURLAndTokenFlags(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "http://127.0.0.1:1")
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-from-env")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_DEBUG", "1")
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+
+	var logs strings.Builder
+	origOut := debugOut
+	defer func() { debugOut = origOut }()
+	debugOut = &logs
+
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"info": {"spend": 1}}`))
+	}))
+	defer server.Close()
+
+	run([]string{"-file-only", "-base-url", server.URL, "-token", "sk-from-flag"})
+
+	if gotAuth != "Bearer sk-from-flag" {
+		t.Errorf("expected the -token flag to win over the env, got %q", gotAuth)
+	}
+	if getBaseURL() != server.URL {
+		t.Errorf("expected the -base-url flag to win over the env, got %q", getBaseURL())
+	}
+	if strings.Contains(logs.String(), "sk-from-flag") {
+		t.Errorf("token leaked into the debug log: %q", logs.String())
+	}
+}
+
+func TestRunFastFlag(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-test")
+	t.Setenv("LITELLM_RETRIES", "")
+	t.Setenv("LITELLM_CONNECT_TIMEOUT_MS", "")
+	t.Setenv("LITELLM_READ_TIMEOUT_MS", "")
+	t.Setenv("LITELLM_OUTPUT_FILE", filepath.Join(t.TempDir(), "out.txt"))
+
+	origFileOnly, origSleep := outputFileOnly, retrySleep
+	defer func() { outputFileOnly, retrySleep = origFileOnly, origSleep }()
+	retrySleep = func(time.Duration) {}
+
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		callCount++
+		_, _ = w.Write([]byte(`{"error":{"message":"temporarily unavailable"}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	for _, tt := range []struct {
+		args      []string
+		wantCalls int
+	}{
+		{[]string{"-file-only"}, 1 + DefaultRetries},
+		{[]string{"-file-only", "-fast"}, 1},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			callCount = 0
+			run(tt.args)
+			if callCount != tt.wantCalls {
+				t.Errorf("expected %d attempts, got %d", tt.wantCalls, callCount)
+			}
+		})
+	}
+	if connect, read, split := getPhaseTimeouts(); !split || connect != FastConnectTimeout || read != FastReadTimeout {
+		t.Errorf("expected -fast to shorten the timeouts, got connect=%v read=%v", connect, read)
+	}
+}
+
+func TestRunColorFlag(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-test")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("NO_COLOR", "1")
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+
+	origFileOnly, origPlain := outputFileOnly, plainOutput
+	defer func() { outputFileOnly, plainOutput = origFileOnly, origPlain }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"info": {"spend": 1, "max_budget": 10}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	for _, tt := range []struct {
+		mode      string
+		wantColor bool
+	}{
+		{"always", true},
+		{"never", false},
+		{"auto", false}, // NO_COLOR is set
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			run([]string{"-file-only", "-color=" + tt.mode})
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatalf("expected status file, got %v", err)
+			}
+			if got := strings.Contains(string(data), "\x1b["); got != tt.wantColor {
+				t.Errorf("-color=%s: color in %q = %v, want %v", tt.mode, data, got, tt.wantColor)
+			}
+		})
+	}
+}
+
+func TestDaemonRoundTrip(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-test")
+	// Unset so the prefix comes from the forwarded model name.
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	if err := os.Unsetenv("LITELLM_PLUGIN_PREFIX"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LITELLM_SOCKET", filepath.Join(t.TempDir(), "d.sock"))
+
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/team/info" {
+			_, _ = w.Write([]byte(`{"team_info": {"spend": 9.5, "max_budget": 10}}`))
+			return
+		}
+		callCount++
+		_, _ = w.Write([]byte(`{"info": {"team_id": "t1"}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	// As runDaemon does: keep the budget in memory.
+	budgetMemory.entries = make(map[string]BudgetCacheEntry)
+	t.Cleanup(func() { budgetMemory.entries = nil })
+
+	l, err := listenDaemon(socketPath())
+	if err != nil {
+		t.Fatalf("listenDaemon: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- serveDaemon(l, "text") }()
+
+	if _, err := listenDaemon(socketPath()); err == nil {
+		t.Error("expected a second daemon on the same socket to be refused")
+	}
+
+	var input StatusInput
+	input.Model.DisplayName = "Opus"
+	for i := range 2 {
+		reply, err := queryDaemon(daemonRequest{Input: input})
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if got := stripANSI(reply.Line); !strings.Contains(got, "95%") || !strings.Contains(got, "Opus") {
+			t.Errorf("query %d: expected the budget and the forwarded model, got %q", i, got)
+		}
+		if reply.ExitCode != ExitCrit {
+			t.Errorf("query %d: expected exit code %d for the critical band, got %d", i, ExitCrit, reply.ExitCode)
+		}
+		if i == 0 {
+			// Written through to disk, but later requests are answered from memory.
+			if _, err := os.Stat(budgetCacheFile()); err != nil {
+				t.Errorf("expected the budget written through to disk: %v", err)
+			}
+			_ = os.Remove(budgetCacheFile())
+		}
+	}
+	if callCount != 1 {
+		t.Errorf("expected the second query to be served from memory, got %d API calls", callCount)
+	}
+
+	// The client's output settings win over the daemon's text mode.
+	reply, err := queryDaemon(daemonRequest{Input: input, Mode: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out StatusJSON
+	if err := json.Unmarshal([]byte(reply.Line), &out); err != nil || out.Percent != 95 {
+		t.Errorf("expected a JSON reply with percent 95, got %q (%v)", reply.Line, err)
+	}
+	if reply, err = queryDaemon(daemonRequest{Input: input, Plain: true}); err != nil || strings.Contains(reply.Line, "\x1b[") {
+		t.Errorf("expected a plain reply, got %q (%v)", reply.Line, err)
+	}
+
+	_ = l.Close()
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+	if _, err := queryDaemon(daemonRequest{Input: input}); err == nil {
+		t.Error("expected an error once the daemon is gone")
+	}
+}
+
+// TestRunClientSendsOutputSettings verifies -client forwards its output mode and color
+// setting to the daemon and returns the daemon's exit code only under -exit-code.
+// The daemon is faked so it shares no globals with the client run.
+func TestRunClientSendsOutputSettings(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("LITELLM_SOCKET", filepath.Join(t.TempDir(), "d.sock"))
+	t.Setenv("LITELLM_OUTPUT", "logfmt")
+	t.Setenv("NO_COLOR", "1")
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+
+	l, err := listenDaemon(socketPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	requests := make(chan daemonRequest, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var req daemonRequest
+			_ = json.NewDecoder(conn).Decode(&req)
+			requests <- req
+			_ = json.NewEncoder(conn).Encode(daemonReply{Line: "percent=80", ExitCode: ExitWarn})
+			_ = conn.Close()
+		}
+	}()
+
+	if code := run([]string{"-file-only", "-client"}); code != ExitOK {
+		t.Errorf("expected ExitOK without -exit-code, got %d", code)
+	}
+	if req := <-requests; req.Mode != "logfmt" || !req.Plain {
+		t.Errorf("expected the client's logfmt mode without color, got %+v", req)
+	}
+	if data, err := os.ReadFile(out); err != nil || strings.TrimSpace(string(data)) != "percent=80" {
+		t.Errorf("expected the daemon's line, got %q (%v)", data, err)
+	}
+
+	if code := run([]string{"-file-only", "-client", "-exit-code", "-json"}); code != ExitWarn {
+		t.Errorf("expected the daemon's exit code %d with -exit-code, got %d", ExitWarn, code)
+	}
+	if req := <-requests; req.Mode != "json" {
+		t.Errorf("expected -json to be forwarded, got %+v", req)
+	}
+}
+
+func TestRunClientFallsBackWithoutDaemon(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "sk-test")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	out := filepath.Join(t.TempDir(), "out.txt")
+	t.Setenv("LITELLM_OUTPUT_FILE", out)
+
+	orig := outputFileOnly
+	defer func() { outputFileOnly = orig }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/team/info" {
+			_, _ = w.Write([]byte(`{"team_info": {"spend": 1, "max_budget": 10}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"info": {"team_id": "t1"}}`))
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	run([]string{"-file-only", "-client"})
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("expected status file, got %v", err)
+	}
+	if got := stripANSI(string(data)); !strings.Contains(got, "10%") {
+		t.Errorf("expected an in-process render, got %q", got)
+	}
+}
+
+func TestFormatStatusLineDebounce(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "https://debounce.example")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-debounce")
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_ALERT_BUDGET", "")
+	t.Setenv("LITELLM_DEBOUNCE_MS", "5000")
+
+	now := fixedNow
+	origNow := nowFunc
+	defer func() { nowFunc = origNow }()
+	nowFunc = func() time.Time { return now }
+
+	budget := 100.0
+	color := func(spend float64, at time.Duration) string {
+		now = fixedNow.Add(at)
+		info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+		got := formatStatusLine(info, "", withShownColor("text", info, StatusInput{}))
+		for _, c := range []string{ColorBrightRed, ColorRed, ColorYellow, ColorGreen} {
+			if strings.HasPrefix(got, c) {
+				return colorName(c)
+			}
+		}
+		return got
+	}
+
+	steps := []struct {
+		spend float64
+		at    time.Duration
+		want  string
+	}{
+		{74.9, 0, "green"},                // first state is shown immediately
+		{75.1, time.Second, "green"},      // flip to yellow starts pending
+		{74.9, 2 * time.Second, "green"},  // flipped back: pending cleared
+		{75.1, 3 * time.Second, "green"},  // yellow pending again from 3s
+		{75.2, 7 * time.Second, "green"},  // stable for 4s < 5s window
+		{75.3, 8 * time.Second, "yellow"}, // stable for 5s: shown
+		{74.9, 8500 * time.Millisecond, "yellow"},
+		{91, 9 * time.Second, "red"},               // critical shows at once
+		{80, 10 * time.Second, "red"},              // leaving it is debounced
+		{100, 11 * time.Second, "bright red"},      // so is exhausted
+		{80, 20 * time.Second, "bright red"},       // yellow pending from 20s
+		{80, 25 * time.Second, "yellow"},           // stable for 5s: shown
+		{74.9, 25500 * time.Millisecond, "yellow"}, // green pending
+	}
+	for i, s := range steps {
+		if got := color(s.spend, s.at); got != s.want {
+			t.Errorf("step %d (spend %.1f at %v): color = %s, want %s", i, s.spend, s.at, got, s.want)
+		}
+	}
+
+	// Renders outside the live text path neither read nor move the display state.
+	spend := 10.0
+	info := &KeyInfo{TeamSpend: &spend, TeamMaxBudget: &budget}
+	buildStatusJSON(info, "", StatusInput{}, nil)
+	renderStaleLine(info, "", StatusInput{})
+	if got := withShownColor("json", info, StatusInput{}); got.shownColor != "" {
+		t.Errorf("expected no debounced color for JSON, got %q", got.shownColor)
+	}
+	if state, _ := readDisplayState(); state.Color != ColorYellow || state.Pending != ColorGreen {
+		t.Errorf("display state = %+v, want yellow with green pending", state)
+	}
+
+	t.Setenv("LITELLM_DEBOUNCE_MS", "")
+	if got := color(74.9, 26*time.Second); got != "green" {
+		t.Errorf("expected no debouncing when disabled, got %s", got)
+	}
+}
+
+func TestModelsSegment(t *testing.T) {
+	var info KeyInfo
+	if err := json.Unmarshal([]byte(`{"spend": 1, "models": ["gpt-4", "claude-sonnet-4", "claude-opus-4", "gemini-2.5-pro", "o3"]}`), &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Models) != 5 {
+		t.Fatalf("expected 5 models parsed, got %v", info.Models)
+	}
+
+	tests := []struct {
+		name, mode, maxLen string
+		models             []string
+		want               string
+	}{
+		{"disabled", "", "", info.Models, ""},
+		{"count", "1", "", info.Models, " | 5 models"},
+		{"single", "count", "", []string{"gpt-4"}, " | 1 model"},
+		{"empty means all", "1", "", nil, " | all models"},
+		{"empty list mode", "list", "", []string{}, " | all models"},
+		{"short list", "list", "", []string{"gpt-4", "sonnet"}, " | gpt-4,sonnet"},
+		{"truncated list", "list", "", info.Models, " | gpt-4,claude-sonnet-4,claude-…"},
+		{"custom length", "list", "10", info.Models, " | gpt-4,cla…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LITELLM_SHOW_MODELS", tt.mode)
+			t.Setenv("LITELLM_MODELS_MAX_LEN", tt.maxLen)
+			if got := stripANSI(formatModelsSegment(&KeyInfo{Models: tt.models})); got != tt.want {
+				t.Errorf("formatModelsSegment() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("statusline", func(t *testing.T) {
+		t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+		t.Setenv("LITELLM_ALERT_BUDGET", "")
+		t.Setenv("LITELLM_SHOW_MODELS", "1")
+		spend, budget := 10.0, 100.0
+		key := &KeyInfo{Models: []string{"gpt-4", "o3"}, TeamSpend: &spend, TeamMaxBudget: &budget}
+		if got := stripANSI(formatStatusLine(key, "", StatusInput{})); got != "◔ 10% | 2 models" {
+			t.Errorf("expected the key's models on the statusline, got %q", got)
+		}
+	})
+}
+
+// unsetIconEnv clears the per-icon overrides (restored after the test), since an
+// empty LITELLM_ICON_* value means "no icon" rather than "use the preset".
+func unsetIconEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range []string{"LITELLM_ICON_MONEY", "LITELLM_ICON_CLOCK", "LITELLM_ICON_WARNING"} {
+		t.Setenv(key, "")
+		if err := os.Unsetenv(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIconPresets(t *testing.T) {
+	unsetIconEnv(t)
+
+	t.Setenv("LITELLM_PRESET", "")
+	if got := getIcons(); got != (iconSet{Warning: "⚠"}) {
+		t.Errorf("plain preset = %+v, want only the ⚠ warning", got)
+	}
+
+	t.Setenv("LITELLM_PRESET", "nerdfont")
+	if got := getIcons(); got != (iconSet{Money: "", Clock: "", Warning: ""}) {
+		t.Errorf("nerdfont preset = %+q", got)
+	}
+
+	t.Setenv("LITELLM_ICON_CLOCK", "⏱")
+	t.Setenv("LITELLM_ICON_WARNING", "")
+	if got := getIcons(); got != (iconSet{Money: "", Clock: "⏱", Warning: ""}) {
+		t.Errorf("expected icon vars to override the preset, got %+q", got)
+	}
+}
+
+func TestFormatStatusLineNerdFontIcons(t *testing.T) {
+	t.Setenv("LITELLM_PLUGIN_PREFIX", "")
+	t.Setenv("LITELLM_PLUGIN_SHOW_COST", "1")
+	t.Setenv("LITELLM_ALERT_BUDGET", "20")
+	t.Setenv("LITELLM_PRESET", "nerdfont")
+	unsetIconEnv(t)
+	setNow(t, fixedNow)
+
+	spend, budget := 25.0, 100.0
+	info := &KeyInfo{
+		TeamSpend:          &spend,
+		TeamMaxBudget:      &budget,
+		TeamBudgetDuration: strPtr("7d"),
+		TeamBudgetResetAt:  strPtr(fixedNow.Add(10 * time.Hour).Format(time.RFC3339)),
+	}
+	got := stripANSI(formatStatusLine(info, "", StatusInput{}))
+	want := "◔  $25.00/$100.00 (25%)  over alert  weekly reset: 10h"
+	if got != want {
+		t.Errorf("formatStatusLine() = %q, want %q", got, want)
+	}
+}
+
+func TestSpendWasReset(t *testing.T) {
+	tests := []struct {
+		before, after float64
+		want          bool
+	}{
+		{80, 2, true},
+		{80, 39.9, true},
+		{80, 40, false}, // exactly half is not enough
+		{80, 79, false}, // refund
+		{80, 90, false},
+		{0, 0, false},
+		{0.004, 0, true},
+	}
+	for _, tt := range tests {
+		if got := spendWasReset(tt.before, tt.after); got != tt.want {
+			t.Errorf("spendWasReset(%v, %v) = %v, want %v", tt.before, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestRefreshKeyInfoClearsHistoryOnReset(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("LITELLM_PROXY_URL", "")
+	t.Setenv("LITELLM_PROXY_API_KEY", "key-reset")
+	t.Setenv("LITELLM_SHOW_SPARKLINE", "1")
+	t.Setenv("LITELLM_DEBUG", "1")
+	setNow(t, fixedNow)
+
+	var logs strings.Builder
+	origOut := debugOut
+	defer func() { debugOut = origOut }()
+	debugOut = &logs
+
+	spend := 80.0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/key/info":
+			_, _ = w.Write([]byte(`{"info": {"team_id": "t1"}}`))
+		case "/team/info":
+			fmt.Fprintf(w, `{"team_info": {"spend": %v, "max_budget": 100}}`, spend)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+
+	for _, s := range []float64{70, 75, 80} {
+		spend = s
+		if _, err := refreshKeyInfo("key-reset", newBreaker()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(readSpendHistory()); n != 3 {
+		t.Fatalf("expected 3 history samples before the reset, got %d", n)
+	}
+
+	spend = 2
+	info, err := refreshKeyInfo("key-reset", newBreaker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := derefFloat(info.TeamSpend); got != 2 {
+		t.Errorf("expected the fresh spend 2, got %v", got)
+	}
+	if entry, ok := readBudgetCacheEntry(); !ok || derefFloat(entry.Info.TeamSpend) != 2 {
+		t.Errorf("expected the cache to be overwritten with spend 2")
+	}
+	if history := readSpendHistory(); len(history) != 1 || history[0].Spend != 2 {
+		t.Errorf("expected history to restart at the reset, got %+v", history)
+	}
+	if !strings.Contains(logs.String(), "spend dropped from $80.00 to $2.00, treating it as a budget reset") {
+		t.Errorf("expected a reset debug note, got %q", logs.String())
+	}
+}
+
+func TestFormatResetTimeLabelAndOverdue(t *testing.T) {
+	t.Setenv("LITELLM_RESET_FORMAT", "")
+	t.Setenv("LITELLM_RESET_UNITS", "")
+	tests := []struct {
+		name, label string
+		ago         time.Duration
+		want        string
+	}{
+		{"just passed", "", 30 * time.Second, "resetting"},
+		{"custom label", "pending", 5 * time.Minute, "pending"},
+		{"within grace", "", ProxyResetGrace, "resetting"},
+		{"long overdue", "", ProxyResetGrace + 5*time.Minute, "overdue by 20m"},
+		{"overdue ignores label", "pending", 3 * time.Hour, "overdue by 3h"},
+		{"under a minute left", "soon", -30 * time.Second, "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LITELLM_RESET_LABEL", tt.label)
+			if got := formatResetTime(fixedNow.Add(-tt.ago), fixedNow); got != tt.want {
+				t.Errorf("formatResetTime(%v ago) = %q, want %q", tt.ago, got, tt.want)
+			}
+		})
+	}
+}
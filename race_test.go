@@ -0,0 +1,7 @@
+//go:build race
+
+package main
+
+// raceEnabled reports whether the race detector is on; its instrumentation adds
+// allocations, so allocation-count tests skip themselves.
+const raceEnabled = true
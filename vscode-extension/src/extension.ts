@@ -6,6 +6,7 @@ import * as fs from "fs";
 
 /** Fields emitted by `claude-code-litellm-plugin --json`. All optional. */
 interface StatusJSON {
+  schema_version?: number;
   prefix?: string;
   text?: string;
   percent?: number;